@@ -0,0 +1,536 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+// A backup is a backend-neutral stream of (context path, key, value) records. Any
+// Database can restore a backup taken from any other Database, since records name
+// contexts by path rather than by bolt bucket or badger prefix.
+//
+// All integers are big-endian unless noted as uvarint (encoding/binary varint).
+//
+//	Backup  := Header Record* Trailer
+//	Header  := Magic[8] Version uint16 SourceId uint8 Lineage[16] Since uint64 Until uint64
+//	Record  := (0x01 | 0x02) BodyLength uvarint Body Checksum uint32
+//	Body    := NumSegments uvarint (SegmentLength uvarint Segment)*
+//	           KeyLength uvarint Key ValueLength uvarint Value
+//	Trailer := 0xFF RecordCount uint64 Checksum uint32
+//
+// Magic is "BBXBAKUP" and SourceId is the DatabaseId the backup was taken from. A
+// record's Checksum is the CRC-32C of its Body. The trailer's Checksum is the CRC-32C of
+// every byte of the stream that precedes it, so a truncated or spliced stream is
+// detected even if every record is intact. A record with no path segments holds a key
+// that the source database could not attribute to any context.
+//
+// Lineage identifies the source database, and Since and Until are versions of it: a
+// backup holds the changes committed after Since up to and including Until. A full
+// backup has Since set to zero and only holds 0x01 records, which set a key. An
+// incremental backup also holds 0x02 records, which delete a key and have an empty
+// Value, and it can be applied on top of the backup whose Until equals its Since.
+//
+// A record's BodyLength is at most MaxBackupRecordSize, so that a corrupt length is
+// rejected before the body is read.
+const (
+	BackupFormatVersion uint16 = 2
+
+	// MaxBackupRecordSize is 1 GB, the largest value Badger's default value log takes.
+	MaxBackupRecordSize = 1 << 30
+
+	backupRecordTag  byte = 0x01
+	backupDeleteTag  byte = 0x02
+	backupTrailerTag byte = 0xFF
+)
+
+var (
+	backupMagic = []byte("BBXBAKUP")
+
+	backupCrcTable = crc32.MakeTable(crc32.Castagnoli)
+
+	ErrIncrementalBackupUnavailable = errors.New("BackupSince: changes since the requested version are not tracked")
+	ErrBrokenBackupChain            = errors.New("RestoreChain: backups do not form a chain")
+)
+
+// BackupLineage identifies a database across backups, so an incremental backup is never
+// applied on top of a backup of another database.
+type BackupLineage [16]byte
+
+type BackupHeader struct {
+	SourceId DatabaseId
+	Lineage  BackupLineage
+	// Since is zero for a full backup.
+	Since uint64
+	Until uint64
+}
+
+func (header BackupHeader) Full() bool {
+	return header.Since == 0
+}
+
+type BackupRecord struct {
+	Path  [][]byte
+	Key   []byte
+	Value []byte
+	// Delete is set for records of an incremental backup that delete Key.
+	Delete bool
+}
+
+// ==========================
+// BackupWriter
+// ==========================
+
+type BackupWriter struct {
+	writer      *bufio.Writer
+	streamCrc   hash.Hash32
+	recordCount uint64
+	body        []byte
+}
+
+func NewBackupWriter(w io.Writer, header BackupHeader) (*BackupWriter, error) {
+	bw := &BackupWriter{
+		writer:    bufio.NewWriter(w),
+		streamCrc: crc32.New(backupCrcTable),
+	}
+
+	encoded := make([]byte, 0, len(backupMagic)+35)
+	encoded = append(encoded, backupMagic...)
+	encoded = binary.BigEndian.AppendUint16(encoded, BackupFormatVersion)
+	encoded = append(encoded, byte(header.SourceId))
+	encoded = append(encoded, header.Lineage[:]...)
+	encoded = binary.BigEndian.AppendUint64(encoded, header.Since)
+	encoded = binary.BigEndian.AppendUint64(encoded, header.Until)
+	if err := bw.write(encoded); err != nil {
+		return nil, errors.Wrapf(err, "NewBackupWriter: Problem writing header")
+	}
+	return bw, nil
+}
+
+func (bw *BackupWriter) WriteRecord(path [][]byte, key []byte, value []byte) error {
+	return errors.Wrapf(bw.writeRecord(backupRecordTag, path, key, value), "WriteRecord:")
+}
+
+// WriteDelete records that key was deleted. It is only valid in incremental backups.
+func (bw *BackupWriter) WriteDelete(path [][]byte, key []byte) error {
+	return errors.Wrapf(bw.writeRecord(backupDeleteTag, path, key, nil), "WriteDelete:")
+}
+
+func (bw *BackupWriter) writeRecord(tag byte, path [][]byte, key []byte, value []byte) error {
+	body := bw.body[:0]
+	body = binary.AppendUvarint(body, uint64(len(path)))
+	for _, segment := range path {
+		body = appendLengthPrefixed(body, segment)
+	}
+	body = appendLengthPrefixed(body, key)
+	body = appendLengthPrefixed(body, value)
+	bw.body = body
+	if len(body) > MaxBackupRecordSize {
+		return errors.Errorf("Record of %v bytes is larger than %v bytes", len(body), MaxBackupRecordSize)
+	}
+
+	record := make([]byte, 0, 1+binary.MaxVarintLen64)
+	record = append(record, tag)
+	record = binary.AppendUvarint(record, uint64(len(body)))
+	if err := bw.write(record); err != nil {
+		return err
+	}
+	if err := bw.write(body); err != nil {
+		return err
+	}
+	if err := bw.write(binary.BigEndian.AppendUint32(nil, crc32.Checksum(body, backupCrcTable))); err != nil {
+		return err
+	}
+	bw.recordCount++
+	return nil
+}
+
+// Close writes the trailer and flushes the stream. It does not close the underlying writer.
+func (bw *BackupWriter) Close() error {
+	trailer := []byte{backupTrailerTag}
+	trailer = binary.BigEndian.AppendUint64(trailer, bw.recordCount)
+	if err := bw.write(trailer); err != nil {
+		return errors.Wrapf(err, "Close: Problem writing trailer")
+	}
+	if _, err := bw.writer.Write(binary.BigEndian.AppendUint32(nil, bw.streamCrc.Sum32())); err != nil {
+		return errors.Wrapf(err, "Close: Problem writing trailer")
+	}
+	return errors.Wrapf(bw.writer.Flush(), "Close: Problem flushing backup")
+}
+
+func (bw *BackupWriter) write(data []byte) error {
+	bw.streamCrc.Write(data)
+	_, err := bw.writer.Write(data)
+	return err
+}
+
+func appendLengthPrefixed(dst []byte, data []byte) []byte {
+	dst = binary.AppendUvarint(dst, uint64(len(data)))
+	return append(dst, data...)
+}
+
+// ==========================
+// BackupReader
+// ==========================
+
+type BackupReader struct {
+	reader      *bufio.Reader
+	streamCrc   hash.Hash32
+	recordCount uint64
+	header      BackupHeader
+	done        bool
+}
+
+func NewBackupReader(r io.Reader) (*BackupReader, error) {
+	br := &BackupReader{
+		reader:    bufio.NewReader(r),
+		streamCrc: crc32.New(backupCrcTable),
+	}
+
+	header, err := br.read(len(backupMagic) + 3)
+	if err != nil {
+		return nil, errors.Wrapf(err, "NewBackupReader: Problem reading header")
+	}
+	if !bytes.Equal(header[:len(backupMagic)], backupMagic) {
+		return nil, errors.New("NewBackupReader: Not a backup stream")
+	}
+	version := binary.BigEndian.Uint16(header[len(backupMagic):])
+	if version != BackupFormatVersion {
+		return nil, errors.Errorf("NewBackupReader: Unsupported backup version %v", version)
+	}
+	br.header.SourceId = DatabaseId(header[len(backupMagic)+2])
+
+	versions, err := br.read(len(br.header.Lineage) + 16)
+	if err != nil {
+		return nil, errors.Wrapf(err, "NewBackupReader: Problem reading header")
+	}
+	copy(br.header.Lineage[:], versions)
+	br.header.Since = binary.BigEndian.Uint64(versions[len(br.header.Lineage):])
+	br.header.Until = binary.BigEndian.Uint64(versions[len(br.header.Lineage)+8:])
+	if br.header.Since > br.header.Until {
+		return nil, errors.Errorf("NewBackupReader: Backup starts at version %v after it ends at %v",
+			br.header.Since, br.header.Until)
+	}
+	return br, nil
+}
+
+// SourceId is the id of the database the backup was taken from.
+func (br *BackupReader) SourceId() DatabaseId {
+	return br.header.SourceId
+}
+
+func (br *BackupReader) Header() BackupHeader {
+	return br.header
+}
+
+// Next returns the next record, or io.EOF once the trailer has been read and verified.
+func (br *BackupReader) Next() (*BackupRecord, error) {
+	if br.done {
+		return nil, io.EOF
+	}
+
+	tag, err := br.read(1)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Next: Problem reading record")
+	}
+	switch tag[0] {
+	case backupRecordTag:
+		return br.readRecord()
+	case backupDeleteTag:
+		if br.header.Full() {
+			return nil, errors.Errorf("Next: Delete record %v in a full backup", br.recordCount)
+		}
+		record, err := br.readRecord()
+		if err != nil {
+			return nil, err
+		}
+		record.Delete = true
+		return record, nil
+	case backupTrailerTag:
+		return nil, br.readTrailer()
+	default:
+		return nil, errors.Errorf("Next: Invalid record tag %x", tag[0])
+	}
+}
+
+func (br *BackupReader) readRecord() (*BackupRecord, error) {
+	bodyLength, err := br.readUvarint()
+	if err != nil {
+		return nil, errors.Wrapf(err, "Next: Problem reading record length")
+	}
+	if bodyLength > MaxBackupRecordSize {
+		return nil, errors.Errorf("Next: Malformed record %v of %v bytes", br.recordCount, bodyLength)
+	}
+	body, err := br.read(int(bodyLength))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Next: Problem reading record")
+	}
+	checksum, err := br.read(4)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Next: Problem reading record checksum")
+	}
+	if binary.BigEndian.Uint32(checksum) != crc32.Checksum(body, backupCrcTable) {
+		return nil, errors.Errorf("Next: Checksum mismatch in record %v", br.recordCount)
+	}
+
+	record := &BackupRecord{}
+	numSegments, n := binary.Uvarint(body)
+	if n <= 0 || numSegments > uint64(len(body)) {
+		return nil, errors.Errorf("Next: Malformed record %v", br.recordCount)
+	}
+	body = body[n:]
+	fields := make([][]byte, numSegments+2)
+	for ii := range fields {
+		length, n := binary.Uvarint(body)
+		if n <= 0 || length > uint64(len(body)-n) {
+			return nil, errors.Errorf("Next: Malformed record %v", br.recordCount)
+		}
+		fields[ii] = body[n : n+int(length)]
+		body = body[n+int(length):]
+	}
+	if len(body) != 0 {
+		return nil, errors.Errorf("Next: Malformed record %v", br.recordCount)
+	}
+	record.Path = fields[:numSegments]
+	record.Key = fields[numSegments]
+	record.Value = fields[numSegments+1]
+
+	br.recordCount++
+	return record, nil
+}
+
+func (br *BackupReader) readTrailer() error {
+	count, err := br.read(8)
+	if err != nil {
+		return errors.Wrapf(err, "Next: Problem reading trailer")
+	}
+	expectedCrc := br.streamCrc.Sum32()
+	checksum := make([]byte, 4)
+	if _, err := io.ReadFull(br.reader, checksum); err != nil {
+		return errors.Wrapf(err, "Next: Problem reading trailer")
+	}
+	if recordCount := binary.BigEndian.Uint64(count); recordCount != br.recordCount {
+		return errors.Errorf("Next: Trailer expects %v records but backup has %v", recordCount, br.recordCount)
+	}
+	if binary.BigEndian.Uint32(checksum) != expectedCrc {
+		return errors.New("Next: Backup checksum mismatch")
+	}
+	br.done = true
+	return io.EOF
+}
+
+func (br *BackupReader) read(length int) ([]byte, error) {
+	data := make([]byte, length)
+	if _, err := io.ReadFull(br.reader, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	br.streamCrc.Write(data)
+	return data, nil
+}
+
+func (br *BackupReader) readUvarint() (uint64, error) {
+	value, err := binary.ReadUvarint(br.reader)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	br.streamCrc.Write(binary.AppendUvarint(nil, value))
+	return value, nil
+}
+
+// forEachRecord streams a backup of db through fn without buffering it. Returning an
+// error from fn stops the backup.
+func forEachRecord(db Database, fn func(*BackupRecord) error) error {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(db.Backup(pw))
+	}()
+
+	err := func() error {
+		br, err := NewBackupReader(pr)
+		if err != nil {
+			return err
+		}
+		for {
+			record, err := br.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := fn(record); err != nil {
+				return err
+			}
+		}
+	}()
+	// Unblock the backup if we stopped reading early.
+	pr.CloseWithError(io.ErrClosedPipe)
+	return err
+}
+
+// ==========================
+// Restore
+// ==========================
+
+// GetContextForPath resolves a context path, as returned by Context.Path, in db.
+func GetContextForPath(db Database, path [][]byte) Context {
+	if len(path) == 0 {
+		return db.GetContext(nil)
+	}
+	ctx := db.GetContext(path[0])
+	for _, segment := range path[1:] {
+		ctx = ctx.NestContext(segment)
+	}
+	return ctx
+}
+
+// restoreBackup writes every record of the backup into db through a WriteBatch. The
+// restore is not atomic, and a corrupted backup is only detected once the records
+// preceding the corruption have been written, so it should target an empty database.
+// An incremental backup can only be restored as part of a chain, with RestoreChain.
+func restoreBackup(db Database, r io.Reader) error {
+	br, err := NewBackupReader(r)
+	if err != nil {
+		return err
+	}
+	if !br.Header().Full() {
+		return errors.Wrapf(ErrBrokenBackupChain, "Backup is incremental since version %v", br.Header().Since)
+	}
+	return applyBackup(db, br)
+}
+
+// RestoreChain restores a full backup followed by incremental backups, in order. Every
+// header is checked with VerifyBackupChain before any record is written, so a missing,
+// duplicated or foreign backup leaves db untouched. As with Restore, the target should
+// be empty.
+func RestoreChain(db Database, backups ...io.Reader) error {
+	readers := make([]*BackupReader, len(backups))
+	headers := make([]BackupHeader, len(backups))
+	for ii, backup := range backups {
+		br, err := NewBackupReader(backup)
+		if err != nil {
+			return errors.Wrapf(err, "RestoreChain: Problem reading backup %v", ii)
+		}
+		readers[ii] = br
+		headers[ii] = br.Header()
+	}
+	if err := VerifyBackupChain(headers); err != nil {
+		return err
+	}
+
+	for ii, br := range readers {
+		if err := applyBackup(db, br); err != nil {
+			return errors.Wrapf(err, "RestoreChain: Problem restoring backup %v", ii)
+		}
+	}
+	return nil
+}
+
+// VerifyBackupChain checks that headers start with a full backup and that every
+// following backup is an incremental backup of the same database, starting where the
+// previous one ended.
+func VerifyBackupChain(headers []BackupHeader) error {
+	if len(headers) == 0 {
+		return errors.Wrapf(ErrBrokenBackupChain, "No backups")
+	}
+	if !headers[0].Full() {
+		return errors.Wrapf(ErrBrokenBackupChain, "First backup is incremental since version %v", headers[0].Since)
+	}
+	for ii := 1; ii < len(headers); ii++ {
+		previous, current := headers[ii-1], headers[ii]
+		if current.SourceId != previous.SourceId || current.Lineage != previous.Lineage {
+			return errors.Wrapf(ErrBrokenBackupChain, "Backup %v was taken from another database", ii)
+		}
+		if current.Full() {
+			return errors.Wrapf(ErrBrokenBackupChain, "Backup %v is a full backup", ii)
+		}
+		if current.Since != previous.Until {
+			return errors.Wrapf(ErrBrokenBackupChain, "Backup %v starts at version %v but backup %v ends at %v",
+				ii, current.Since, ii-1, previous.Until)
+		}
+	}
+	return nil
+}
+
+func applyBackup(db Database, br *BackupReader) error {
+	wb := db.NewWriteBatch()
+	defer wb.Cancel()
+	contexts := make(map[string]Context)
+	for {
+		record, err := br.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		pathKey := string(encodeContextPath(record.Path))
+		ctx, exists := contexts[pathKey]
+		if !exists {
+			ctx = GetContextForPath(db, record.Path)
+			contexts[pathKey] = ctx
+		}
+		if record.Delete {
+			err = wb.Delete(record.Key, ctx)
+		} else {
+			err = wb.Set(record.Key, record.Value, ctx)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "Problem restoring key %x in context %q", record.Key, record.Path)
+		}
+	}
+	return wb.Flush()
+}
+
+// encodeContextPath encodes a context path as a sequence of length-prefixed segments.
+func encodeContextPath(path [][]byte) []byte {
+	var encoded []byte
+	for _, segment := range path {
+		encoded = appendLengthPrefixed(encoded, segment)
+	}
+	return encoded
+}
+
+func decodeContextPath(encoded []byte) ([][]byte, error) {
+	var path [][]byte
+	for len(encoded) > 0 {
+		length, n := binary.Uvarint(encoded)
+		if n <= 0 || length > uint64(len(encoded)-n) {
+			return nil, errors.New("decodeContextPath: Malformed context path")
+		}
+		path = append(path, encoded[n:n+int(length)])
+		encoded = encoded[n+int(length):]
+	}
+	return path, nil
+}
+
+// encodeRecordLocation encodes the context path and key of a record.
+func encodeRecordLocation(path [][]byte, key []byte) []byte {
+	pathBytes := encodeContextPath(path)
+	location := binary.AppendUvarint(nil, uint64(len(pathBytes)))
+	location = append(location, pathBytes...)
+	return append(location, key...)
+}
+
+func decodeRecordLocation(location []byte) (_path [][]byte, _key []byte, _err error) {
+	length, n := binary.Uvarint(location)
+	if n <= 0 || length > uint64(len(location)-n) {
+		return nil, nil, errors.New("decodeRecordLocation: Malformed location")
+	}
+	path, err := decodeContextPath(location[n : n+int(length)])
+	if err != nil {
+		return nil, nil, err
+	}
+	return path, location[n+int(length):], nil
+}
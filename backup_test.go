@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"github.com/dgraph-io/badger/v4"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"io"
+	"os"
+	"sort"
+	"testing"
+)
+
+// TestBackup_CrossBackendRoundTrip restores a Bolt backup into Badger, then a backup of that
+// Badger database into a fresh Bolt database, and checks that no record was lost on the way.
+func TestBackup_CrossBackendRoundTrip(t *testing.T) {
+	require := require.New(t)
+
+	source := newTestBoltDatabase("boltdb-backup-source", t)
+	defer source.Erase()
+	defer source.Close()
+	populateBackupTestDatabase(source, t)
+
+	var sourceBackup bytes.Buffer
+	require.NoError(source.Backup(&sourceBackup))
+
+	badgerDb := newTestBadgerDatabase("badgerdb-backup", t)
+	defer badgerDb.Erase()
+	defer badgerDb.Close()
+	require.NoError(badgerDb.Restore(bytes.NewReader(sourceBackup.Bytes())))
+
+	var badgerBackup bytes.Buffer
+	require.NoError(badgerDb.Backup(&badgerBackup))
+
+	target := newTestBoltDatabase("boltdb-backup-target", t)
+	defer target.Erase()
+	defer target.Close()
+	require.NoError(target.Restore(bytes.NewReader(badgerBackup.Bytes())))
+
+	var targetBackup bytes.Buffer
+	require.NoError(target.Backup(&targetBackup))
+
+	expected := readBackupRecords(sourceBackup.Bytes(), t)
+	require.Len(expected, 30)
+	require.Equal(expected, readBackupRecords(badgerBackup.Bytes(), t))
+	require.Equal(expected, readBackupRecords(targetBackup.Bytes(), t))
+}
+
+// TestBackup_CollidingContextIds writes keys to Badger contexts whose ids and keys
+// concatenate to the same bytes, and checks that a backup attributes every key to the
+// context it was written to.
+func TestBackup_CollidingContextIds(t *testing.T) {
+	require := require.New(t)
+
+	db := newTestBadgerDatabase("badgerdb-backup-colliding", t)
+	defer db.Erase()
+	defer db.Close()
+
+	a := db.GetContext([]byte("a"))
+	writes := []struct {
+		ctx Context
+		key string
+	}{
+		{a, "bc"},
+		{a.NestContext([]byte("b")), "c"},
+		{db.GetContext([]byte("ab")), "c"},
+	}
+	var expected []*BackupRecord
+	for _, write := range writes {
+		require.NoError(db.Update(write.ctx, func(tx Transaction, ctx Context) error {
+			return tx.Set([]byte(write.key), []byte(write.key), ctx)
+		}))
+		expected = append(expected, &BackupRecord{Path: write.ctx.Path(), Key: []byte(write.key), Value: []byte(write.key)})
+	}
+	require.NoError(db.View(a, func(tx Transaction, ctx Context) error {
+		it, err := tx.GetIterator(ctx)
+		if err != nil {
+			return err
+		}
+		defer it.Close()
+		var keys []string
+		for valid := it.Seek(nil); valid; valid = it.Next() {
+			keys = append(keys, string(iteratorLocalKey(it)))
+		}
+		require.Equal([]string{"bc"}, keys)
+		return nil
+	}))
+
+	var backup bytes.Buffer
+	require.NoError(db.Backup(&backup))
+	sort.Slice(expected, func(ii, jj int) bool {
+		return bytes.Compare(encodeContextPath(expected[ii].Path), encodeContextPath(expected[jj].Path)) < 0
+	})
+	require.Equal(expected, readBackupRecords(backup.Bytes(), t))
+
+	target := newTestBoltDatabase("boltdb-backup-colliding", t)
+	defer target.Erase()
+	defer target.Close()
+	require.NoError(target.Restore(bytes.NewReader(backup.Bytes())))
+	var targetBackup bytes.Buffer
+	require.NoError(target.Backup(&targetBackup))
+	require.Equal(expected, readBackupRecords(targetBackup.Bytes(), t))
+}
+
+// TestBackup_EmptyContextId backs up Badger contexts with empty ids, restores them into
+// Bolt, which can't name a bucket with an empty id, and back into Badger.
+func TestBackup_EmptyContextId(t *testing.T) {
+	require := require.New(t)
+
+	source := newTestBadgerDatabase("badgerdb-backup-empty-id", t)
+	defer source.Erase()
+	defer source.Close()
+	empty := source.GetContext([]byte{})
+	writes := []Context{empty, empty.NestContext([]byte{}), source.GetContext([]byte("a")).NestContext([]byte{})}
+	for _, ctx := range writes {
+		require.NoError(source.Update(ctx, func(tx Transaction, ctx Context) error {
+			return tx.Set([]byte("key"), []byte("value"), ctx)
+		}))
+	}
+	var sourceBackup bytes.Buffer
+	require.NoError(source.Backup(&sourceBackup))
+	expected := readBackupRecords(sourceBackup.Bytes(), t)
+	require.Len(expected, 3)
+
+	boltDb := newTestBoltDatabase("boltdb-backup-empty-id", t)
+	defer boltDb.Erase()
+	defer boltDb.Close()
+	require.NoError(boltDb.Restore(bytes.NewReader(sourceBackup.Bytes())))
+	require.NoError(boltDb.View(boltDb.GetContext([]byte{}), func(tx Transaction, ctx Context) error {
+		value, err := tx.Get([]byte("key"), ctx)
+		require.NoError(err)
+		require.Equal([]byte("value"), value)
+		return nil
+	}))
+	var boltBackup bytes.Buffer
+	require.NoError(boltDb.Backup(&boltBackup))
+	require.Equal(expected, readBackupRecords(boltBackup.Bytes(), t))
+
+	target := newTestBadgerDatabase("badgerdb-backup-empty-id-target", t)
+	defer target.Erase()
+	defer target.Close()
+	require.NoError(target.Restore(bytes.NewReader(boltBackup.Bytes())))
+	var targetBackup bytes.Buffer
+	require.NoError(target.Backup(&targetBackup))
+	require.Equal(expected, readBackupRecords(targetBackup.Bytes(), t))
+
+	// The bucket standing for the empty id can't be used as an id itself.
+	err := boltDb.Update(boltDb.GetContext([]byte("a")).NestContext(boltEmptyIdBucket), func(tx Transaction, ctx Context) error {
+		return tx.Set([]byte("key"), []byte("value"), ctx)
+	})
+	require.True(errors.Is(err, ErrReservedContextId))
+}
+
+// TestBadgerFormatVersion reopens a Badger database whose format version was changed,
+// and one whose version was removed although it holds keys.
+func TestBadgerFormatVersion(t *testing.T) {
+	require := require.New(t)
+
+	db := newTestBadgerDatabase("badgerdb-format", t)
+	defer db.Erase()
+	populateBackupTestDatabase(db, t)
+	require.NoError(db.Close())
+
+	for _, version := range [][]byte{binary.BigEndian.AppendUint32(nil, badgerFormatVersion+1), nil} {
+		raw, err := badger.Open(db.opts)
+		require.NoError(err)
+		require.NoError(raw.Update(func(txn *badger.Txn) error {
+			if version == nil {
+				return txn.Delete(badgerFormatKey)
+			}
+			return txn.Set(badgerFormatKey, version)
+		}))
+		require.NoError(raw.Close())
+
+		err = db.SetupContext(context.Background())
+		require.True(errors.Is(err, ErrBadgerFormatMismatch), "%v", err)
+	}
+}
+
+// TestBackup_DetectsCorruption flips a byte in a backup and truncates another.
+func TestBackup_DetectsCorruption(t *testing.T) {
+	require := require.New(t)
+
+	source := newTestBoltDatabase("boltdb-backup-corrupt", t)
+	defer source.Erase()
+	defer source.Close()
+	populateBackupTestDatabase(source, t)
+
+	var backup bytes.Buffer
+	require.NoError(source.Backup(&backup))
+
+	corrupted := append([]byte{}, backup.Bytes()...)
+	corrupted[len(corrupted)/2] ^= 0xFF
+	target := newTestBoltDatabase("boltdb-backup-corrupt-target", t)
+	defer target.Erase()
+	defer target.Close()
+	require.Error(target.Restore(bytes.NewReader(corrupted)))
+
+	truncated := backup.Bytes()[:backup.Len()-20]
+	require.Error(target.Restore(bytes.NewReader(truncated)))
+
+	// A huge record length is rejected before the body is allocated.
+	var hostile bytes.Buffer
+	writer, err := NewBackupWriter(&hostile, BackupHeader{SourceId: BOLTDB})
+	require.NoError(err)
+	require.NoError(writer.writer.Flush())
+	hostile.WriteByte(backupRecordTag)
+	hostile.Write(binary.AppendUvarint(nil, 1<<62))
+	reader, err := NewBackupReader(&hostile)
+	require.NoError(err)
+	_, err = reader.Next()
+	require.ErrorContains(err, "Malformed record")
+}
+
+func newTestBoltDatabase(pattern string, t *testing.T) *BoltDatabase {
+	dir, err := os.MkdirTemp("", pattern)
+	require.NoError(t, err)
+	db := NewBoltDatabase(dir)
+	require.NoError(t, db.Setup())
+	return db
+}
+
+func newTestBadgerDatabase(pattern string, t *testing.T) *BadgerDatabase {
+	dir, err := os.MkdirTemp("", pattern)
+	require.NoError(t, err)
+	db := NewBadgerDatabase(DefaultBadgerOptions(dir))
+	require.NoError(t, db.Setup())
+	return db
+}
+
+// populateBackupTestDatabase writes 10 keys to each of a top-level, a nested and a second
+// top-level context.
+func populateBackupTestDatabase(db Database, t *testing.T) {
+	accounts := db.GetContext([]byte("accounts"))
+	contexts := []Context{accounts, accounts.NestContext([]byte("balances")), db.GetContext([]byte("blocks"))}
+	for _, ctx := range contexts {
+		require.NoError(t, db.Update(ctx, func(tx Transaction, ctx Context) error {
+			for ii := 0; ii < 10; ii++ {
+				value, err := RandomBytes(100)
+				if err != nil {
+					return err
+				}
+				if err := tx.Set([]byte{'k', byte(ii)}, value, ctx); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+	}
+}
+
+// readBackupRecords returns the records of a backup in a canonical order.
+func readBackupRecords(backup []byte, t *testing.T) []*BackupRecord {
+	br, err := NewBackupReader(bytes.NewReader(backup))
+	require.NoError(t, err)
+	var records []*BackupRecord
+	for {
+		record, err := br.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		records = append(records, record)
+	}
+	sort.Slice(records, func(ii, jj int) bool {
+		pathCmp := bytes.Compare(encodeContextPath(records[ii].Path), encodeContextPath(records[jj].Path))
+		if pathCmp != 0 {
+			return pathCmp < 0
+		}
+		return bytes.Compare(records[ii].Key, records[jj].Key) < 0
+	})
+	return records
+}
+
+// TestBackup_IncrementalChain restores a full backup and two incremental backups of each
+// backend into the other backend.
+func TestBackup_IncrementalChain(t *testing.T) {
+	boltDir, err := os.MkdirTemp("", "boltdb-backup-incremental")
+	require.NoError(t, err)
+	boltDb := NewBoltDatabaseWithChangeTracking(boltDir)
+	require.NoError(t, boltDb.Setup())
+	defer boltDb.Erase()
+	defer boltDb.Close()
+	badgerTarget := newTestBadgerDatabase("badgerdb-backup-incremental-target", t)
+	defer badgerTarget.Erase()
+	defer badgerTarget.Close()
+	GenericIncrementalBackupTest(boltDb, badgerTarget, t)
+
+	badgerDb := newTestBadgerDatabase("badgerdb-backup-incremental", t)
+	defer badgerDb.Erase()
+	defer badgerDb.Close()
+	boltTarget := newTestBoltDatabase("boltdb-backup-incremental-target", t)
+	defer boltTarget.Erase()
+	defer boltTarget.Close()
+	GenericIncrementalBackupTest(badgerDb, boltTarget, t)
+
+	// Without change tracking, Bolt can only take full backups.
+	untracked := newTestBoltDatabase("boltdb-backup-untracked", t)
+	defer untracked.Erase()
+	defer untracked.Close()
+	since, err := untracked.BackupSince(io.Discard, 0)
+	require.NoError(t, err)
+	_, err = untracked.BackupSince(io.Discard, since)
+	require.True(t, errors.Is(err, ErrIncrementalBackupUnavailable))
+
+	// The bucket tracking the changes can't be used as a top-level context.
+	setKey := func(tx Transaction, ctx Context) error {
+		return tx.Set([]byte("key"), []byte("value"), ctx)
+	}
+	err = boltDb.Update(boltDb.GetContext(boltMetaBucket), setKey)
+	require.True(t, errors.Is(err, ErrReservedContextId))
+	require.NoError(t, boltDb.Update(boltDb.GetContext([]byte("accounts")).NestContext(boltMetaBucket), setKey))
+}
+
+func GenericIncrementalBackupTest(source Database, target Database, t *testing.T) {
+	require := require.New(t)
+
+	populateBackupTestDatabase(source, t)
+	var full, first, second bytes.Buffer
+	since, err := source.BackupSince(&full, 0)
+	require.NoError(err)
+
+	accounts := source.GetContext([]byte("accounts"))
+	require.NoError(source.Update(accounts, func(tx Transaction, ctx Context) error {
+		if err := tx.Set([]byte{'k', 0}, []byte("updated"), ctx); err != nil {
+			return err
+		}
+		return tx.Delete([]byte{'k', 1}, ctx)
+	}))
+	since, err = source.BackupSince(&first, since)
+	require.NoError(err)
+
+	require.NoError(source.Update(accounts, func(tx Transaction, ctx Context) error {
+		// Deleted and recreated between backups.
+		if err := tx.Set([]byte{'k', 1}, []byte("recreated"), ctx); err != nil {
+			return err
+		}
+		return tx.Set([]byte("new"), []byte("value"), ctx.NestContext([]byte("orders")))
+	}))
+	require.NoError(source.Update(source.GetContext([]byte("blocks")), func(tx Transaction, ctx Context) error {
+		return tx.Delete([]byte{'k', 9}, ctx)
+	}))
+	_, err = source.BackupSince(&second, since)
+	require.NoError(err)
+	require.Len(readBackupRecords(second.Bytes(), t), 3)
+
+	// Skipping a link, or restoring an incremental backup on its own, is refused.
+	err = RestoreChain(target, bytes.NewReader(full.Bytes()), bytes.NewReader(second.Bytes()))
+	require.True(errors.Is(err, ErrBrokenBackupChain))
+	require.Error(target.Restore(bytes.NewReader(first.Bytes())))
+
+	require.NoError(RestoreChain(target, bytes.NewReader(full.Bytes()),
+		bytes.NewReader(first.Bytes()), bytes.NewReader(second.Bytes())))
+
+	var sourceBackup, targetBackup bytes.Buffer
+	require.NoError(source.Backup(&sourceBackup))
+	require.NoError(target.Backup(&targetBackup))
+	expected := readBackupRecords(sourceBackup.Bytes(), t)
+	require.Len(expected, 30)
+	require.Equal(expected, readBackupRecords(targetBackup.Bytes(), t))
+}
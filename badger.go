@@ -1,10 +1,19 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
 	"github.com/dgraph-io/badger/v4"
+	"github.com/dgraph-io/badger/v4/pb"
+	"github.com/dgraph-io/ristretto/z"
 	"github.com/pkg/errors"
+	"io"
 	"log"
 	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
 )
 
 const (
@@ -16,18 +25,81 @@ const (
 	PerformanceLogValueSize = 256 << 20
 )
 
+var (
+	// badgerMetaPrefix is reserved for keys Badger stores about the database itself.
+	badgerMetaPrefix = []byte("__meta/")
+
+	badgerCatalogPrefix = []byte("__meta/contexts/")
+
+	badgerLineageKey = []byte("__meta/lineage")
+
+	// badgerFormatKey holds the version of the key layout the database was written with.
+	badgerFormatKey = []byte("__meta/format")
+
+	ErrBadgerFormatMismatch = errors.New("Database was written with another key layout")
+)
+
+const (
+	// badgerPathSegmentTag starts every id of a context prefix, and badgerPathEndTag ends
+	// the prefix. Neither can start a meta key.
+	badgerPathSegmentTag byte = 0x01
+	badgerPathEndTag     byte = 0x00
+
+	// badgerFormatVersion is the version of the key layout. Version 1 prefixes keys with
+	// self-delimiting context paths.
+	badgerFormatVersion uint32 = 1
+)
+
 type BadgerDatabase struct {
-	db            *badger.DB
-	opts          badger.Options
-	useWriteBatch bool
+	db       *badger.DB
+	opts     badger.Options
+	contexts *badgerContextCatalog
+	lineage  BackupLineage
+
+	// gcOpts enables the value log GC scheduler, which runs from Setup to Close.
+	gcOpts *ValueLogGCOptions
+	gc     *valueLogGC
+	// writes is the number of keys written or deleted, which the scheduler watches
+	// to back off under write load.
+	writes atomic.Uint64
+
+	// retry reruns Updates that conflict, if set.
+	retry *conflictRetrier
+
+	commitHooks
 }
 
-func NewBadgerDatabase(opts badger.Options, useWriteBatch bool) *BadgerDatabase {
+func NewBadgerDatabase(opts badger.Options) *BadgerDatabase {
 	return &BadgerDatabase{
-		db:            nil,
-		opts:          opts,
-		useWriteBatch: useWriteBatch,
+		db:       nil,
+		opts:     opts,
+		contexts: newBadgerContextCatalog(),
+	}
+}
+
+// NewBadgerDatabaseWithValueLogGC returns a BadgerDatabase that collects its value log
+// in the background, as configured by gcOpts. A non-positive Interval is replaced by
+// DefaultValueLogGCInterval, and a MaxInterval below Interval by Interval.
+func NewBadgerDatabaseWithValueLogGC(opts badger.Options, gcOpts ValueLogGCOptions) *BadgerDatabase {
+	if gcOpts.Interval <= 0 {
+		gcOpts.Interval = DefaultValueLogGCInterval
+	}
+	if gcOpts.MaxInterval < gcOpts.Interval {
+		gcOpts.MaxInterval = gcOpts.Interval
 	}
+	bdb := NewBadgerDatabase(opts)
+	bdb.gcOpts = &gcOpts
+	return bdb
+}
+
+// NewBadgerDatabaseWithConflictRetry returns a BadgerDatabase that reruns Updates failing
+// with badger.ErrConflict, as configured by retryOpts. The function passed to Update may
+// then run more than once, each time in a new transaction, and must not have effects
+// outside the transaction that can't be repeated.
+func NewBadgerDatabaseWithConflictRetry(opts badger.Options, retryOpts ConflictRetryOptions) *BadgerDatabase {
+	bdb := NewBadgerDatabase(opts)
+	bdb.retry = newConflictRetrier(retryOpts)
+	return bdb
 }
 
 func (bdb *BadgerDatabase) Setup() error {
@@ -35,36 +107,284 @@ func (bdb *BadgerDatabase) Setup() error {
 	if err != nil {
 		log.Fatal(err)
 	}
+	return bdb.setup(db)
+}
+
+// SetupContext opens the database like Setup, but returns the errors Setup exits on.
+// Badger fails right away on a directory locked by another process, so goCtx only
+// bounds the replay of the logs of a database that wasn't closed cleanly.
+func (bdb *BadgerDatabase) SetupContext(goCtx context.Context) error {
+	return setupWithContext(goCtx, bdb, func() error {
+		db, err := badger.Open(bdb.opts)
+		if err != nil {
+			return errors.Wrapf(err, "SetupContext: Problem opening database")
+		}
+		return bdb.setup(db)
+	})
+}
+
+// setup loads what the database keeps about itself from the freshly opened db, which
+// is closed if that fails.
+func (bdb *BadgerDatabase) setup(db *badger.DB) error {
 	bdb.db = db
+	if err := bdb.db.Update(checkBadgerFormat); err != nil {
+		bdb.db.Close()
+		return errors.Wrapf(err, "Setup: Problem checking format")
+	}
+	if err := bdb.db.Update(bdb.loadLineage); err != nil {
+		bdb.db.Close()
+		return errors.Wrapf(err, "Setup: Problem loading backup lineage")
+	}
+	if err := bdb.db.View(bdb.contexts.load); err != nil {
+		bdb.db.Close()
+		return err
+	}
+	if bdb.gcOpts != nil {
+		bdb.gc = newValueLogGC(bdb.db, bdb.opts.ValueDir, *bdb.gcOpts, &bdb.writes)
+		bdb.gc.start()
+	}
+	return nil
+}
+
+// ValueLogGCStats returns the statistics of the value log GC scheduler, which are
+// empty if it isn't enabled.
+func (bdb *BadgerDatabase) ValueLogGCStats() ValueLogGCStats {
+	if bdb.gc == nil {
+		return ValueLogGCStats{}
+	}
+	return bdb.gc.snapshot()
+}
+
+// checkBadgerFormat fails with ErrBadgerFormatMismatch unless the database was written
+// with the current key layout, and records the layout of a new database. A database
+// holding keys but no version predates the versioning, and has another layout.
+func checkBadgerFormat(txn *badger.Txn) error {
+	item, err := txn.Get(badgerFormatKey)
+	if err == badger.ErrKeyNotFound {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			if !bytes.HasPrefix(it.Item().Key(), badgerMetaPrefix) {
+				return errors.Wrapf(ErrBadgerFormatMismatch, "No format version, found key %x", it.Item().Key())
+			}
+		}
+		return txn.Set(badgerFormatKey, binary.BigEndian.AppendUint32(nil, badgerFormatVersion))
+	}
+	if err != nil {
+		return err
+	}
+
+	version, err := item.ValueCopy(nil)
+	if err != nil {
+		return err
+	}
+	if len(version) != 4 || binary.BigEndian.Uint32(version) != badgerFormatVersion {
+		return errors.Wrapf(ErrBadgerFormatMismatch, "Format version %x, expected %v", version, badgerFormatVersion)
+	}
 	return nil
 }
 
+// loadLineage reads the lineage of the database, generating it on first use.
+func (bdb *BadgerDatabase) loadLineage(txn *badger.Txn) error {
+	item, err := txn.Get(badgerLineageKey)
+	if err == badger.ErrKeyNotFound {
+		lineage, err := RandomBytes(int32(len(bdb.lineage)))
+		if err != nil {
+			return err
+		}
+		copy(bdb.lineage[:], lineage)
+		return txn.Set(badgerLineageKey, lineage)
+	}
+	if err != nil {
+		return err
+	}
+	return item.Value(func(lineage []byte) error {
+		copy(bdb.lineage[:], lineage)
+		return nil
+	})
+}
+
 func (bdb *BadgerDatabase) GetContext(id []byte) Context {
-	return NewBadgerContext(id, bdb.useWriteBatch)
+	return NewBadgerContext(id)
 }
 
+// Update runs fn in a transaction, and reruns it in a new transaction on conflict if the
+// database retries conflicts.
 func (bdb *BadgerDatabase) Update(ctx Context, fn func(Transaction, Context) error) error {
-	var wb *badger.WriteBatch
-	if bdb.useWriteBatch {
-		wb = bdb.db.NewWriteBatch()
-		defer wb.Cancel()
-		defer wb.Flush()
+	if bdb.retry == nil {
+		return bdb.update(ctx, fn)
+	}
+	return bdb.retry.run(context.Background(), ctx.Path(), func() error {
+		return bdb.update(ctx, fn)
+	})
+}
+
+// ConflictStats returns the conflict statistics of every context, or nil if the database
+// doesn't retry conflicts.
+func (bdb *BadgerDatabase) ConflictStats() []ConflictStats {
+	if bdb.retry == nil {
+		return nil
 	}
+	return bdb.retry.snapshot()
+}
 
-	return bdb.db.Update(func(txn *badger.Txn) error {
-		T := NewBadgerTransaction(txn, wb)
-		return fn(T, ctx)
+func (bdb *BadgerDatabase) update(ctx Context, fn func(Transaction, Context) error) error {
+	T := NewBadgerTransaction(nil, bdb.contexts)
+	T.mutations = bdb.beginMutations()
+	T.writable = true
+	err := bdb.db.Update(func(txn *badger.Txn) error {
+		T.txn = txn
+		if err := fn(T, ctx); err != nil {
+			return err
+		}
+		return T.mutations.runPreCommit()
 	})
+	if err != nil {
+		return err
+	}
+	bdb.contexts.add(T.newContexts)
+	bdb.writes.Add(T.writes)
+	T.mutations.runPostCommit()
+	return nil
 }
 
 func (bdb *BadgerDatabase) View(ctx Context, fn func(Transaction, Context) error) error {
 	return bdb.db.View(func(txn *badger.Txn) error {
-		T := NewBadgerTransaction(txn, nil)
+		T := NewBadgerTransaction(txn, bdb.contexts)
 		return fn(T, ctx)
 	})
 }
 
+func (bdb *BadgerDatabase) NewWriteBatch() WriteBatch {
+	wb := NewBadgerWriteBatch(bdb.db.NewWriteBatch(), bdb.contexts)
+	wb.writes = &bdb.writes
+	return wb
+}
+
+func (bdb *BadgerDatabase) Backup(w io.Writer) error {
+	_, err := bdb.BackupSince(w, 0)
+	return err
+}
+
+// BackupSince iterates over the whole database in a single transaction, and picks the
+// keys whose latest version is above since. Badger only stores prefixed keys, and every
+// key is attributed to the context its prefix encodes.
+// Versions are Badger commit timestamps, and the backup ends at the read timestamp of
+// its transaction.
+//
+// Deletes are found through the tombstones Badger keeps until compaction discards
+// them. A key deleted and compacted away before an incremental backup is taken is
+// missed by it, so incremental backups should be taken more often than compactions
+// settle, and chains should be restarted with a full backup periodically.
+func (bdb *BadgerDatabase) BackupSince(w io.Writer, since uint64) (uint64, error) {
+	var until uint64
+	err := bdb.db.View(func(txn *badger.Txn) error {
+		until = txn.ReadTs()
+		if since > until {
+			return errors.Errorf("Version %v is ahead of the database at %v", since, until)
+		}
+		bw, err := NewBackupWriter(w, BackupHeader{
+			SourceId: BADGERDB,
+			Lineage:  bdb.lineage,
+			Since:    since,
+			Until:    until,
+		})
+		if err != nil {
+			return err
+		}
+
+		opts := badger.DefaultIteratorOptions
+		opts.AllVersions = true
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		var lastKey []byte
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			key := item.Key()
+			// Versions of a key are ordered newest first, and only the newest one counts.
+			if lastKey != nil && bytes.Equal(key, lastKey) {
+				continue
+			}
+			lastKey = item.KeyCopy(lastKey)
+			if bytes.HasPrefix(key, badgerMetaPrefix) || item.Version() <= since {
+				continue
+			}
+
+			path, prefixLength := resolveBadgerKey(key)
+			if item.IsDeletedOrExpired() {
+				if since == 0 {
+					continue
+				}
+				if err := bw.WriteDelete(path, key[prefixLength:]); err != nil {
+					return err
+				}
+				continue
+			}
+			err := item.Value(func(value []byte) error {
+				return bw.WriteRecord(path, key[prefixLength:], value)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return bw.Close()
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "BackupSince:")
+	}
+	return until, nil
+}
+
+// checkIntegrity checks the checksums of every table, then reads the latest version of
+// every value. Values in the value log are only checked against their checksums if the
+// database was opened with VerifyValueChecksum; otherwise only their pointers are.
+func (bdb *BadgerDatabase) checkIntegrity(report *IntegrityReport) error {
+	report.Physical = true
+	if err := bdb.db.VerifyChecksum(); err != nil {
+		report.addIssue(nil, nil, errors.Wrapf(err, "Problem verifying tables"))
+	}
+
+	return bdb.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			err := item.Value(func([]byte) error {
+				return nil
+			})
+			if err != nil {
+				key := item.KeyCopy(nil)
+				path, prefixLength := resolveBadgerKey(key)
+				report.addIssue(path, key[prefixLength:], err)
+			}
+		}
+		return nil
+	})
+}
+
+// nestedContextIds reads the nested contexts from the catalog, since their keys live
+// under their own prefix, out of reach of the iterators of ctx.
+func (bdb *BadgerDatabase) nestedContextIds(ctx Context) ([][]byte, error) {
+	badgerCtx, err := AssertContext[*BadgerContext](ctx, BADGERDB)
+	if err != nil {
+		return nil, err
+	}
+	return bdb.contexts.nestedIds(badgerCtx.path), nil
+}
+
+func (bdb *BadgerDatabase) Restore(r io.Reader) error {
+	return errors.Wrapf(restoreBackup(bdb, r), "Restore:")
+}
+
 func (bdb *BadgerDatabase) Close() error {
+	// Stop the scheduler first, since a collection can't run on a closed database.
+	if bdb.gc != nil {
+		bdb.gc.close()
+	}
 	return bdb.db.Close()
 }
 
@@ -76,32 +396,167 @@ func (bdb *BadgerDatabase) Id() DatabaseId {
 	return BADGERDB
 }
 
+// loadSorted builds tables directly from the sorted source with a StreamWriter. On an
+// empty database the StreamWriter owns the whole keyspace; otherwise it writes
+// incrementally above the existing levels, and if Badger can't do that, the load falls
+// back to a WriteBatch.
+func (bdb *BadgerDatabase) loadSorted(ctx Context, src KVSource, opts BulkLoadOptions, result *BulkLoadResult) error {
+	badgerCtx, err := AssertContext[*BadgerContext](ctx, BADGERDB)
+	if err != nil {
+		return errors.Wrapf(err, "loadSorted:")
+	}
+
+	// The database counts as empty if it only holds what it keeps about itself. Those
+	// keys are read to be written again, since preparing an empty database drops them.
+	ctxEmpty, dbEmpty := true, true
+	var meta []*pb.KV
+	err = bdb.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{})
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			if !bytes.HasPrefix(item.Key(), badgerMetaPrefix) {
+				dbEmpty = false
+				break
+			}
+			value, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			meta = append(meta, &pb.KV{Key: item.KeyCopy(nil), Value: value})
+		}
+		it.Seek(badgerCtx.prefix)
+		ctxEmpty = !it.ValidForPrefix(badgerCtx.prefix)
+		return nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "loadSorted: Problem checking for existing data")
+	}
+	if !ctxEmpty {
+		return ErrBulkLoadContextNotEmpty
+	}
+
+	version := bdb.db.MaxVersion() + 1
+	sw := bdb.db.NewStreamWriter()
+	if dbEmpty {
+		err = sw.Prepare()
+	} else {
+		// Badger can only stream into a database whose level 0 is empty, which it
+		// isn't once reopened, for instance.
+		meta = nil
+		err = sw.PrepareIncremental()
+	}
+	if err != nil {
+		sw.Cancel()
+		result.Fallback = errors.Wrapf(err, "loadSorted: Problem preparing stream writer")
+		return bulkLoadWithWriteBatch(bdb, ctx, src)
+	}
+
+	buf := z.NewBuffer(badgerBulkLoadBufferBytes, "BadgerDatabase.loadSorted")
+	defer func() {
+		buf.Release()
+	}()
+	for {
+		key, value, err := src.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			sw.Cancel()
+			return err
+		}
+
+		kv := &pb.KV{
+			Key:     badgerCtx.prefixedKey(key),
+			Value:   value,
+			Version: version,
+		}
+		badger.KVToBuffer(kv, buf)
+		if buf.LenNoPadding() < badgerBulkLoadBufferBytes {
+			continue
+		}
+		if err := sw.Write(buf); err != nil {
+			sw.Cancel()
+			return errors.Wrapf(err, "loadSorted: Problem writing stream")
+		}
+		buf.Release()
+		buf = z.NewBuffer(badgerBulkLoadBufferBytes, "BadgerDatabase.loadSorted")
+	}
+
+	// Meta keys sort after the keys of every context.
+	for _, kv := range meta {
+		kv.Version = version
+		badger.KVToBuffer(kv, buf)
+	}
+	if err := sw.Write(buf); err != nil {
+		sw.Cancel()
+		return errors.Wrapf(err, "loadSorted: Problem writing stream")
+	}
+	if err := sw.Flush(); err != nil {
+		return errors.Wrapf(err, "loadSorted: Problem flushing stream")
+	}
+
+	// The StreamWriter bypasses transactions, so register the context separately.
+	return bdb.Update(ctx, func(tx Transaction, ctx Context) error {
+		return tx.(*BadgerTransaction).registerContext(badgerCtx)
+	})
+}
+
 // ==========================
 // BadgerTransaction
 // ==========================
 
 type BadgerTransaction struct {
-	txn *badger.Txn
-	wb  *badger.WriteBatch
+	txn      *badger.Txn
+	contexts *badgerContextCatalog
+
+	// newContexts are the contexts this transaction added to the catalog. They are
+	// only added to the in-memory catalog once the transaction commits.
+	newContexts []*BadgerContext
+	// writes is the number of keys written or deleted, counted once the transaction commits.
+	writes uint64
+	// mutations records the writes for the commit hooks, if there are any.
+	mutations *mutationLog
+	// writable is set in Update. Badger allows a single open iterator per read-write
+	// transaction.
+	writable bool
 }
 
-func NewBadgerTransaction(txn *badger.Txn, wb *badger.WriteBatch) *BadgerTransaction {
+func NewBadgerTransaction(txn *badger.Txn, contexts *badgerContextCatalog) *BadgerTransaction {
 	return &BadgerTransaction{
-		txn: txn,
-		wb:  wb,
+		txn:      txn,
+		contexts: contexts,
 	}
 }
 
 func (btx *BadgerTransaction) Set(key []byte, value []byte, ctx Context) error {
-	prefixedKey, err := castBadgerContextAndGetPrefixedKey(key, ctx)
+	badgerCtx, err := AssertContext[*BadgerContext](ctx, BADGERDB)
 	if err != nil {
 		return errors.Wrapf(err, "Set:")
 	}
+	if err := btx.registerContext(badgerCtx); err != nil {
+		return errors.Wrapf(err, "Set: Problem registering context")
+	}
 
-	if btx.wb != nil {
-		return btx.wb.Set(prefixedKey, value)
+	btx.writes++
+	if err := btx.txn.Set(badgerCtx.prefixedKey(key), value); err != nil {
+		return err
 	}
-	return btx.txn.Set(prefixedKey, value)
+	btx.mutations.set(ctx.Path(), key, value)
+	return nil
+}
+
+func (btx *BadgerTransaction) registerContext(badgerCtx *BadgerContext) error {
+	if btx.contexts.contains(badgerCtx) {
+		return nil
+	}
+	for _, newCtx := range btx.newContexts {
+		if newCtx.pathKey == badgerCtx.pathKey {
+			return nil
+		}
+	}
+	btx.newContexts = append(btx.newContexts, badgerCtx)
+	return btx.txn.Set(badgerCtx.catalogKey(), nil)
 }
 
 func (btx *BadgerTransaction) Delete(key []byte, ctx Context) error {
@@ -110,10 +565,12 @@ func (btx *BadgerTransaction) Delete(key []byte, ctx Context) error {
 		return errors.Wrapf(err, "Delete:")
 	}
 
-	if btx.wb != nil {
-		return btx.wb.Delete(prefixedKey)
+	btx.writes++
+	if err := btx.txn.Delete(prefixedKey); err != nil {
+		return err
 	}
-	return btx.txn.Delete(prefixedKey)
+	btx.mutations.delete(ctx.Path(), key)
+	return nil
 }
 
 func (btx *BadgerTransaction) Get(key []byte, ctx Context) ([]byte, error) {
@@ -130,6 +587,56 @@ func (btx *BadgerTransaction) Get(key []byte, ctx Context) ([]byte, error) {
 	return item.ValueCopy(nil)
 }
 
+// MultiGet looks up all keys with a single iterator. Keys are visited in sorted
+// order so the iterator only ever seeks forward through the LSM tree. In an Update,
+// which may already have an iterator open, keys are looked up one by one instead.
+func (btx *BadgerTransaction) MultiGet(keys [][]byte, ctx Context) ([][]byte, []bool, error) {
+	badgerCtx, err := AssertContext[*BadgerContext](ctx, BADGERDB)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "MultiGet:")
+	}
+
+	values := make([][]byte, len(keys))
+	found := make([]bool, len(keys))
+
+	if btx.writable {
+		for ii, key := range keys {
+			item, err := btx.txn.Get(badgerCtx.prefixedKey(key))
+			if err == badger.ErrKeyNotFound {
+				continue
+			}
+			if err != nil {
+				return nil, nil, errors.Wrapf(err, "MultiGet:")
+			}
+			if values[ii], err = item.ValueCopy(nil); err != nil {
+				return nil, nil, errors.Wrapf(err, "MultiGet:")
+			}
+			found[ii] = true
+		}
+		return values, found, nil
+	}
+
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	opts.Prefix = badgerCtx.prefix
+	it := btx.txn.NewIterator(opts)
+	defer it.Close()
+
+	for _, ii := range sortedKeyOrder(keys) {
+		prefixedKey := badgerCtx.prefixedKey(keys[ii])
+		it.Seek(prefixedKey)
+		if !it.Valid() || !bytes.Equal(it.Item().Key(), prefixedKey) {
+			continue
+		}
+		values[ii], err = it.Item().ValueCopy(nil)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "MultiGet:")
+		}
+		found[ii] = true
+	}
+	return values, found, nil
+}
+
 func (btx *BadgerTransaction) GetIterator(ctx Context) (Iterator, error) {
 	badgerCtx, err := AssertContext[*BadgerContext](ctx, BADGERDB)
 	if err != nil {
@@ -141,6 +648,74 @@ func (btx *BadgerTransaction) GetIterator(ctx Context) (Iterator, error) {
 	return NewBadgerIterator(it, badgerCtx), nil
 }
 
+// ==========================
+// BadgerWriteBatch
+// ==========================
+
+type BadgerWriteBatch struct {
+	wb          *badger.WriteBatch
+	contexts    *badgerContextCatalog
+	newContexts []*BadgerContext
+
+	// writes, if set, counts the keys written or deleted once the batch is flushed.
+	writes  *atomic.Uint64
+	pending uint64
+}
+
+func NewBadgerWriteBatch(wb *badger.WriteBatch, contexts *badgerContextCatalog) *BadgerWriteBatch {
+	return &BadgerWriteBatch{
+		wb:       wb,
+		contexts: contexts,
+	}
+}
+
+func (bwb *BadgerWriteBatch) Set(key []byte, value []byte, ctx Context) error {
+	badgerCtx, err := AssertContext[*BadgerContext](ctx, BADGERDB)
+	if err != nil {
+		return errors.Wrapf(err, "Set:")
+	}
+	if !bwb.contexts.contains(badgerCtx) {
+		registered := false
+		for _, newCtx := range bwb.newContexts {
+			registered = registered || newCtx.pathKey == badgerCtx.pathKey
+		}
+		if !registered {
+			bwb.newContexts = append(bwb.newContexts, badgerCtx)
+			if err := bwb.wb.Set(badgerCtx.catalogKey(), nil); err != nil {
+				return errors.Wrapf(err, "Set: Problem registering context")
+			}
+		}
+	}
+
+	bwb.pending++
+	return bwb.wb.Set(badgerCtx.prefixedKey(key), value)
+}
+
+func (bwb *BadgerWriteBatch) Delete(key []byte, ctx Context) error {
+	prefixedKey, err := castBadgerContextAndGetPrefixedKey(key, ctx)
+	if err != nil {
+		return errors.Wrapf(err, "Delete:")
+	}
+
+	bwb.pending++
+	return bwb.wb.Delete(prefixedKey)
+}
+
+func (bwb *BadgerWriteBatch) Flush() error {
+	if err := bwb.wb.Flush(); err != nil {
+		return err
+	}
+	bwb.contexts.add(bwb.newContexts)
+	if bwb.writes != nil {
+		bwb.writes.Add(bwb.pending)
+	}
+	return nil
+}
+
+func (bwb *BadgerWriteBatch) Cancel() {
+	bwb.wb.Cancel()
+}
+
 // ==========================
 // BadgerIterator
 // ==========================
@@ -170,11 +745,20 @@ func (bit *BadgerIterator) Key() []byte {
 	return bit.it.Item().KeyCopy(nil)
 }
 
+func (bit *BadgerIterator) localKey() []byte {
+	return bytes.TrimPrefix(bit.Key(), bit.ctx.prefix)
+}
+
 func (bit *BadgerIterator) Next() bool {
 	bit.it.Next()
 	return bit.it.ValidForPrefix(bit.ctx.prefix)
 }
 
+func (bit *BadgerIterator) Seek(key []byte) bool {
+	bit.it.Seek(bit.ctx.prefixedKey(key))
+	return bit.it.ValidForPrefix(bit.ctx.prefix)
+}
+
 func (bit *BadgerIterator) Close() {
 	bit.it.Close()
 }
@@ -184,20 +768,68 @@ func (bit *BadgerIterator) Close() {
 // ==========================
 
 type BadgerContext struct {
-	prefix        []byte
-	useWriteBatch bool
+	prefix []byte
+	path   [][]byte
+
+	// pathKey is the encoded path, used to identify the context in the catalog.
+	pathKey string
+}
+
+func NewBadgerContext(prefix []byte) *BadgerContext {
+	return newBadgerContextWithPath([][]byte{prefix})
 }
 
-func NewBadgerContext(prefix []byte, useWriteBatch bool) *BadgerContext {
+func NewBadgerNestedContext(prefix []byte, parent *BadgerContext) *BadgerContext {
+	path := make([][]byte, 0, len(parent.path)+1)
+	path = append(path, parent.path...)
+	path = append(path, prefix)
+	return newBadgerContextWithPath(path)
+}
+
+func newBadgerContextWithPath(path [][]byte) *BadgerContext {
 	return &BadgerContext{
-		prefix:        prefix,
-		useWriteBatch: useWriteBatch,
+		prefix:  badgerContextPrefix(path),
+		path:    path,
+		pathKey: string(encodeContextPath(path)),
 	}
 }
 
-func NewBadgerNestedContext(prefix []byte, parent *BadgerContext) *BadgerContext {
-	prefixedPrefix := append(parent.prefix, prefix...)
-	return NewBadgerContext(prefixedPrefix, parent.useWriteBatch)
+// badgerContextPrefix encodes path as the prefix of the keys of its context. Every id is
+// tagged and length-prefixed, and the path ends with a terminator, so that the prefix of
+// a context is never a prefix of the keys of another context, nested ones included.
+func badgerContextPrefix(path [][]byte) []byte {
+	var prefix []byte
+	for _, segment := range path {
+		prefix = append(prefix, badgerPathSegmentTag)
+		prefix = appendLengthPrefixed(prefix, segment)
+	}
+	return append(prefix, badgerPathEndTag)
+}
+
+// resolveBadgerKey returns the path of the context owning key, and the length of its
+// prefix. Keys that no context owns resolve to an empty path. The path aliases key.
+func resolveBadgerKey(key []byte) ([][]byte, int) {
+	var path [][]byte
+	for offset := 0; offset < len(key); {
+		switch key[offset] {
+		case badgerPathEndTag:
+			if len(path) == 0 {
+				return nil, 0
+			}
+			return path, offset + 1
+		case badgerPathSegmentTag:
+			length, n := binary.Uvarint(key[offset+1:])
+			if n <= 0 || length > uint64(len(key)-offset-1-n) {
+				return nil, 0
+			}
+			start := offset + 1 + n
+			path = append(path, key[start:start+int(length)])
+			offset = start + int(length)
+		default:
+			return nil, 0
+		}
+	}
+	return nil, 0
 }
 
 func (bc *BadgerContext) Id() DatabaseId {
@@ -208,14 +840,125 @@ func (bc *BadgerContext) NestContext(prefixId []byte) Context {
 	return NewBadgerNestedContext(prefixId, bc)
 }
 
+func (bc *BadgerContext) Path() [][]byte {
+	return bc.path
+}
+
+func (bc *BadgerContext) catalogKey() []byte {
+	catalogKey := make([]byte, 0, len(badgerCatalogPrefix)+len(bc.pathKey))
+	catalogKey = append(catalogKey, badgerCatalogPrefix...)
+	return append(catalogKey, bc.pathKey...)
+}
+
+// prefixedKey returns a freshly allocated key with the context prefix prepended.
+// Appending directly to the prefix would share its backing array between keys.
+func (bc *BadgerContext) prefixedKey(key []byte) []byte {
+	prefixedKey := make([]byte, 0, len(bc.prefix)+len(key))
+	prefixedKey = append(prefixedKey, bc.prefix...)
+	return append(prefixedKey, key...)
+}
+
 func castBadgerContextAndGetPrefixedKey(key []byte, ctx Context) (_prefixedKey []byte, _err error) {
 	badgerCtx, err := AssertContext[*BadgerContext](ctx, BADGERDB)
 	if err != nil {
 		return nil, err
 	}
 
-	prefixedKey := append(badgerCtx.prefix, key...)
-	return prefixedKey, nil
+	return badgerCtx.prefixedKey(key), nil
+}
+
+// ==========================
+// badgerContextCatalog
+// ==========================
+
+// badgerContextCatalog is the set of context paths that have been written to. Badger
+// flattens contexts into key prefixes, so the catalog is what allows a key to be
+// attributed back to its context. It is persisted under badgerCatalogPrefix and
+// mirrored in memory, so that registering a known context costs a map lookup.
+type badgerContextCatalog struct {
+	sync.RWMutex
+
+	paths map[string][][]byte
+}
+
+func newBadgerContextCatalog() *badgerContextCatalog {
+	return &badgerContextCatalog{
+		paths: make(map[string][][]byte),
+	}
+}
+
+func (cat *badgerContextCatalog) contains(ctx *BadgerContext) bool {
+	cat.RLock()
+	defer cat.RUnlock()
+
+	_, exists := cat.paths[ctx.pathKey]
+	return exists
+}
+
+func (cat *badgerContextCatalog) add(ctxs []*BadgerContext) {
+	if len(ctxs) == 0 {
+		return
+	}
+	cat.Lock()
+	defer cat.Unlock()
+
+	for _, ctx := range ctxs {
+		cat.paths[ctx.pathKey] = ctx.path
+	}
+}
+
+// nestedIds returns the sorted ids of the contexts nested right under path. A context
+// is only in the catalog once it's written to, so ids are also taken from the paths of
+// contexts nested deeper.
+func (cat *badgerContextCatalog) nestedIds(path [][]byte) [][]byte {
+	cat.RLock()
+	defer cat.RUnlock()
+
+	seen := make(map[string]bool)
+	var ids [][]byte
+	for _, other := range cat.paths {
+		if len(other) <= len(path) || !pathHasPrefix(other, path) {
+			continue
+		}
+		id := other[len(path)]
+		if !seen[string(id)] {
+			seen[string(id)] = true
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return bytes.Compare(ids[i], ids[j]) < 0
+	})
+	return ids
+}
+
+func pathHasPrefix(path [][]byte, prefix [][]byte) bool {
+	for ii, segment := range prefix {
+		if !bytes.Equal(path[ii], segment) {
+			return false
+		}
+	}
+	return true
+}
+
+func (cat *badgerContextCatalog) load(txn *badger.Txn) error {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	opts.Prefix = badgerCatalogPrefix
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	cat.Lock()
+	defer cat.Unlock()
+	for it.Rewind(); it.Valid(); it.Next() {
+		pathKey := it.Item().KeyCopy(nil)[len(badgerCatalogPrefix):]
+		path, err := decodeContextPath(pathKey)
+		if err != nil {
+			return errors.Wrapf(err, "load: Problem loading context catalog")
+		}
+		cat.paths[string(pathKey)] = path
+	}
+	return nil
 }
 
 // PerformanceBadgerOptions are performance geared
@@ -1,10 +1,41 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
 	"github.com/boltdb/bolt"
 	"github.com/pkg/errors"
+	"io"
 	"os"
 	"path/filepath"
+	"sync"
+)
+
+const (
+	// DefaultBoltWriteBatchBytes is 16 MB.
+	DefaultBoltWriteBatchBytes = 16 << 20
+
+	boltFileName = "bolt.db"
+)
+
+var (
+	// boltMetaBucket is reserved for what Bolt stores about the database itself. It is
+	// left out of backups, and can't be used as a top-level context id.
+	boltMetaBucket = []byte("__meta")
+
+	boltLineageKey = []byte("lineage")
+
+	// boltChangesSinceKey holds the transaction id after which every change is in the
+	// boltChangesBucket. Changes are keyed by transaction id and a sequence number, and
+	// hold the location of the changed key.
+	boltChangesSinceKey = []byte("changes_since")
+	boltChangesBucket   = []byte("changes")
+
+	// boltEmptyIdBucket is the bucket of the empty context id, since Bolt requires bucket
+	// names to be non-empty. It can't be used as a context id itself.
+	boltEmptyIdBucket = []byte("__empty")
+
+	ErrReservedContextId = errors.New("Context id is reserved")
 )
 
 // ==========================
@@ -14,6 +45,20 @@ import (
 type BoltDatabase struct {
 	db  *bolt.DB
 	dir string
+
+	// lock guards db, which an online compaction swaps for the compacted file. Every
+	// transaction holds it shared, through update and view.
+	lock sync.RWMutex
+	// compaction, if set, is the online compaction copying the database.
+	compaction *boltCompactionLog
+	// failed, if set, is why db is closed after an online compaction couldn't reopen the
+	// file. Transactions return it until Setup succeeds.
+	failed error
+
+	trackChanges bool
+	lineage      BackupLineage
+
+	commitHooks
 }
 
 func NewBoltDatabase(dir string) *BoltDatabase {
@@ -23,35 +68,338 @@ func NewBoltDatabase(dir string) *BoltDatabase {
 	}
 }
 
+// NewBoltDatabaseWithChangeTracking records the location of every changed key, which
+// incremental backups need since Bolt keeps no versions. Each write pays for an extra
+// insert into the change log, which grows until TrimChanges is called.
+func NewBoltDatabaseWithChangeTracking(dir string) *BoltDatabase {
+	return &BoltDatabase{
+		db:           nil,
+		dir:          dir,
+		trackChanges: true,
+	}
+}
+
 func (bdb *BoltDatabase) Setup() error {
-	dbFile := filepath.Join(bdb.dir, "bolt.db")
-	db, err := bolt.Open(dbFile, 0600, nil)
+	return bdb.setup(nil)
+}
+
+func (bdb *BoltDatabase) setup(opts *bolt.Options) error {
+	db, err := bolt.Open(boltFilePath(bdb.dir), 0600, opts)
 	if err != nil {
 		return err
 	}
 	bdb.db = db
+	bdb.failed = nil
+	if err := bdb.db.Update(bdb.setupMeta); err != nil {
+		// Release the file lock, so that the database can be set up again.
+		bdb.db.Close()
+		return errors.Wrapf(err, "Setup: Problem setting up meta bucket")
+	}
 	return nil
 }
 
+func boltFilePath(dir string) string {
+	return filepath.Join(dir, boltFileName)
+}
+
+// update and view run fn against the current file.
+func (bdb *BoltDatabase) update(fn func(*bolt.Tx) error) error {
+	bdb.lock.RLock()
+	defer bdb.lock.RUnlock()
+
+	if bdb.failed != nil {
+		return bdb.failed
+	}
+	return bdb.db.Update(fn)
+}
+
+func (bdb *BoltDatabase) view(fn func(*bolt.Tx) error) error {
+	bdb.lock.RLock()
+	defer bdb.lock.RUnlock()
+
+	if bdb.failed != nil {
+		return bdb.failed
+	}
+	return bdb.db.View(fn)
+}
+
+func (bdb *BoltDatabase) setupMeta(tx *bolt.Tx) error {
+	meta, err := tx.CreateBucketIfNotExists(boltMetaBucket)
+	if err != nil {
+		return err
+	}
+	if lineage := meta.Get(boltLineageKey); lineage != nil {
+		copy(bdb.lineage[:], lineage)
+	} else {
+		lineage, err := RandomBytes(int32(len(bdb.lineage)))
+		if err != nil {
+			return err
+		}
+		copy(bdb.lineage[:], lineage)
+		if err := meta.Put(boltLineageKey, lineage); err != nil {
+			return err
+		}
+	}
+
+	if !bdb.trackChanges {
+		// Changes made from now on won't be tracked, so the log can't be relied on anymore.
+		if err := meta.DeleteBucket(boltChangesBucket); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		return meta.Delete(boltChangesSinceKey)
+	}
+	if _, err := meta.CreateBucketIfNotExists(boltChangesBucket); err != nil {
+		return err
+	}
+	if meta.Get(boltChangesSinceKey) != nil {
+		return nil
+	}
+	return meta.Put(boltChangesSinceKey, binary.BigEndian.AppendUint64(nil, uint64(tx.ID())))
+}
+
 func (bdb *BoltDatabase) GetContext(id []byte) Context {
 	return NewBoltContext(id)
 }
 
 func (bdb *BoltDatabase) Update(ctx Context, fn func(Transaction, Context) error) error {
-	return bdb.db.Update(func(tx *bolt.Tx) error {
+	mutations := bdb.beginMutations()
+	err := bdb.update(func(tx *bolt.Tx) error {
 		T := NewBoltTransaction(tx, false)
-		return fn(T, ctx)
+		T.changes = bdb.changesBucket(tx)
+		T.compaction = bdb.compaction
+		T.mutations = mutations
+		if err := fn(T, ctx); err != nil {
+			return err
+		}
+		return mutations.runPreCommit()
 	})
+	if err != nil {
+		return err
+	}
+	mutations.runPostCommit()
+	return nil
 }
 
+// View runs fn in a read-only bolt transaction, concurrently with other views and with
+// the writer. Contexts that don't exist yet read as empty. A writer that grows the file
+// waits for the views in progress to finish.
 func (bdb *BoltDatabase) View(ctx Context, fn func(Transaction, Context) error) error {
-	return bdb.db.Update(func(tx *bolt.Tx) error {
+	return bdb.view(func(tx *bolt.Tx) error {
 		T := NewBoltTransaction(tx, true)
 		return fn(T, ctx)
 	})
 }
 
+func (bdb *BoltDatabase) NewWriteBatch() WriteBatch {
+	return NewBoltWriteBatch(bdb, DefaultBoltWriteBatchBytes)
+}
+
+func (bdb *BoltDatabase) Backup(w io.Writer) error {
+	_, err := bdb.BackupSince(w, 0)
+	return err
+}
+
+// BackupSince works in a single read transaction, and uses transaction ids as versions.
+// A full backup walks every bucket, and bucket names form the context path of their
+// keys. An incremental backup walks the change log written since the requested
+// transaction, and reads the current value of every changed key, so it needs the
+// database to track changes.
+func (bdb *BoltDatabase) BackupSince(w io.Writer, since uint64) (uint64, error) {
+	var until uint64
+	err := bdb.view(func(tx *bolt.Tx) error {
+		until = uint64(tx.ID())
+		if since > until {
+			return errors.Errorf("Version %v is ahead of the database at %v", since, until)
+		}
+		bw, err := NewBackupWriter(w, BackupHeader{
+			SourceId: BOLTDB,
+			Lineage:  bdb.lineage,
+			Since:    since,
+			Until:    until,
+		})
+		if err != nil {
+			return err
+		}
+
+		if since == 0 {
+			err = tx.ForEach(func(name []byte, bucket *bolt.Bucket) error {
+				if bytes.Equal(name, boltMetaBucket) {
+					return nil
+				}
+				return backupBoltBucket(bw, [][]byte{BucketId(name).contextId()}, bucket)
+			})
+		} else {
+			err = backupBoltChanges(bw, tx, since)
+		}
+		if err != nil {
+			return err
+		}
+		return bw.Close()
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "BackupSince:")
+	}
+	return until, nil
+}
+
+func backupBoltBucket(bw *BackupWriter, path [][]byte, bucket *bolt.Bucket) error {
+	return bucket.ForEach(func(k []byte, v []byte) error {
+		// Nested buckets show up with a nil value.
+		if v == nil {
+			nestedPath := append(append([][]byte{}, path...), BucketId(k).contextId())
+			return backupBoltBucket(bw, nestedPath, bucket.Bucket(k))
+		}
+		return bw.WriteRecord(path, k, v)
+	})
+}
+
+// backupBoltChanges writes the current state of every key changed after transaction
+// since. A key that no longer exists is written as a delete.
+func backupBoltChanges(bw *BackupWriter, tx *bolt.Tx, since uint64) error {
+	meta := tx.Bucket(boltMetaBucket)
+	trackedSince := meta.Get(boltChangesSinceKey)
+	if trackedSince == nil || since < binary.BigEndian.Uint64(trackedSince) {
+		return ErrIncrementalBackupUnavailable
+	}
+
+	written := make(map[string]bool)
+	cursor := meta.Bucket(boltChangesBucket).Cursor()
+	for k, location := cursor.Seek(binary.BigEndian.AppendUint64(nil, since+1)); k != nil; k, location = cursor.Next() {
+		if written[string(location)] {
+			continue
+		}
+		written[string(location)] = true
+
+		path, key, err := decodeRecordLocation(location)
+		if err != nil {
+			return err
+		}
+		var value []byte
+		if bucket := lookupBoltBucket(tx, path); bucket != nil {
+			value = bucket.Get(key)
+		}
+		if value == nil {
+			err = bw.WriteDelete(path, key)
+		} else {
+			err = bw.WriteRecord(path, key, value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lookupBoltBucket returns the bucket at the context path, or nil if it doesn't exist.
+// Unlike GetNestedBucket, it works in read-only transactions.
+func lookupBoltBucket(tx *bolt.Tx, path [][]byte) *bolt.Bucket {
+	if len(path) == 0 {
+		return nil
+	}
+	bucket := tx.Bucket(MakeBucketId(path[0]).Bytes())
+	for _, segment := range path[1:] {
+		if bucket == nil {
+			return nil
+		}
+		bucket = bucket.Bucket(MakeBucketId(segment).Bytes())
+	}
+	return bucket
+}
+
+// TrimChanges drops the change log up to and including transaction until, usually the
+// end of the oldest backup still in use. Incremental backups since an earlier
+// transaction are no longer possible afterwards.
+func (bdb *BoltDatabase) TrimChanges(until uint64) error {
+	err := bdb.update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(boltMetaBucket)
+		trackedSince := meta.Get(boltChangesSinceKey)
+		if trackedSince == nil {
+			return ErrIncrementalBackupUnavailable
+		}
+		if until <= binary.BigEndian.Uint64(trackedSince) {
+			return nil
+		}
+
+		cursor := meta.Bucket(boltChangesBucket).Cursor()
+		end := binary.BigEndian.AppendUint64(nil, until+1)
+		for k, _ := cursor.First(); k != nil && bytes.Compare(k, end) < 0; k, _ = cursor.First() {
+			if err := cursor.Delete(); err != nil {
+				return err
+			}
+		}
+		return meta.Put(boltChangesSinceKey, binary.BigEndian.AppendUint64(nil, until))
+	})
+	return errors.Wrapf(err, "TrimChanges:")
+}
+
+// changesBucket returns the change log if the database tracks changes.
+func (bdb *BoltDatabase) changesBucket(tx *bolt.Tx) *bolt.Bucket {
+	if !bdb.trackChanges {
+		return nil
+	}
+	return tx.Bucket(boltMetaBucket).Bucket(boltChangesBucket)
+}
+
+func recordBoltChange(tx *bolt.Tx, changes *bolt.Bucket, path [][]byte, key []byte) error {
+	sequence, err := changes.NextSequence()
+	if err != nil {
+		return err
+	}
+	changeKey := binary.BigEndian.AppendUint64(nil, uint64(tx.ID()))
+	changeKey = binary.BigEndian.AppendUint64(changeKey, sequence)
+	return changes.Put(changeKey, encodeRecordLocation(path, key))
+}
+
+// checkIntegrity checks every page of the file is either in use or free, and referenced once.
+func (bdb *BoltDatabase) checkIntegrity(report *IntegrityReport) error {
+	report.Physical = true
+	return bdb.view(func(tx *bolt.Tx) error {
+		for err := range tx.Check() {
+			report.addIssue(nil, nil, err)
+		}
+		return nil
+	})
+}
+
+// nestedContextIds lists the nested buckets of the bucket of ctx.
+func (bdb *BoltDatabase) nestedContextIds(ctx Context) ([][]byte, error) {
+	boltCtx, err := AssertContext[*BoltContext](ctx, BOLTDB)
+	if err != nil {
+		return nil, err
+	}
+
+	if boltCtx.err != nil {
+		return nil, boltCtx.err
+	}
+
+	var ids [][]byte
+	err = bdb.view(func(tx *bolt.Tx) error {
+		bucket := lookupBoltBucket(tx, boltCtx.Path())
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(key, value []byte) error {
+			if value == nil {
+				ids = append(ids, append([]byte{}, BucketId(key).contextId()...))
+			}
+			return nil
+		})
+	})
+	return ids, err
+}
+
+func (bdb *BoltDatabase) Restore(r io.Reader) error {
+	return errors.Wrapf(restoreBackup(bdb, r), "Restore:")
+}
+
 func (bdb *BoltDatabase) Close() error {
+	bdb.lock.Lock()
+	defer bdb.lock.Unlock()
+
+	if bdb.failed != nil {
+		// The failed compaction already closed the file.
+		return nil
+	}
 	return bdb.db.Close()
 }
 
@@ -63,6 +411,71 @@ func (bdb *BoltDatabase) Id() DatabaseId {
 	return BOLTDB
 }
 
+// loadSorted inserts the sorted source in key order, in transactions of
+// opts.BoltBatchBytes each. Since every insert appends to the rightmost page, pages can
+// be filled up to opts.BoltFillPercent instead of being split in half.
+func (bdb *BoltDatabase) loadSorted(ctx Context, src KVSource, opts BulkLoadOptions, _ *BulkLoadResult) error {
+	boltCtx, err := AssertContext[*BoltContext](ctx, BOLTDB)
+	if err != nil {
+		return errors.Wrapf(err, "loadSorted:")
+	}
+
+	err = bdb.update(func(tx *bolt.Tx) error {
+		bucket, err := boltCtx.GetNestedBucket(tx)
+		if err != nil {
+			return err
+		}
+		if k, _ := bucket.Cursor().First(); k != nil {
+			return ErrBulkLoadContextNotEmpty
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	done := false
+	for !done {
+		err := bdb.update(func(tx *bolt.Tx) error {
+			bucket, err := boltCtx.GetNestedBucket(tx)
+			if err != nil {
+				return err
+			}
+			bucket.FillPercent = opts.BoltFillPercent
+			// The compaction is read under the lock update holds.
+			compaction := bdb.compaction
+
+			for batchBytes := 0; batchBytes < opts.BoltBatchBytes; {
+				key, value, err := src.Next()
+				if err == io.EOF {
+					done = true
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				if err := bucket.Put(key, value); err != nil {
+					return err
+				}
+				if compaction != nil {
+					compaction.touch(boltCtx.Path(), key)
+				}
+				if changes := bdb.changesBucket(tx); changes != nil {
+					if err := recordBoltChange(tx, changes, boltCtx.Path(), key); err != nil {
+						return err
+					}
+				}
+				batchBytes += len(key) + len(value)
+			}
+			return nil
+		})
+		if err != nil {
+			return errors.Wrapf(err, "loadSorted:")
+		}
+	}
+	return nil
+}
+
 // ==========================
 // BoltTransaction
 // ==========================
@@ -70,6 +483,13 @@ func (bdb *BoltDatabase) Id() DatabaseId {
 type BoltTransaction struct {
 	tx       *bolt.Tx
 	readOnly bool
+
+	// changes is the change log, if the database tracks changes.
+	changes *bolt.Bucket
+	// compaction is the online compaction in progress, if any.
+	compaction *boltCompactionLog
+	// mutations records the writes for the commit hooks, if there are any.
+	mutations *mutationLog
 }
 
 func NewBoltTransaction(tx *bolt.Tx, readOnly bool) *BoltTransaction {
@@ -88,7 +508,21 @@ func (bt *BoltTransaction) Set(key []byte, value []byte, ctx Context) error {
 	if err != nil {
 		return errors.Wrap(err, "Set:")
 	}
-	return bucket.Put(key, value)
+	if err := bucket.Put(key, value); err != nil {
+		return err
+	}
+	bt.mutations.set(ctx.Path(), key, value)
+	return bt.recordChange(key, ctx)
+}
+
+func (bt *BoltTransaction) recordChange(key []byte, ctx Context) error {
+	if bt.compaction != nil {
+		bt.compaction.touch(ctx.Path(), key)
+	}
+	if bt.changes == nil {
+		return nil
+	}
+	return errors.Wrapf(recordBoltChange(bt.tx, bt.changes, ctx.Path(), key), "Problem recording change")
 }
 
 func (bt *BoltTransaction) Delete(key []byte, ctx Context) error {
@@ -101,7 +535,11 @@ func (bt *BoltTransaction) Delete(key []byte, ctx Context) error {
 		return errors.Wrap(err, "Delete:")
 	}
 
-	return bucket.Delete(key)
+	if err := bucket.Delete(key); err != nil {
+		return err
+	}
+	bt.mutations.delete(ctx.Path(), key)
+	return bt.recordChange(key, ctx)
 }
 
 func (bt *BoltTransaction) Get(key []byte, ctx Context) ([]byte, error) {
@@ -109,24 +547,94 @@ func (bt *BoltTransaction) Get(key []byte, ctx Context) ([]byte, error) {
 	if err != nil {
 		return nil, errors.Wrap(err, "Get:")
 	}
+	if bucket == nil {
+		return nil, nil
+	}
 
 	return bucket.Get(key), nil
 }
 
+// MultiGet looks up all keys with a single cursor, visiting them in sorted order
+// to keep page accesses local. Values are copied since bolt only guarantees them
+// for the lifetime of the transaction.
+func (bt *BoltTransaction) MultiGet(keys [][]byte, ctx Context) ([][]byte, []bool, error) {
+	bucket, err := castBoltContextAndGetBucket(bt.tx, ctx)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "MultiGet:")
+	}
+
+	values := make([][]byte, len(keys))
+	found := make([]bool, len(keys))
+	if bucket == nil {
+		return values, found, nil
+	}
+
+	cursor := bucket.Cursor()
+	for _, ii := range sortedKeyOrder(keys) {
+		k, v := cursor.Seek(keys[ii])
+		// Nested buckets show up in the cursor with a nil value.
+		if k == nil || v == nil || !bytes.Equal(k, keys[ii]) {
+			continue
+		}
+		values[ii] = make([]byte, len(v))
+		copy(values[ii], v)
+		found[ii] = true
+	}
+	return values, found, nil
+}
+
 func (bt *BoltTransaction) GetIterator(ctx Context) (Iterator, error) {
 	boltCtx, err := AssertContext[*BoltContext](ctx, BOLTDB)
 	if err != nil {
 		return nil, errors.Wrapf(err, "Set:")
 	}
 
-	bucket, err := boltCtx.GetNestedBucket(bt.tx)
+	bucket, err := castBoltContextAndGetBucket(bt.tx, boltCtx)
 	if err != nil {
-		return nil, errors.Wrapf(err, "Set: Problem creating bucket")
+		return nil, errors.Wrapf(err, "GetIterator:")
+	}
+	if bucket == nil {
+		return NewBoltIterator(nil, boltCtx), nil
 	}
 
 	return NewBoltIterator(bucket.Cursor(), boltCtx), nil
 }
 
+// ==========================
+// BoltWriteBatch
+// ==========================
+
+// BoltWriteBatch buffers writes and commits them in chunked Update transactions of at
+// most maxBatchBytes each. Unlike bolt.DB.Batch, which coalesces concurrent callers,
+// this bounds the size of a single writer's transactions.
+type BoltWriteBatch struct {
+	bw *bulkWriter
+}
+
+func NewBoltWriteBatch(db *BoltDatabase, maxBatchBytes int) *BoltWriteBatch {
+	opts := DefaultBulkUpdateOptions()
+	opts.MaxBatchBytes = maxBatchBytes
+	return &BoltWriteBatch{
+		bw: newBulkWriter(db, nil, opts),
+	}
+}
+
+func (bwb *BoltWriteBatch) Set(key []byte, value []byte, ctx Context) error {
+	return bwb.bw.Set(key, value, ctx)
+}
+
+func (bwb *BoltWriteBatch) Delete(key []byte, ctx Context) error {
+	return bwb.bw.Delete(key, ctx)
+}
+
+func (bwb *BoltWriteBatch) Flush() error {
+	return bwb.bw.flush()
+}
+
+func (bwb *BoltWriteBatch) Cancel() {
+	bwb.bw.cancel()
+}
+
 // ==========================
 // BoltIterator
 // ==========================
@@ -138,7 +646,12 @@ type BoltIterator struct {
 	currentKey   []byte
 }
 
+// NewBoltIterator returns an iterator over the cursor, or an empty iterator if the
+// cursor is nil.
 func NewBoltIterator(it *bolt.Cursor, ctx *BoltContext) *BoltIterator {
+	if it == nil {
+		return &BoltIterator{ctx: ctx}
+	}
 	k, v := it.First()
 	return &BoltIterator{
 		it:           it,
@@ -160,7 +673,14 @@ func (bi *BoltIterator) Key() []byte {
 	return bi.currentKey
 }
 
+func (bi *BoltIterator) localKey() []byte {
+	return bi.currentKey
+}
+
 func (bi *BoltIterator) Next() bool {
+	if bi.it == nil {
+		return false
+	}
 	k, v := bi.it.Next()
 	if k == nil {
 		return false
@@ -170,6 +690,14 @@ func (bi *BoltIterator) Next() bool {
 	return true
 }
 
+func (bi *BoltIterator) Seek(key []byte) bool {
+	if bi.it == nil {
+		return false
+	}
+	bi.currentKey, bi.currentValue = bi.it.Seek(key)
+	return bi.currentKey != nil
+}
+
 func (bi *BoltIterator) Close() {
 	bi.it = nil
 }
@@ -180,7 +708,12 @@ func (bi *BoltIterator) Close() {
 
 type BucketId []byte
 
+// MakeBucketId returns the name of the bucket of a context id. The empty id, which Bolt
+// can't use as a bucket name, is stored as boltEmptyIdBucket.
 func MakeBucketId(id []byte) BucketId {
+	if len(id) == 0 {
+		return boltEmptyIdBucket
+	}
 	return id
 }
 
@@ -188,20 +721,52 @@ func (bi BucketId) Bytes() []byte {
 	return bi
 }
 
+// contextId returns the context id the bucket name was made from.
+func (bi BucketId) contextId() []byte {
+	if bytes.Equal(bi, boltEmptyIdBucket) {
+		return []byte{}
+	}
+	return bi
+}
+
 type BoltContext struct {
 	bucketIds []BucketId
+
+	// err is set if an id of the path is reserved, and fails every use of the context.
+	err error
 }
 
 func NewBoltContext(bucketId []byte) *BoltContext {
+	err := checkBoltContextId(bucketId)
+	if err == nil && bytes.Equal(bucketId, boltMetaBucket) {
+		err = errors.Wrapf(ErrReservedContextId, "Bolt stores its metadata in bucket %q", bucketId)
+	}
 	return &BoltContext{
 		bucketIds: []BucketId{MakeBucketId(bucketId)},
+		err:       err,
 	}
 }
 
 func NewBoltNestedContext(bucketId []byte, parent *BoltContext) *BoltContext {
+	bucketIds := make([]BucketId, 0, len(parent.bucketIds)+1)
+	bucketIds = append(bucketIds, parent.bucketIds...)
+	err := parent.err
+	if err == nil {
+		err = checkBoltContextId(bucketId)
+	}
 	return &BoltContext{
-		bucketIds: append(parent.bucketIds, MakeBucketId(bucketId)),
+		bucketIds: append(bucketIds, MakeBucketId(bucketId)),
+		err:       err,
+	}
+}
+
+// checkBoltContextId rejects the ids whose bucket stands for something else at any
+// level. The meta bucket is only reserved at the top level.
+func checkBoltContextId(id []byte) error {
+	if bytes.Equal(id, boltEmptyIdBucket) {
+		return errors.Wrapf(ErrReservedContextId, "Bolt stores the empty id as %q", id)
 	}
+	return nil
 }
 
 func (bc *BoltContext) Id() DatabaseId {
@@ -212,10 +777,21 @@ func (bc *BoltContext) NestContext(bucketId []byte) Context {
 	return NewBoltNestedContext(bucketId, bc)
 }
 
+func (bc *BoltContext) Path() [][]byte {
+	path := make([][]byte, len(bc.bucketIds))
+	for ii, bucketId := range bc.bucketIds {
+		path[ii] = bucketId.contextId()
+	}
+	return path
+}
+
 func (bc *BoltContext) GetNestedBucket(txn *bolt.Tx) (*bolt.Bucket, error) {
 	if len(bc.bucketIds) == 0 {
 		return nil, errors.New("GetNestedBucket: No bucketIds")
 	}
+	if bc.err != nil {
+		return nil, errors.Wrapf(bc.err, "GetNestedBucket:")
+	}
 
 	bucket, err := txn.CreateBucketIfNotExists(bc.bucketIds[0].Bytes())
 	if err != nil {
@@ -232,11 +808,20 @@ func (bc *BoltContext) GetNestedBucket(txn *bolt.Tx) (*bolt.Bucket, error) {
 	return finalBucket, nil
 }
 
+// castBoltContextAndGetBucket returns the bucket of the context, creating it in a
+// writable transaction. In a read-only transaction, it returns nil if the bucket
+// doesn't exist.
 func castBoltContextAndGetBucket(tx *bolt.Tx, ctx Context) (*bolt.Bucket, error) {
 	boltCtx, err := AssertContext[*BoltContext](ctx, BOLTDB)
 	if err != nil {
 		return nil, errors.Wrapf(err, "Set:")
 	}
+	if !tx.Writable() {
+		if boltCtx.err != nil {
+			return nil, errors.Wrapf(boltCtx.err, "Set:")
+		}
+		return lookupBoltBucket(tx, boltCtx.Path()), nil
+	}
 
 	bucket, err := boltCtx.GetNestedBucket(tx)
 	if err != nil {
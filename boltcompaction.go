@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bytes"
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultBoltCompactionFillPercent fills pages entirely. Keys are copied in order,
+	// so no page needs room for inserts during the copy.
+	DefaultBoltCompactionFillPercent = 1.0
+
+	boltCompactionSuffix = ".compact"
+)
+
+var (
+	ErrBoltCompactionRunning = errors.New("BoltDatabase: A compaction is already running")
+	// ErrBoltReopenFailed is returned by every transaction once an online compaction
+	// closed the database file and couldn't open it again. Setup opens it again.
+	ErrBoltReopenFailed = errors.New("BoltDatabase: The database file could not be reopened after a compaction")
+)
+
+type BoltCompactionOptions struct {
+	// FillPercent is how full the pages of the compacted file are. Fuller pages make a
+	// smaller file, but the first writes to a full page split it.
+	FillPercent float64
+	// MaxBatchBytes is the budget of key and value bytes copied by a single transaction
+	// of the compacted file.
+	MaxBatchBytes int
+}
+
+func DefaultBoltCompactionOptions() BoltCompactionOptions {
+	return BoltCompactionOptions{
+		FillPercent:   DefaultBoltCompactionFillPercent,
+		MaxBatchBytes: DefaultBoltWriteBatchBytes,
+	}
+}
+
+type BoltCompactionResult struct {
+	// SizeBefore and SizeAfter are the sizes of the database file.
+	SizeBefore int64
+	SizeAfter  int64
+	// Blocked is how long an online compaction blocked transactions, zero offline.
+	Blocked time.Duration
+}
+
+// CompactBolt compacts the Bolt database in dir offline, like bolt compact. Every bucket
+// is copied into a fresh file with tight pages, which then atomically replaces the
+// database file. The database must not be open, and CompactBolt fails rather than wait
+// for it to be closed.
+//
+// Bolt never shrinks its file, and only reuses the pages freed by deletes, so compaction
+// is the only way to reclaim them. The compacted file starts its transaction ids over,
+// and with them the versions of backups, so the meta bucket is left out of the copy and
+// the database starts a new backup lineage. Incremental backups have to restart with a
+// full backup afterwards.
+func CompactBolt(dir string, opts BoltCompactionOptions) (*BoltCompactionResult, error) {
+	db, err := bolt.Open(boltFilePath(dir), 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, errors.Wrapf(err, "CompactBolt: Problem opening database")
+	}
+	defer db.Close()
+
+	result := &BoltCompactionResult{}
+	if result.SizeBefore, err = fileSize(boltFilePath(dir)); err != nil {
+		return nil, errors.Wrapf(err, "CompactBolt:")
+	}
+	dst, err := openBoltCompactionTarget(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "CompactBolt:")
+	}
+	err = db.View(func(tx *bolt.Tx) error {
+		return copyBolt(tx, dst, opts)
+	})
+	if err != nil {
+		dst.Close()
+		os.Remove(dst.Path())
+		return nil, errors.Wrapf(err, "CompactBolt: Problem copying database")
+	}
+	if err := dst.Close(); err != nil {
+		return nil, errors.Wrapf(err, "CompactBolt:")
+	}
+	if err := db.Close(); err != nil {
+		return nil, errors.Wrapf(err, "CompactBolt:")
+	}
+	if err := swapBoltCompactionTarget(dir); err != nil {
+		return nil, errors.Wrapf(err, "CompactBolt:")
+	}
+	if result.SizeAfter, err = fileSize(boltFilePath(dir)); err != nil {
+		return nil, errors.Wrapf(err, "CompactBolt:")
+	}
+	return result, nil
+}
+
+// Compact compacts the database online, the same way CompactBolt does offline. The copy
+// is read from a snapshot while transactions keep running, and the keys they write are
+// logged. Transactions are then blocked while the logged keys are copied again and the
+// compacted file is swapped in, which takes as long as the writes made during the copy.
+//
+// Like offline compaction, Compact starts a new backup lineage. The change log is part
+// of the meta bucket, which isn't copied, so the changes tracked before the compaction
+// are dropped, and incremental backups have to restart with a full backup.
+//
+// If the file can't be opened again once the compacted file is swapped in, the database
+// is left closed, and transactions fail with ErrBoltReopenFailed until Setup succeeds.
+func (bdb *BoltDatabase) Compact(opts BoltCompactionOptions) (*BoltCompactionResult, error) {
+	written := newBoltCompactionLog()
+	bdb.lock.Lock()
+	if bdb.compaction != nil {
+		bdb.lock.Unlock()
+		return nil, ErrBoltCompactionRunning
+	}
+	bdb.compaction = written
+	bdb.lock.Unlock()
+
+	result, err := bdb.compact(written, opts)
+	if err != nil {
+		bdb.lock.Lock()
+		bdb.compaction = nil
+		bdb.lock.Unlock()
+		return nil, errors.Wrapf(err, "Compact:")
+	}
+	return result, nil
+}
+
+func (bdb *BoltDatabase) compact(written *boltCompactionLog, opts BoltCompactionOptions) (*BoltCompactionResult, error) {
+	result := &BoltCompactionResult{}
+	var err error
+	if result.SizeBefore, err = fileSize(boltFilePath(bdb.dir)); err != nil {
+		return nil, err
+	}
+	dst, err := openBoltCompactionTarget(bdb.dir)
+	if err != nil {
+		return nil, err
+	}
+	// The log was set before the snapshot was taken, so it holds every key written after it.
+	err = bdb.view(func(tx *bolt.Tx) error {
+		return copyBolt(tx, dst, opts)
+	})
+	if err != nil {
+		dst.Close()
+		os.Remove(dst.Path())
+		return nil, errors.Wrapf(err, "Problem copying database")
+	}
+
+	bdb.lock.Lock()
+	defer bdb.lock.Unlock()
+	blockedSince := time.Now()
+	bdb.compaction = nil
+
+	err = bdb.db.View(func(tx *bolt.Tx) error {
+		return written.replay(tx, dst, opts)
+	})
+	if err != nil {
+		dst.Close()
+		os.Remove(dst.Path())
+		return nil, errors.Wrapf(err, "Problem copying keys written during the copy")
+	}
+	if err := dst.Close(); err != nil {
+		return nil, err
+	}
+	if err := bdb.db.Close(); err != nil {
+		return nil, err
+	}
+	swapErr := swapBoltCompactionTarget(bdb.dir)
+	// Reopen the database whether or not the swap happened, so it stays usable.
+	db, err := bolt.Open(boltFilePath(bdb.dir), 0600, nil)
+	if err != nil {
+		bdb.failed = errors.Wrapf(ErrBoltReopenFailed, "%v", err)
+		return nil, errors.Wrapf(err, "Problem reopening database")
+	}
+	bdb.db = db
+	if swapErr != nil {
+		return nil, swapErr
+	}
+	if err := bdb.db.Update(bdb.setupMeta); err != nil {
+		return nil, errors.Wrapf(err, "Problem setting up meta bucket")
+	}
+	result.Blocked = time.Since(blockedSince)
+
+	if result.SizeAfter, err = fileSize(boltFilePath(bdb.dir)); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// openBoltCompactionTarget creates the file the database in dir is compacted into,
+// replacing what an interrupted compaction left behind.
+func openBoltCompactionTarget(dir string) (*bolt.DB, error) {
+	path := boltFilePath(dir) + boltCompactionSuffix
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrapf(err, "Problem removing previous compaction")
+	}
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Problem creating compacted file")
+	}
+	return db, nil
+}
+
+// swapBoltCompactionTarget renames the compacted file over the database file, and syncs
+// the directory so the rename survives a crash.
+func swapBoltCompactionTarget(dir string) error {
+	if err := os.Rename(boltFilePath(dir)+boltCompactionSuffix, boltFilePath(dir)); err != nil {
+		return errors.Wrapf(err, "Problem swapping in compacted file")
+	}
+	dirFile, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer dirFile.Close()
+	return dirFile.Sync()
+}
+
+func fileSize(path string) (int64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// copyBolt copies every bucket but the meta bucket from src into dst.
+func copyBolt(src *bolt.Tx, dst *bolt.DB, opts BoltCompactionOptions) error {
+	bc := newBoltCopier(dst, opts)
+	err := src.ForEach(func(name []byte, bucket *bolt.Bucket) error {
+		if bytes.Equal(name, boltMetaBucket) {
+			return nil
+		}
+		return bc.copyBucket([][]byte{name}, bucket)
+	})
+	if err != nil {
+		bc.rollback()
+		return err
+	}
+	return bc.commit()
+}
+
+// ==========================
+// boltCopier
+// ==========================
+
+// boltCopier writes to dst in transactions of at most opts.MaxBatchBytes, recreating
+// the bucket being written to in every new transaction.
+type boltCopier struct {
+	dst  *bolt.DB
+	opts BoltCompactionOptions
+
+	tx         *bolt.Tx
+	batchBytes int
+
+	// path and bucket are the last bucket looked up in tx.
+	path   string
+	bucket *bolt.Bucket
+}
+
+func newBoltCopier(dst *bolt.DB, opts BoltCompactionOptions) *boltCopier {
+	return &boltCopier{
+		dst:  dst,
+		opts: opts,
+	}
+}
+
+func (bc *boltCopier) copyBucket(path [][]byte, src *bolt.Bucket) error {
+	dst, err := bc.lookup(path, true)
+	if err != nil {
+		return err
+	}
+	if err := dst.SetSequence(src.Sequence()); err != nil {
+		return err
+	}
+	return src.ForEach(func(k []byte, v []byte) error {
+		// Nested buckets show up with a nil value.
+		if v == nil {
+			nestedPath := append(append([][]byte{}, path...), k)
+			return bc.copyBucket(nestedPath, src.Bucket(k))
+		}
+		return bc.put(path, k, v)
+	})
+}
+
+func (bc *boltCopier) put(path [][]byte, key []byte, value []byte) error {
+	dst, err := bc.lookup(path, true)
+	if err != nil {
+		return err
+	}
+	if err := dst.Put(key, value); err != nil {
+		return err
+	}
+	return bc.account(len(key) + len(value))
+}
+
+func (bc *boltCopier) delete(path [][]byte, key []byte) error {
+	dst, err := bc.lookup(path, false)
+	if err != nil || dst == nil {
+		return err
+	}
+	if err := dst.Delete(key); err != nil {
+		return err
+	}
+	return bc.account(len(key))
+}
+
+// account commits the transaction once it has written its budget.
+func (bc *boltCopier) account(size int) error {
+	bc.batchBytes += size
+	if bc.batchBytes < bc.opts.MaxBatchBytes {
+		return nil
+	}
+	return bc.commit()
+}
+
+// lookup returns the bucket at path in the current transaction, beginning one if
+// needed. If create is false, a missing bucket is returned as nil. Paths are bucket
+// names when copying buckets, and context paths when catching up with the compaction
+// log, which MakeBucketId both resolves to bucket names.
+func (bc *boltCopier) lookup(path [][]byte, create bool) (*bolt.Bucket, error) {
+	pathKey := string(encodeContextPath(path))
+	if bc.tx != nil && bc.bucket != nil && bc.path == pathKey {
+		return bc.bucket, nil
+	}
+	if bc.tx == nil {
+		tx, err := bc.dst.Begin(true)
+		if err != nil {
+			return nil, err
+		}
+		bc.tx = tx
+	}
+
+	var bucket *bolt.Bucket
+	if !create {
+		bucket = lookupBoltBucket(bc.tx, path)
+		if bucket == nil {
+			return nil, nil
+		}
+	} else {
+		var err error
+		if bucket, err = bc.tx.CreateBucketIfNotExists(MakeBucketId(path[0]).Bytes()); err != nil {
+			return nil, err
+		}
+		for _, segment := range path[1:] {
+			if bucket, err = bucket.CreateBucketIfNotExists(MakeBucketId(segment).Bytes()); err != nil {
+				return nil, err
+			}
+		}
+	}
+	bucket.FillPercent = bc.opts.FillPercent
+	bc.path = pathKey
+	bc.bucket = bucket
+	return bucket, nil
+}
+
+func (bc *boltCopier) commit() error {
+	if bc.tx == nil {
+		return nil
+	}
+	err := bc.tx.Commit()
+	bc.tx, bc.bucket, bc.batchBytes = nil, nil, 0
+	return err
+}
+
+func (bc *boltCopier) rollback() {
+	if bc.tx == nil {
+		return
+	}
+	bc.tx.Rollback()
+	bc.tx, bc.bucket, bc.batchBytes = nil, nil, 0
+}
+
+// ==========================
+// boltCompactionLog
+// ==========================
+
+// boltCompactionLog is the set of keys written while an online compaction copies the
+// database. A key written by a transaction that then rolls back is copied again all the
+// same, which is harmless.
+type boltCompactionLog struct {
+	sync.Mutex
+
+	locations map[string]bool
+}
+
+func newBoltCompactionLog() *boltCompactionLog {
+	return &boltCompactionLog{
+		locations: make(map[string]bool),
+	}
+}
+
+func (cl *boltCompactionLog) touch(path [][]byte, key []byte) {
+	location := string(encodeRecordLocation(path, key))
+	cl.Lock()
+	defer cl.Unlock()
+
+	cl.locations[location] = true
+}
+
+// replay copies the current state of every logged key from src into dst.
+func (cl *boltCompactionLog) replay(src *bolt.Tx, dst *bolt.DB, opts BoltCompactionOptions) error {
+	cl.Lock()
+	defer cl.Unlock()
+
+	bc := newBoltCopier(dst, opts)
+	for location := range cl.locations {
+		path, key, err := decodeRecordLocation([]byte(location))
+		if err != nil {
+			bc.rollback()
+			return err
+		}
+		var value []byte
+		if bucket := lookupBoltBucket(src, path); bucket != nil {
+			value = bucket.Get(key)
+		}
+		if value == nil {
+			err = bc.delete(path, key)
+		} else {
+			err = bc.put(path, key, value)
+		}
+		if err != nil {
+			bc.rollback()
+			return err
+		}
+	}
+	return bc.commit()
+}
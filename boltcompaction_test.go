@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/binary"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+)
+
+// TestBoltCompaction deletes most of a Bolt database, compacts it online while a writer
+// keeps running, then offline, and checks that the file shrinks and no key is lost.
+func TestBoltCompaction(t *testing.T) {
+	require := require.New(t)
+
+	db := newTestBoltDatabase("boltdb-compaction", t)
+	defer db.Erase()
+	ctx := db.GetContext([]byte("blocks"))
+	nestedCtx := ctx.NestContext([]byte("headers"))
+
+	value, err := RandomBytes(2048)
+	require.NoError(err)
+	expected := make(map[string]int)
+	require.NoError(db.Update(ctx, func(tx Transaction, ctx Context) error {
+		for ii := uint64(0); ii < 2000; ii++ {
+			key := binary.BigEndian.AppendUint64(nil, ii)
+			if err := tx.Set(key, value, ctx); err != nil {
+				return err
+			}
+			if ii%10 == 0 {
+				expected[string(encodeRecordLocation(ctx.Path(), key))]++
+			}
+		}
+		for ii := uint64(0); ii < 10; ii++ {
+			key := binary.BigEndian.AppendUint64(nil, ii)
+			if err := tx.Set(key, value, nestedCtx); err != nil {
+				return err
+			}
+			expected[string(encodeRecordLocation(nestedCtx.Path(), key))]++
+		}
+		return nil
+	}))
+	require.NoError(db.Update(ctx, func(tx Transaction, ctx Context) error {
+		for ii := uint64(0); ii < 2000; ii++ {
+			if ii%10 == 0 {
+				continue
+			}
+			if err := tx.Delete(binary.BigEndian.AppendUint64(nil, ii), ctx); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	// Keep writing while the online compaction runs.
+	stop := make(chan struct{})
+	var written [][]byte
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for ii := uint64(0); ; ii++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			key := binary.BigEndian.AppendUint64([]byte("live"), ii)
+			require.NoError(db.Update(ctx, func(tx Transaction, ctx Context) error {
+				return tx.Set(key, value[:64], ctx)
+			}))
+			written = append(written, key)
+		}
+	}()
+	result, err := db.Compact(DefaultBoltCompactionOptions())
+	close(stop)
+	wg.Wait()
+	require.NoError(err)
+	require.Less(result.SizeAfter*2, result.SizeBefore)
+	for _, key := range written {
+		expected[string(encodeRecordLocation(ctx.Path(), key))]++
+	}
+	requireRecords(db, expected, t)
+
+	require.NoError(db.Close())
+	result, err = CompactBolt(db.dir, DefaultBoltCompactionOptions())
+	require.NoError(err)
+	require.LessOrEqual(result.SizeAfter, result.SizeBefore)
+	require.NoError(db.Setup())
+	requireRecords(db, expected, t)
+	require.NoError(db.Close())
+}
+
+// requireRecords checks that db holds exactly the expected record locations.
+func requireRecords(db Database, expected map[string]int, t *testing.T) {
+	require := require.New(t)
+
+	found := make(map[string]int)
+	require.NoError(forEachRecord(db, func(record *BackupRecord) error {
+		found[string(encodeRecordLocation(record.Path, record.Key))]++
+		return nil
+	}))
+	require.Equal(expected, found)
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"sort"
+)
+
+const (
+	// DefaultBulkLoadMemoryBudget is 256 MB.
+	DefaultBulkLoadMemoryBudget = 256 << 20
+
+	// DefaultBoltBulkLoadBatchBytes is 64 MB.
+	DefaultBoltBulkLoadBatchBytes = 64 << 20
+
+	// DefaultBoltBulkLoadFillPercent packs pages completely, since sorted inserts only
+	// ever append to the rightmost page.
+	DefaultBoltBulkLoadFillPercent = 1.0
+
+	// badgerBulkLoadBufferBytes is the amount of data handed to the StreamWriter at once.
+	badgerBulkLoadBufferBytes = 16 << 20
+)
+
+var ErrBulkLoadContextNotEmpty = errors.New("BulkLoad: context is not empty")
+
+// KVSource is a stream of key/value pairs. Next returns io.EOF once the stream is
+// exhausted. Returned slices are owned by the caller and must not be reused by the source.
+type KVSource interface {
+	Next() (key []byte, value []byte, err error)
+}
+
+// KVSourceFunc adapts a function to the KVSource interface.
+type KVSourceFunc func() ([]byte, []byte, error)
+
+func (f KVSourceFunc) Next() ([]byte, []byte, error) {
+	return f()
+}
+
+type BulkLoadOptions struct {
+	// Sorted declares that the source yields strictly ascending keys, which skips the
+	// external sort. A source that turns out not to be sorted fails the load.
+	Sorted bool
+	// MemoryBudget is the number of bytes sorted in memory before a run is spilled to disk.
+	MemoryBudget int
+	// TempDir is where sorted runs are spilled. Defaults to os.TempDir().
+	TempDir string
+	// BoltBatchBytes is the amount of data inserted per bolt transaction.
+	BoltBatchBytes int
+	// BoltFillPercent is the bucket fill percent used for the inserts.
+	BoltFillPercent float64
+}
+
+func DefaultBulkLoadOptions() BulkLoadOptions {
+	return BulkLoadOptions{
+		MemoryBudget:    DefaultBulkLoadMemoryBudget,
+		BoltBatchBytes:  DefaultBoltBulkLoadBatchBytes,
+		BoltFillPercent: DefaultBoltBulkLoadFillPercent,
+	}
+}
+
+type BulkLoadResult struct {
+	// Items is the number of key/value pairs loaded, after removing duplicates.
+	Items uint64
+	// Bytes is the number of key and value bytes loaded.
+	Bytes uint64
+	// SpilledRuns is the number of sorted runs the external sort spilled to disk.
+	SpilledRuns int
+	// Fallback is why the backend's fast path couldn't be used, and the pairs were
+	// written through a WriteBatch instead, nil if it was used.
+	Fallback error
+}
+
+// sortedLoader is implemented by backends with a fast path for loading sorted data.
+type sortedLoader interface {
+	loadSorted(ctx Context, src KVSource, opts BulkLoadOptions, result *BulkLoadResult) error
+}
+
+// BulkLoad ingests src into ctx, which must be empty. Unless opts.Sorted is set, the
+// source is first sorted externally, spilling to opts.TempDir, and when a key appears
+// more than once the last value wins. The sorted stream is then handed to the backend:
+// Badger builds tables directly with a StreamWriter, and Bolt inserts in key order
+// into tightly packed pages.
+//
+// BulkLoad is meant for bootstrapping a database. It is not atomic, and on Badger the
+// StreamWriter requires that nothing else writes to the database during the load. When
+// the backend can't take its fast path, the pairs go through a WriteBatch, and
+// BulkLoadResult.Fallback says why. Options that are zero or out of range take their
+// default value.
+func BulkLoad(db Database, ctx Context, src KVSource, opts BulkLoadOptions) (*BulkLoadResult, error) {
+	result := &BulkLoadResult{}
+	defaults := DefaultBulkLoadOptions()
+	if opts.MemoryBudget <= 0 {
+		opts.MemoryBudget = defaults.MemoryBudget
+	}
+	if opts.BoltBatchBytes <= 0 {
+		opts.BoltBatchBytes = defaults.BoltBatchBytes
+	}
+	if opts.BoltFillPercent <= 0 || opts.BoltFillPercent > 1 {
+		opts.BoltFillPercent = defaults.BoltFillPercent
+	}
+
+	sorted := src
+	if !opts.Sorted {
+		sorter := newExternalSorter(opts.MemoryBudget, opts.TempDir)
+		defer sorter.Close()
+		for {
+			key, value, err := src.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return result, errors.Wrapf(err, "BulkLoad: Problem reading source")
+			}
+			if err := sorter.Add(key, value); err != nil {
+				return result, errors.Wrapf(err, "BulkLoad: Problem sorting source")
+			}
+		}
+
+		var err error
+		if sorted, err = sorter.Sorted(); err != nil {
+			return result, errors.Wrapf(err, "BulkLoad: Problem sorting source")
+		}
+		result.SpilledRuns = len(sorter.runs)
+	}
+	sorted = &checkedKVSource{src: sorted, result: result}
+
+	var err error
+	if loader, ok := db.(sortedLoader); ok {
+		err = loader.loadSorted(ctx, sorted, opts, result)
+	} else {
+		err = bulkLoadWithWriteBatch(db, ctx, sorted)
+	}
+	if err != nil {
+		return result, errors.Wrapf(err, "BulkLoad:")
+	}
+	return result, nil
+}
+
+// bulkLoadWithWriteBatch is the fallback for databases without a sorted load path.
+func bulkLoadWithWriteBatch(db Database, ctx Context, src KVSource) error {
+	wb := db.NewWriteBatch()
+	defer wb.Cancel()
+	for {
+		key, value, err := src.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := wb.Set(key, value, ctx); err != nil {
+			return err
+		}
+	}
+	return wb.Flush()
+}
+
+// checkedKVSource verifies that keys are strictly ascending and tallies the result.
+type checkedKVSource struct {
+	src     KVSource
+	result  *BulkLoadResult
+	lastKey []byte
+}
+
+func (cs *checkedKVSource) Next() ([]byte, []byte, error) {
+	key, value, err := cs.src.Next()
+	if err != nil {
+		return nil, nil, err
+	}
+	if cs.lastKey != nil && bytes.Compare(cs.lastKey, key) >= 0 {
+		return nil, nil, errors.Errorf("Source is not sorted: key %x follows key %x", key, cs.lastKey)
+	}
+	cs.lastKey = key
+	cs.result.Items++
+	cs.result.Bytes += uint64(len(key) + len(value))
+	return key, value, nil
+}
+
+// ==========================
+// externalSorter
+// ==========================
+
+type kvPair struct {
+	key   []byte
+	value []byte
+}
+
+// externalSorter sorts key/value pairs that may not fit in memory. Pairs are buffered up
+// to the memory budget, then sorted and spilled to a temporary run file. The runs are
+// finally merged with a k-way merge.
+type externalSorter struct {
+	budget      int
+	tempDir     string
+	buffer      []*kvPair
+	bufferBytes int
+	runs        []string
+}
+
+func newExternalSorter(budget int, tempDir string) *externalSorter {
+	return &externalSorter{
+		budget:  budget,
+		tempDir: tempDir,
+	}
+}
+
+func (es *externalSorter) Add(key []byte, value []byte) error {
+	es.buffer = append(es.buffer, &kvPair{key: key, value: value})
+	es.bufferBytes += len(key) + len(value)
+	if es.bufferBytes < es.budget {
+		return nil
+	}
+	return es.spill()
+}
+
+// sortBuffer sorts the buffered pairs and drops all but the last value of duplicate keys.
+func (es *externalSorter) sortBuffer() []*kvPair {
+	sort.SliceStable(es.buffer, func(ii, jj int) bool {
+		return bytes.Compare(es.buffer[ii].key, es.buffer[jj].key) < 0
+	})
+	pairs := es.buffer[:0]
+	for ii, pair := range es.buffer {
+		if ii+1 < len(es.buffer) && bytes.Equal(pair.key, es.buffer[ii+1].key) {
+			continue
+		}
+		pairs = append(pairs, pair)
+	}
+	es.buffer = nil
+	es.bufferBytes = 0
+	return pairs
+}
+
+func (es *externalSorter) spill() error {
+	file, err := os.CreateTemp(es.tempDir, "bulkload-run-*")
+	if err != nil {
+		return errors.Wrapf(err, "spill: Problem creating run file")
+	}
+	defer file.Close()
+	es.runs = append(es.runs, file.Name())
+
+	writer := bufio.NewWriter(file)
+	lenBuf := make([]byte, binary.MaxVarintLen64)
+	for _, pair := range es.sortBuffer() {
+		for _, data := range [][]byte{pair.key, pair.value} {
+			n := binary.PutUvarint(lenBuf, uint64(len(data)))
+			if _, err := writer.Write(lenBuf[:n]); err != nil {
+				return errors.Wrapf(err, "spill: Problem writing run file")
+			}
+			if _, err := writer.Write(data); err != nil {
+				return errors.Wrapf(err, "spill: Problem writing run file")
+			}
+		}
+	}
+	return errors.Wrapf(writer.Flush(), "spill: Problem writing run file")
+}
+
+// Sorted returns the merged, sorted and deduplicated stream of all added pairs.
+func (es *externalSorter) Sorted() (KVSource, error) {
+	if len(es.runs) == 0 {
+		pairs := es.sortBuffer()
+		return KVSourceFunc(func() ([]byte, []byte, error) {
+			if len(pairs) == 0 {
+				return nil, nil, io.EOF
+			}
+			pair := pairs[0]
+			pairs = pairs[1:]
+			return pair.key, pair.value, nil
+		}), nil
+	}
+
+	if len(es.buffer) > 0 {
+		if err := es.spill(); err != nil {
+			return nil, err
+		}
+	}
+	merger := &runMerger{}
+	for ii, path := range es.runs {
+		file, err := os.Open(path)
+		if err != nil {
+			merger.Close()
+			return nil, errors.Wrapf(err, "Sorted: Problem opening run file")
+		}
+		run := &runReader{file: file, reader: bufio.NewReader(file), index: ii}
+		if err := run.advance(); err == io.EOF {
+			file.Close()
+			continue
+		} else if err != nil {
+			file.Close()
+			merger.Close()
+			return nil, err
+		}
+		merger.runs = append(merger.runs, run)
+	}
+	heap.Init(merger)
+	return merger, nil
+}
+
+// Close removes the spilled run files.
+func (es *externalSorter) Close() {
+	for _, path := range es.runs {
+		os.Remove(path)
+	}
+}
+
+type runReader struct {
+	file   *os.File
+	reader *bufio.Reader
+	index  int
+	key    []byte
+	value  []byte
+}
+
+func (rr *runReader) advance() error {
+	var err error
+	if rr.key, err = readLengthPrefixed(rr.reader); err != nil {
+		return err
+	}
+	if rr.value, err = readLengthPrefixed(rr.reader); err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func readLengthPrefixed(reader *bufio.Reader) ([]byte, error) {
+	length, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
+// runMerger is a min-heap of runs ordered by their current key. For equal keys the most
+// recent run comes first, so that its value wins.
+type runMerger struct {
+	runs []*runReader
+}
+
+func (rm *runMerger) Len() int {
+	return len(rm.runs)
+}
+
+func (rm *runMerger) Less(ii, jj int) bool {
+	cmp := bytes.Compare(rm.runs[ii].key, rm.runs[jj].key)
+	if cmp == 0 {
+		return rm.runs[ii].index > rm.runs[jj].index
+	}
+	return cmp < 0
+}
+
+func (rm *runMerger) Swap(ii, jj int) {
+	rm.runs[ii], rm.runs[jj] = rm.runs[jj], rm.runs[ii]
+}
+
+func (rm *runMerger) Push(x any) {
+	rm.runs = append(rm.runs, x.(*runReader))
+}
+
+func (rm *runMerger) Pop() any {
+	run := rm.runs[len(rm.runs)-1]
+	rm.runs = rm.runs[:len(rm.runs)-1]
+	return run
+}
+
+func (rm *runMerger) Next() ([]byte, []byte, error) {
+	if len(rm.runs) == 0 {
+		return nil, nil, io.EOF
+	}
+	key, value := rm.runs[0].key, rm.runs[0].value
+
+	// Advance every run positioned at this key, dropping the older duplicates.
+	for len(rm.runs) > 0 && bytes.Equal(rm.runs[0].key, key) {
+		run := rm.runs[0]
+		if err := run.advance(); err == io.EOF {
+			run.file.Close()
+			heap.Pop(rm)
+		} else if err != nil {
+			rm.Close()
+			return nil, nil, errors.Wrapf(err, "Next: Problem reading run file")
+		} else {
+			heap.Fix(rm, 0)
+		}
+	}
+	if len(rm.runs) == 0 {
+		rm.Close()
+	}
+	return key, value, nil
+}
+
+func (rm *runMerger) Close() {
+	for _, run := range rm.runs {
+		run.file.Close()
+	}
+	rm.runs = nil
+}
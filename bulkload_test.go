@@ -0,0 +1,152 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"io"
+	"os"
+	"testing"
+)
+
+// TestBulkLoad loads an unsorted stream with duplicate keys through the external sort on both
+// backends. Badger streams the first load into the empty database, keeping what it stores
+// about itself, and the second one incrementally. Once reopened, its level 0 holds data,
+// and the load reports that it fell back to a write batch.
+func TestBulkLoad(t *testing.T) {
+	require := require.New(t)
+
+	boltDir, err := os.MkdirTemp("", "boltdb-bulkload")
+	require.NoError(err)
+	boltDb := NewBoltDatabase(boltDir)
+	require.NoError(boltDb.Setup())
+	defer boltDb.Erase()
+	defer boltDb.Close()
+	GenericBulkLoadTest(boltDb, boltDb.GetContext([]byte("FirstBucket")), t)
+	GenericBulkLoadTest(boltDb, boltDb.GetContext([]byte("SecondBucket")), t)
+
+	badgerDir, err := os.MkdirTemp("", "badgerdb-bulkload")
+	require.NoError(err)
+	badgerDb := NewBadgerDatabase(DefaultBadgerOptions(badgerDir))
+	require.NoError(badgerDb.Setup())
+	defer badgerDb.Erase()
+	defer badgerDb.Close()
+	lineage := badgerDb.lineage
+	result := GenericBulkLoadTest(badgerDb, badgerDb.GetContext([]byte("FirstPrefix")), t)
+	require.NoError(result.Fallback)
+	result = GenericBulkLoadTest(badgerDb, badgerDb.GetContext([]byte("SecondPrefix")), t)
+	require.NoError(result.Fallback)
+
+	// The lineage and the catalog survive the stream.
+	require.NoError(badgerDb.Close())
+	badgerDb = NewBadgerDatabase(DefaultBadgerOptions(badgerDir))
+	require.NoError(badgerDb.Setup())
+	require.Equal(lineage, badgerDb.lineage)
+	report, err := Verify(badgerDb)
+	require.NoError(err)
+	require.True(report.OK())
+	records := 0
+	require.NoError(forEachRecord(badgerDb, func(record *BackupRecord) error {
+		records++
+		return nil
+	}))
+	require.Equal(2*5001, records)
+	result = GenericBulkLoadTest(badgerDb, badgerDb.GetContext([]byte("ThirdPrefix")), t)
+	require.ErrorContains(result.Fallback, "L0 has data")
+	require.NoError(badgerDb.Close())
+}
+
+// TestBulkLoad_ZeroOptions loads with zero-valued options, which take their defaults.
+func TestBulkLoad_ZeroOptions(t *testing.T) {
+	require := require.New(t)
+
+	for _, db := range []Database{newTestBoltDatabase("boltdb-bulkload-zero", t), newTestBadgerDatabase("badgerdb-bulkload-zero", t)} {
+		remaining := 100
+		source := KVSourceFunc(func() ([]byte, []byte, error) {
+			if remaining == 0 {
+				return nil, nil, io.EOF
+			}
+			remaining--
+			return []byte{byte(remaining)}, []byte("value"), nil
+		})
+		ctx := db.GetContext([]byte("zero"))
+		result, err := BulkLoad(db, ctx, source, BulkLoadOptions{})
+		require.NoError(err)
+		require.Equal(uint64(100), result.Items)
+		require.Zero(result.SpilledRuns)
+		require.NoError(db.Close())
+		require.NoError(db.Erase())
+	}
+}
+
+func GenericBulkLoadTest(db Database, ctx Context, t *testing.T) *BulkLoadResult {
+	require := require.New(t)
+
+	items := 5000
+	expected := make(map[Key][]byte)
+	var pairs []*kvPair
+	for ii := 0; ii < items; ii++ {
+		randomKey, err := RandomBytes(32)
+		require.NoError(err)
+		value, err := RandomBytes(64)
+		require.NoError(err)
+		pairs = append(pairs, &kvPair{key: randomKey, value: value})
+		expected[NewKey(randomKey)] = value
+	}
+	// Overwrite every tenth key later in the stream, so duplicates span spilled runs.
+	for ii := 0; ii < items; ii += 10 {
+		value, err := RandomBytes(64)
+		require.NoError(err)
+		pairs = append(pairs, &kvPair{key: pairs[ii].key, value: value})
+		expected[NewKey(pairs[ii].key)] = value
+	}
+
+	source := func() KVSource {
+		remaining := pairs
+		return KVSourceFunc(func() ([]byte, []byte, error) {
+			if len(remaining) == 0 {
+				return nil, nil, io.EOF
+			}
+			pair := remaining[0]
+			remaining = remaining[1:]
+			return pair.key, pair.value, nil
+		})
+	}
+
+	opts := DefaultBulkLoadOptions()
+	opts.MemoryBudget = 64 << 10
+	result, err := BulkLoad(db, ctx, source(), opts)
+	require.NoError(err)
+	require.Equal(uint64(items), result.Items)
+	require.Greater(result.SpilledRuns, 1)
+
+	var keys [][]byte
+	var values [][]byte
+	for key, value := range expected {
+		keys = append(keys, key.Bytes())
+		values = append(values, value)
+	}
+	require.NoError(db.View(ctx, func(tx Transaction, ctx Context) error {
+		got, found, err := tx.MultiGet(keys, ctx)
+		require.NoError(err)
+		for ii := range keys {
+			require.True(found[ii])
+		}
+		require.Equal(values, got)
+		return nil
+	}))
+
+	// Regular transactions keep working after the load.
+	require.NoError(db.Update(ctx, func(tx Transaction, ctx Context) error {
+		return tx.Set([]byte("after-load"), []byte("value"), ctx)
+	}))
+	require.NoError(db.View(ctx, func(tx Transaction, ctx Context) error {
+		value, err := tx.Get([]byte("after-load"), ctx)
+		require.NoError(err)
+		require.Equal([]byte("value"), value)
+		return nil
+	}))
+
+	_, err = BulkLoad(db, ctx, source(), opts)
+	require.True(errors.Is(err, ErrBulkLoadContextNotEmpty))
+	return result
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/dgraph-io/badger/v4"
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultBulkUpdateBatchBytes is 8 MB, which fits in a single transaction under
+	// Badger's default 64 MB memtable.
+	DefaultBulkUpdateBatchBytes = 8 << 20
+
+	// bulkUpdateOperationOverhead approximates the per-operation bookkeeping a backend
+	// adds on top of the key and value bytes.
+	bulkUpdateOperationOverhead = 32
+)
+
+var bulkUpdateCheckpointContextId = []byte("__bulk_update")
+
+type BulkUpdateOptions struct {
+	// MaxBatchBytes is the budget of key and value bytes committed in a single transaction.
+	MaxBatchBytes int
+	// JobId makes the bulk update resumable. Progress is checkpointed under this id in
+	// the same transaction as each batch, and a rerun with the same id skips operations
+	// that were already committed. Leave empty to disable checkpointing.
+	JobId []byte
+}
+
+func DefaultBulkUpdateOptions() BulkUpdateOptions {
+	return BulkUpdateOptions{
+		MaxBatchBytes: DefaultBulkUpdateBatchBytes,
+	}
+}
+
+type BulkUpdateResult struct {
+	// Operations is the number of operations issued by the write function.
+	Operations uint64
+	// Committed is the number of operations committed by this call.
+	Committed uint64
+	// Skipped is the number of operations skipped because a previous run of the same
+	// job already committed them.
+	Skipped uint64
+	// Batches is the number of transactions committed.
+	Batches int
+}
+
+// BulkUpdateError is returned when a bulk update fails. Because a bulk update is not
+// atomic, the operations counted in Committed are durable even though the update failed.
+type BulkUpdateError struct {
+	Err       error
+	Committed uint64
+}
+
+func (e *BulkUpdateError) Error() string {
+	return fmt.Sprintf("BulkUpdate: failed after committing %v operations: %v", e.Committed, e.Err)
+}
+
+func (e *BulkUpdateError) Unwrap() error {
+	return e.Err
+}
+
+type BulkWriter interface {
+	Set(key []byte, value []byte, ctx Context) error
+	Delete(key []byte, ctx Context) error
+}
+
+// BulkUpdate applies a write set that may be too large for a single transaction. Writes
+// issued by fn are buffered and committed in several transactions of at most
+// opts.MaxBatchBytes each. A batch rejected with badger.ErrTxnTooBig is split in half
+// and retried, so the budget does not need to match the backend's limits exactly.
+//
+// A bulk update is NOT atomic. Concurrent readers can observe a partially applied write
+// set, and on failure the batches committed so far remain in the database, as reported
+// by BulkUpdateError. To resume after a crash, rerun fn with the same opts.JobId; fn
+// must then issue the same operations in the same order.
+func BulkUpdate(db Database, ctx Context, opts BulkUpdateOptions, fn func(BulkWriter, Context) error) (*BulkUpdateResult, error) {
+	bw := newBulkWriter(db, ctx, opts)
+	if len(opts.JobId) > 0 {
+		if err := bw.loadCheckpoint(); err != nil {
+			return bw.result, &BulkUpdateError{Err: err}
+		}
+	}
+	if err := fn(bw, ctx); err != nil {
+		return bw.result, &BulkUpdateError{Err: err, Committed: bw.result.Committed}
+	}
+	if err := bw.finish(); err != nil {
+		return bw.result, &BulkUpdateError{Err: err, Committed: bw.result.Committed}
+	}
+	return bw.result, nil
+}
+
+type bulkOperation struct {
+	ctx    Context
+	key    []byte
+	value  []byte
+	delete bool
+}
+
+type bulkWriter struct {
+	db            Database
+	ctx           Context
+	opts          BulkUpdateOptions
+	checkpointCtx Context
+	result        *BulkUpdateResult
+
+	// checkpoint is the number of operations of this job committed so far, including
+	// the ones committed by previous runs.
+	checkpoint   uint64
+	pending      []*bulkOperation
+	pendingBytes int
+}
+
+func newBulkWriter(db Database, ctx Context, opts BulkUpdateOptions) *bulkWriter {
+	return &bulkWriter{
+		db:            db,
+		ctx:           ctx,
+		opts:          opts,
+		checkpointCtx: db.GetContext(bulkUpdateCheckpointContextId),
+		result:        &BulkUpdateResult{},
+	}
+}
+
+func (bw *bulkWriter) Set(key []byte, value []byte, ctx Context) error {
+	op := &bulkOperation{
+		ctx:   ctx,
+		key:   append([]byte{}, key...),
+		value: append([]byte{}, value...),
+	}
+	return bw.add(op)
+}
+
+func (bw *bulkWriter) Delete(key []byte, ctx Context) error {
+	op := &bulkOperation{
+		ctx:    ctx,
+		key:    append([]byte{}, key...),
+		delete: true,
+	}
+	return bw.add(op)
+}
+
+func (bw *bulkWriter) add(op *bulkOperation) error {
+	bw.result.Operations++
+	if bw.result.Operations <= bw.checkpoint {
+		bw.result.Skipped++
+		return nil
+	}
+
+	bw.pending = append(bw.pending, op)
+	bw.pendingBytes += len(op.key) + len(op.value) + bulkUpdateOperationOverhead
+	if bw.pendingBytes < bw.opts.MaxBatchBytes {
+		return nil
+	}
+	return bw.flush()
+}
+
+func (bw *bulkWriter) flush() error {
+	if len(bw.pending) == 0 {
+		return nil
+	}
+	if err := bw.commit(bw.pending, false); err != nil {
+		return err
+	}
+	bw.pending = nil
+	bw.pendingBytes = 0
+	return nil
+}
+
+func (bw *bulkWriter) cancel() {
+	bw.pending = nil
+	bw.pendingBytes = 0
+}
+
+// finish commits the remaining operations and clears the checkpoint, so the job id
+// can be reused.
+func (bw *bulkWriter) finish() error {
+	if len(bw.opts.JobId) == 0 {
+		return bw.flush()
+	}
+	if err := bw.commit(bw.pending, true); err != nil {
+		return err
+	}
+	bw.pending = nil
+	bw.pendingBytes = 0
+	return nil
+}
+
+func (bw *bulkWriter) commit(ops []*bulkOperation, last bool) error {
+	err := bw.db.Update(bw.updateContext(ops), func(tx Transaction, ctx Context) error {
+		for _, op := range ops {
+			var err error
+			if op.delete {
+				err = tx.Delete(op.key, op.ctx)
+			} else {
+				err = tx.Set(op.key, op.value, op.ctx)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if len(bw.opts.JobId) == 0 {
+			return nil
+		}
+		if last {
+			return tx.Delete(bw.opts.JobId, bw.checkpointCtx)
+		}
+		checkpoint := make([]byte, 8)
+		binary.BigEndian.PutUint64(checkpoint, bw.checkpoint+uint64(len(ops)))
+		return tx.Set(bw.opts.JobId, checkpoint, bw.checkpointCtx)
+	})
+
+	if errors.Is(err, badger.ErrTxnTooBig) && len(ops) > 1 {
+		half := len(ops) / 2
+		if err := bw.commit(ops[:half], false); err != nil {
+			return err
+		}
+		return bw.commit(ops[half:], last)
+	}
+	if err != nil {
+		return err
+	}
+
+	bw.checkpoint += uint64(len(ops))
+	bw.result.Committed += uint64(len(ops))
+	bw.result.Batches++
+	return nil
+}
+
+// updateContext is the context the Update committing ops runs in. Write batches span
+// contexts and have none of their own, so they use the context of their first operation.
+func (bw *bulkWriter) updateContext(ops []*bulkOperation) Context {
+	if bw.ctx != nil {
+		return bw.ctx
+	}
+	if len(ops) > 0 {
+		return ops[0].ctx
+	}
+	return bw.checkpointCtx
+}
+
+func (bw *bulkWriter) loadCheckpoint() error {
+	return bw.db.View(bw.checkpointCtx, func(tx Transaction, checkpointCtx Context) error {
+		values, found, err := tx.MultiGet([][]byte{bw.opts.JobId}, checkpointCtx)
+		if err != nil {
+			return errors.Wrapf(err, "Problem reading checkpoint")
+		}
+		if !found[0] {
+			return nil
+		}
+		if len(values[0]) != 8 {
+			return errors.Errorf("Invalid checkpoint length %v", len(values[0]))
+		}
+		bw.checkpoint = binary.BigEndian.Uint64(values[0])
+		return nil
+	})
+}
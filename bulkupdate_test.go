@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"os"
+	"testing"
+)
+
+// TestBulkUpdate_SplitsOversizedWrites writes more data than a single transaction can hold under
+// a small memtable, with a batch budget too large to avoid badger.ErrTxnTooBig on its own.
+func TestBulkUpdate_SplitsOversizedWrites(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := os.MkdirTemp("", "badgerdb-bulkupdate")
+	require.NoError(err)
+	opts := DefaultBadgerOptions(dir)
+	opts.MemTableSize = 8 << 20
+	db := NewBadgerDatabase(opts)
+	require.NoError(db.Setup())
+	defer db.Erase()
+	defer db.Close()
+
+	ctx := db.GetContext([]byte("TestPrefix"))
+	items := 256
+	value, err := RandomBytes(16 << 10)
+	require.NoError(err)
+
+	result, err := BulkUpdate(db, ctx, BulkUpdateOptions{MaxBatchBytes: 1 << 30}, func(bw BulkWriter, ctx Context) error {
+		for ii := 0; ii < items; ii++ {
+			if err := bw.Set(bulkTestKey(ii), value, ctx); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(err)
+	require.Equal(uint64(items), result.Committed)
+	require.Greater(result.Batches, 1)
+	requireBulkTestKeys(db, ctx, items, t)
+}
+
+// TestBulkUpdate_Resume interrupts a checkpointed bulk update and resumes it with the same job id.
+func TestBulkUpdate_Resume(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := os.MkdirTemp("", "boltdb-bulkupdate")
+	require.NoError(err)
+	db := NewBoltDatabase(dir)
+	require.NoError(db.Setup())
+	defer db.Erase()
+	defer db.Close()
+
+	ctx := db.GetContext([]byte("TestBucket"))
+	items := 100
+	opts := BulkUpdateOptions{MaxBatchBytes: 1 << 10, JobId: []byte("job")}
+	crash := errors.New("crash")
+	write := func(failAt int) func(BulkWriter, Context) error {
+		return func(bw BulkWriter, ctx Context) error {
+			for ii := 0; ii < items; ii++ {
+				if ii == failAt {
+					return crash
+				}
+				if err := bw.Set(bulkTestKey(ii), make([]byte, 100), ctx); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+
+	result, err := BulkUpdate(db, ctx, opts, write(60))
+	var bulkErr *BulkUpdateError
+	require.True(errors.As(err, &bulkErr))
+	require.True(errors.Is(err, crash))
+	require.Equal(result.Committed, bulkErr.Committed)
+	require.Greater(bulkErr.Committed, uint64(0))
+
+	resumed, err := BulkUpdate(db, ctx, opts, write(-1))
+	require.NoError(err)
+	require.Equal(bulkErr.Committed, resumed.Skipped)
+	require.Equal(uint64(items), resumed.Skipped+resumed.Committed)
+	requireBulkTestKeys(db, ctx, items, t)
+
+	// The checkpoint is cleared once the job completes.
+	fresh, err := BulkUpdate(db, ctx, opts, write(-1))
+	require.NoError(err)
+	require.Equal(uint64(0), fresh.Skipped)
+}
+
+func bulkTestKey(ii int) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(ii))
+	return key
+}
+
+func requireBulkTestKeys(db Database, ctx Context, items int, t *testing.T) {
+	require := require.New(t)
+	keys := make([][]byte, items)
+	for ii := range keys {
+		keys[ii] = bulkTestKey(ii)
+	}
+	require.NoError(db.View(ctx, func(tx Transaction, ctx Context) error {
+		_, found, err := tx.MultiGet(keys, ctx)
+		require.NoError(err)
+		for ii := range found {
+			require.True(found[ii])
+		}
+		return nil
+	}))
+}
+
+// TestBulkUpdate_WriteBatchContext commits a write batch, which has no context of its
+// own, through a wrapper that reads the context of every Update.
+func TestBulkUpdate_WriteBatchContext(t *testing.T) {
+	require := require.New(t)
+
+	boltDb := newTestBoltDatabase("boltdb-bulkupdate-writebatch", t)
+	defer boltDb.Erase()
+	defer boltDb.Close()
+	metrics := NewDatabaseMetrics()
+	db := NewInstrumentedDatabase(boltDb, metrics)
+
+	ctx := db.GetContext([]byte("TestBucket"))
+	bw := newBulkWriter(db, nil, DefaultBulkUpdateOptions())
+	require.NoError(bw.Set(bulkTestKey(0), []byte("value"), ctx))
+	require.NoError(bw.flush())
+	requireBulkTestKeys(db, ctx, 1, t)
+
+	var updates uint64
+	for _, operation := range metrics.Snapshot() {
+		if operation.Operation == OperationUpdate {
+			require.Equal(ctx.Path(), operation.Path)
+			updates += operation.Count
+		}
+	}
+	require.Equal(uint64(1), updates)
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"container/list"
+	"io"
+	"sync"
+)
+
+const (
+	// DefaultCacheMaxBytes is 64 MB.
+	DefaultCacheMaxBytes = 64 << 20
+
+	// cacheEntryOverhead approximates the memory of an entry on top of its key and value.
+	cacheEntryOverhead = 96
+)
+
+type CacheOptions struct {
+	// MaxBytes bounds the memory of the cached keys and values, overhead included.
+	MaxBytes int64
+}
+
+func DefaultCacheOptions() CacheOptions {
+	return CacheOptions{
+		MaxBytes: DefaultCacheMaxBytes,
+	}
+}
+
+type CacheStats struct {
+	Hits   uint64
+	Misses uint64
+	// Fills is the number of values added to the cache after a miss.
+	Fills uint64
+	// Evictions is the number of entries evicted to stay under MaxBytes.
+	Evictions uint64
+	// Invalidations is the number of keys invalidated by committed writes.
+	Invalidations uint64
+	// Bytes is the current memory of the cache.
+	Bytes int64
+}
+
+func (stats CacheStats) HitRatio() float64 {
+	if stats.Hits+stats.Misses == 0 {
+		return 0
+	}
+	return float64(stats.Hits) / float64(stats.Hits+stats.Misses)
+}
+
+// ==========================
+// CachedDatabase
+// ==========================
+
+// CachedDatabase keeps the values read from any Database in an LRU cache of bounded
+// memory, keyed by context path and key, so that hot keys are served the same way on
+// both backends.
+//
+// Writes never fill the cache, so a rolled back write is never served. Keys written by a
+// transaction are invalidated once it returns, and a read racing the commit may still
+// return the previous value, as a transaction that started before the commit would. A
+// value read by a transaction is only cached if no write to its key was invalidated
+// since the transaction started, since the transaction may have read it before the
+// write committed. Iterators bypass the cache, and misses aren't cached.
+//
+// Every write must go through the wrapper, or the cache serves stale values.
+type CachedDatabase struct {
+	db    Database
+	cache *valueCache
+}
+
+func NewCachedDatabase(db Database, opts CacheOptions) *CachedDatabase {
+	return &CachedDatabase{
+		db:    db,
+		cache: newValueCache(opts.MaxBytes),
+	}
+}
+
+func (cdb *CachedDatabase) Stats() CacheStats {
+	return cdb.cache.snapshot()
+}
+
+func (cdb *CachedDatabase) Setup() error {
+	return cdb.db.Setup()
+}
+
+func (cdb *CachedDatabase) GetContext(id []byte) Context {
+	return cdb.db.GetContext(id)
+}
+
+func (cdb *CachedDatabase) Update(ctx Context, fn func(Transaction, Context) error) error {
+	// The epoch is read before the transaction takes its snapshot.
+	T := NewCachedTransaction(cdb, cdb.cache.currentEpoch())
+	err := cdb.db.Update(ctx, func(tx Transaction, ctx Context) error {
+		T.tx = tx
+		return fn(T, ctx)
+	})
+	// Invalidating is harmless if the transaction rolled back.
+	cdb.cache.invalidate(T.written)
+	return err
+}
+
+func (cdb *CachedDatabase) View(ctx Context, fn func(Transaction, Context) error) error {
+	T := NewCachedTransaction(cdb, cdb.cache.currentEpoch())
+	return cdb.db.View(ctx, func(tx Transaction, ctx Context) error {
+		T.tx = tx
+		return fn(T, ctx)
+	})
+}
+
+func (cdb *CachedDatabase) NewWriteBatch() WriteBatch {
+	return NewCachedWriteBatch(cdb, cdb.db.NewWriteBatch())
+}
+
+func (cdb *CachedDatabase) Backup(w io.Writer) error {
+	return cdb.db.Backup(w)
+}
+
+func (cdb *CachedDatabase) BackupSince(w io.Writer, since uint64) (uint64, error) {
+	return cdb.db.BackupSince(w, since)
+}
+
+func (cdb *CachedDatabase) Restore(r io.Reader) error {
+	defer cdb.cache.clear()
+	return cdb.db.Restore(r)
+}
+
+func (cdb *CachedDatabase) Close() error {
+	cdb.cache.clear()
+	return cdb.db.Close()
+}
+
+func (cdb *CachedDatabase) Erase() error {
+	cdb.cache.clear()
+	return cdb.db.Erase()
+}
+
+func (cdb *CachedDatabase) Id() DatabaseId {
+	return cdb.db.Id()
+}
+
+func (cdb *CachedDatabase) checkIntegrity(report *IntegrityReport) error {
+	return checkWrappedIntegrity(cdb.db, report)
+}
+
+func (cdb *CachedDatabase) nestedContextIds(ctx Context) ([][]byte, error) {
+	return listNestedContextIds(cdb.db, ctx)
+}
+
+func cacheKey(ctx Context, key []byte) string {
+	return string(encodeRecordLocation(ctx.Path(), key))
+}
+
+// ==========================
+// CachedTransaction
+// ==========================
+
+type CachedTransaction struct {
+	db *CachedDatabase
+	tx Transaction
+
+	// startEpoch is the cache epoch when the transaction started.
+	startEpoch uint64
+	// written are the cache keys of the keys written by the transaction, which it reads
+	// from the transaction rather than from the cache.
+	written map[string]bool
+}
+
+func NewCachedTransaction(db *CachedDatabase, startEpoch uint64) *CachedTransaction {
+	return &CachedTransaction{
+		db:         db,
+		startEpoch: startEpoch,
+		written:    make(map[string]bool),
+	}
+}
+
+func (ctc *CachedTransaction) Set(key []byte, value []byte, ctx Context) error {
+	ctc.written[cacheKey(ctx, key)] = true
+	return ctc.tx.Set(key, value, ctx)
+}
+
+func (ctc *CachedTransaction) Delete(key []byte, ctx Context) error {
+	ctc.written[cacheKey(ctx, key)] = true
+	return ctc.tx.Delete(key, ctx)
+}
+
+func (ctc *CachedTransaction) Get(key []byte, ctx Context) ([]byte, error) {
+	location := cacheKey(ctx, key)
+	if ctc.written[location] {
+		return ctc.tx.Get(key, ctx)
+	}
+	if value, ok := ctc.db.cache.get(location); ok {
+		return value, nil
+	}
+	value, err := ctc.tx.Get(key, ctx)
+	if value, found, resultErr := getResult(value, err); resultErr == nil && found {
+		ctc.db.cache.fill(location, value, ctc.startEpoch)
+	}
+	return value, err
+}
+
+func (ctc *CachedTransaction) MultiGet(keys [][]byte, ctx Context) ([][]byte, []bool, error) {
+	values := make([][]byte, len(keys))
+	found := make([]bool, len(keys))
+	locations := make([]string, len(keys))
+	var missing [][]byte
+	var missingIndexes []int
+	for ii, key := range keys {
+		locations[ii] = cacheKey(ctx, key)
+		if !ctc.written[locations[ii]] {
+			if values[ii], found[ii] = ctc.db.cache.get(locations[ii]); found[ii] {
+				continue
+			}
+		}
+		missing = append(missing, key)
+		missingIndexes = append(missingIndexes, ii)
+	}
+	if len(missing) == 0 {
+		return values, found, nil
+	}
+
+	missingValues, missingFound, err := ctc.tx.MultiGet(missing, ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	for jj, ii := range missingIndexes {
+		values[ii], found[ii] = missingValues[jj], missingFound[jj]
+		if found[ii] && !ctc.written[locations[ii]] {
+			ctc.db.cache.fill(locations[ii], values[ii], ctc.startEpoch)
+		}
+	}
+	return values, found, nil
+}
+
+func (ctc *CachedTransaction) GetIterator(ctx Context) (Iterator, error) {
+	return ctc.tx.GetIterator(ctx)
+}
+
+// ==========================
+// CachedWriteBatch
+// ==========================
+
+// CachedWriteBatch invalidates keys as they are added to the batch, and again on Flush,
+// since a batch commits in the background, and a read between the two may have cached
+// the value the batch overwrote.
+type CachedWriteBatch struct {
+	db *CachedDatabase
+	wb WriteBatch
+
+	written map[string]bool
+}
+
+func NewCachedWriteBatch(db *CachedDatabase, wb WriteBatch) *CachedWriteBatch {
+	return &CachedWriteBatch{
+		db:      db,
+		wb:      wb,
+		written: make(map[string]bool),
+	}
+}
+
+func (cwb *CachedWriteBatch) Set(key []byte, value []byte, ctx Context) error {
+	cwb.invalidate(cacheKey(ctx, key))
+	return cwb.wb.Set(key, value, ctx)
+}
+
+func (cwb *CachedWriteBatch) Delete(key []byte, ctx Context) error {
+	cwb.invalidate(cacheKey(ctx, key))
+	return cwb.wb.Delete(key, ctx)
+}
+
+func (cwb *CachedWriteBatch) invalidate(location string) {
+	cwb.written[location] = true
+	cwb.db.cache.invalidate(map[string]bool{location: true})
+}
+
+func (cwb *CachedWriteBatch) Flush() error {
+	defer cwb.db.cache.invalidate(cwb.written)
+	return cwb.wb.Flush()
+}
+
+func (cwb *CachedWriteBatch) Cancel() {
+	// Part of a cancelled batch may have been committed.
+	defer cwb.db.cache.invalidate(cwb.written)
+	cwb.wb.Cancel()
+}
+
+// ==========================
+// valueCache
+// ==========================
+
+// valueCache is an LRU cache of values. An invalidated key leaves a tombstone holding
+// the epoch of the invalidation, and a value read by a transaction that started before
+// it can't fill the cache. Tombstones are evicted like values, and the transactions
+// that started before an evicted tombstone can't fill the cache at all.
+type valueCache struct {
+	sync.Mutex
+
+	maxBytes int64
+	bytes    int64
+	entries  map[string]*list.Element
+	lru      *list.List
+
+	epoch uint64
+	// evictedEpoch is the latest epoch of an evicted tombstone.
+	evictedEpoch uint64
+
+	stats CacheStats
+}
+
+type valueCacheEntry struct {
+	key   string
+	value []byte
+	// epoch is set for tombstones, which have a nil value.
+	epoch uint64
+}
+
+func newValueCache(maxBytes int64) *valueCache {
+	return &valueCache{
+		maxBytes: maxBytes,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+func (vc *valueCache) currentEpoch() uint64 {
+	vc.Lock()
+	defer vc.Unlock()
+
+	return vc.epoch
+}
+
+// get returns a copy of the cached value, since callers may modify it.
+func (vc *valueCache) get(key string) ([]byte, bool) {
+	vc.Lock()
+	defer vc.Unlock()
+
+	element, exists := vc.entries[key]
+	if !exists || element.Value.(*valueCacheEntry).value == nil {
+		vc.stats.Misses++
+		return nil, false
+	}
+	vc.stats.Hits++
+	vc.lru.MoveToFront(element)
+	return append([]byte{}, element.Value.(*valueCacheEntry).value...), true
+}
+
+// fill caches a value read by a transaction that started at startEpoch, unless the key
+// may have been written since.
+func (vc *valueCache) fill(key string, value []byte, startEpoch uint64) {
+	vc.Lock()
+	defer vc.Unlock()
+
+	if startEpoch < vc.evictedEpoch {
+		return
+	}
+	if element, exists := vc.entries[key]; exists {
+		if entry := element.Value.(*valueCacheEntry); entry.value == nil && startEpoch < entry.epoch {
+			return
+		}
+		vc.remove(element)
+	}
+	vc.stats.Fills++
+	// Non-nil, so that empty values aren't taken for tombstones.
+	vc.add(&valueCacheEntry{key: key, value: append([]byte{}, value...)})
+}
+
+func (vc *valueCache) invalidate(keys map[string]bool) {
+	if len(keys) == 0 {
+		return
+	}
+	vc.Lock()
+	defer vc.Unlock()
+
+	vc.epoch++
+	for key := range keys {
+		if element, exists := vc.entries[key]; exists {
+			vc.remove(element)
+		}
+		vc.stats.Invalidations++
+		vc.add(&valueCacheEntry{key: key, epoch: vc.epoch})
+	}
+}
+
+func (vc *valueCache) add(entry *valueCacheEntry) {
+	vc.entries[entry.key] = vc.lru.PushFront(entry)
+	vc.bytes += entry.size()
+	for vc.bytes > vc.maxBytes && vc.lru.Len() > 0 {
+		oldest := vc.lru.Back()
+		if evicted := oldest.Value.(*valueCacheEntry); evicted.value == nil && evicted.epoch > vc.evictedEpoch {
+			vc.evictedEpoch = evicted.epoch
+		}
+		vc.remove(oldest)
+		vc.stats.Evictions++
+	}
+}
+
+func (vc *valueCache) remove(element *list.Element) {
+	entry := vc.lru.Remove(element).(*valueCacheEntry)
+	delete(vc.entries, entry.key)
+	vc.bytes -= entry.size()
+}
+
+// clear drops every entry. Transactions in flight can't fill the cache afterwards.
+func (vc *valueCache) clear() {
+	vc.Lock()
+	defer vc.Unlock()
+
+	vc.epoch++
+	vc.evictedEpoch = vc.epoch
+	vc.entries = make(map[string]*list.Element)
+	vc.lru.Init()
+	vc.bytes = 0
+}
+
+func (vc *valueCache) snapshot() CacheStats {
+	vc.Lock()
+	defer vc.Unlock()
+
+	stats := vc.stats
+	stats.Bytes = vc.bytes
+	return stats
+}
+
+func (entry *valueCacheEntry) size() int64 {
+	return int64(len(entry.key) + len(entry.value) + cacheEntryOverhead)
+}
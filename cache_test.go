@@ -0,0 +1,112 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+// TestCachedDatabase checks on Bolt and Badger that reads are served from the cache, and
+// that committed writes invalidate it while rolled back writes are never served.
+func TestCachedDatabase(t *testing.T) {
+	require := require.New(t)
+
+	boltDb := newTestBoltDatabase("boltdb-cached", t)
+	defer boltDb.Erase()
+	defer boltDb.Close()
+	badgerDb := newTestBadgerDatabase("badgerdb-cached", t)
+	defer badgerDb.Erase()
+	defer badgerDb.Close()
+
+	for _, raw := range []Database{boltDb, badgerDb} {
+		db := NewCachedDatabase(raw, DefaultCacheOptions())
+		ctx := db.GetContext([]byte("blocks"))
+		get := func(key string) string {
+			var value []byte
+			require.NoError(db.View(ctx, func(tx Transaction, ctx Context) error {
+				var err error
+				value, _, err = getResult(tx.Get([]byte(key), ctx))
+				return err
+			}))
+			return string(value)
+		}
+
+		require.NoError(db.Update(ctx, func(tx Transaction, ctx Context) error {
+			return tx.Set([]byte("a"), []byte("1"), ctx)
+		}))
+		require.Equal("1", get("a"))
+		require.Equal("1", get("a"))
+		require.Equal("", get("missing"))
+		stats := db.Stats()
+		require.Equal(uint64(1), stats.Hits)
+		require.Equal(uint64(2), stats.Misses)
+		require.InDelta(1.0/3, stats.HitRatio(), 1e-9)
+
+		// A rolled back write is neither served nor read by the transaction from the cache.
+		require.Error(db.Update(ctx, func(tx Transaction, ctx Context) error {
+			require.NoError(tx.Set([]byte("a"), []byte("2"), ctx))
+			value, err := tx.Get([]byte("a"), ctx)
+			require.NoError(err)
+			require.Equal("2", string(value))
+			return errors.New("rollback")
+		}))
+		require.Equal("1", get("a"))
+
+		require.NoError(db.Update(ctx, func(tx Transaction, ctx Context) error {
+			return tx.Set([]byte("a"), []byte("3"), ctx)
+		}))
+		require.Equal("3", get("a"))
+
+		wb := db.NewWriteBatch()
+		require.NoError(wb.Delete([]byte("a"), ctx))
+		require.NoError(wb.Set([]byte("b"), []byte("4"), ctx))
+		require.NoError(wb.Flush())
+		require.Equal("", get("a"))
+
+		require.NoError(db.View(ctx, func(tx Transaction, ctx Context) error {
+			values, found, err := tx.MultiGet([][]byte{[]byte("a"), []byte("b"), []byte("b")}, ctx)
+			require.NoError(err)
+			require.Equal([]bool{false, true, true}, found)
+			require.Equal("4", string(values[2]))
+			return nil
+		}))
+		require.Equal("4", get("b"))
+		require.Positive(db.Stats().Invalidations)
+	}
+}
+
+// TestValueCache checks that a value read before a write was invalidated isn't cached,
+// and that the cache stays under its memory bound.
+func TestValueCache(t *testing.T) {
+	require := require.New(t)
+
+	cache := newValueCache(4 * (cacheEntryOverhead + 2))
+	start := cache.currentEpoch()
+	cache.invalidate(map[string]bool{"a": true})
+	cache.fill("a", []byte("1"), start)
+	_, ok := cache.get("a")
+	require.False(ok)
+	cache.fill("a", []byte("1"), cache.currentEpoch())
+	value, ok := cache.get("a")
+	require.True(ok)
+	require.Equal("1", string(value))
+
+	for _, key := range []string{"b", "c", "d", "e", "f"} {
+		cache.fill(key, []byte("1"), cache.currentEpoch())
+	}
+	stats := cache.snapshot()
+	require.LessOrEqual(stats.Bytes, int64(4*(cacheEntryOverhead+2)))
+	require.Positive(stats.Evictions)
+	_, ok = cache.get("a")
+	require.False(ok)
+
+	// Evicting a tombstone stops older transactions from filling the cache at all.
+	start = cache.currentEpoch()
+	cache.invalidate(map[string]bool{"g": true})
+	for _, key := range []string{"h", "i", "j", "k"} {
+		cache.fill(key, []byte("1"), cache.currentEpoch())
+	}
+	cache.fill("l", []byte("1"), start)
+	_, ok = cache.get("l")
+	require.False(ok)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+	"time"
+)
+
+// runContext runs fn in a transaction opened by run, with operations that stop with goCtx.
+func runContext(goCtx context.Context, run func(Context, func(Transaction, Context) error) error, ctx Context,
+	fn func(context.Context, Transaction, Context) error) error {
+
+	if err := goCtx.Err(); err != nil {
+		return err
+	}
+	return run(ctx, func(tx Transaction, ctx Context) error {
+		// Opening the transaction may have waited on a lock.
+		if err := goCtx.Err(); err != nil {
+			return err
+		}
+		if err := fn(goCtx, NewCancellableTransaction(goCtx, tx), ctx); err != nil {
+			return err
+		}
+		// Returning an error rolls the transaction back instead of committing it.
+		return goCtx.Err()
+	})
+}
+
+// ContextSetup is implemented by databases that can bound how long Setup waits.
+type ContextSetup interface {
+	SetupContext(goCtx context.Context) error
+}
+
+// SetupContext sets db up, giving up once goCtx is done. Databases that don't implement
+// ContextSetup are set up in the background, and closed if their setup completes after
+// goCtx is done.
+func SetupContext(goCtx context.Context, db Database) error {
+	if cdb, ok := db.(ContextSetup); ok {
+		return cdb.SetupContext(goCtx)
+	}
+	return setupWithContext(goCtx, db, db.Setup)
+}
+
+func setupWithContext(goCtx context.Context, db Database, setup func() error) error {
+	if err := goCtx.Err(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- setup()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-goCtx.Done():
+		go func() {
+			if <-done == nil {
+				db.Close()
+			}
+		}()
+		return goCtx.Err()
+	}
+}
+
+// SetupContext opens the database, waiting for the file lock until the deadline of
+// goCtx, which Bolt otherwise waits for indefinitely.
+func (bdb *BoltDatabase) SetupContext(goCtx context.Context) error {
+	opts := &bolt.Options{}
+	if deadline, ok := goCtx.Deadline(); ok {
+		if opts.Timeout = time.Until(deadline); opts.Timeout <= 0 {
+			return context.DeadlineExceeded
+		}
+	}
+	return setupWithContext(goCtx, bdb, func() error {
+		err := bdb.setup(opts)
+		if errors.Is(err, bolt.ErrTimeout) {
+			return errors.Wrapf(context.DeadlineExceeded, "SetupContext: Database is locked")
+		}
+		return err
+	})
+}
+
+// ==========================
+// CancellableTransaction
+// ==========================
+
+// CancellableTransaction fails every operation once its Go context is done.
+type CancellableTransaction struct {
+	goCtx context.Context
+	tx    Transaction
+}
+
+func NewCancellableTransaction(goCtx context.Context, tx Transaction) *CancellableTransaction {
+	return &CancellableTransaction{
+		goCtx: goCtx,
+		tx:    tx,
+	}
+}
+
+func (cx *CancellableTransaction) Set(key []byte, value []byte, ctx Context) error {
+	if err := cx.goCtx.Err(); err != nil {
+		return err
+	}
+	return cx.tx.Set(key, value, ctx)
+}
+
+func (cx *CancellableTransaction) Delete(key []byte, ctx Context) error {
+	if err := cx.goCtx.Err(); err != nil {
+		return err
+	}
+	return cx.tx.Delete(key, ctx)
+}
+
+func (cx *CancellableTransaction) Get(key []byte, ctx Context) ([]byte, error) {
+	if err := cx.goCtx.Err(); err != nil {
+		return nil, err
+	}
+	return cx.tx.Get(key, ctx)
+}
+
+func (cx *CancellableTransaction) MultiGet(keys [][]byte, ctx Context) ([][]byte, []bool, error) {
+	if err := cx.goCtx.Err(); err != nil {
+		return nil, nil, err
+	}
+	return cx.tx.MultiGet(keys, ctx)
+}
+
+func (cx *CancellableTransaction) GetIterator(ctx Context) (Iterator, error) {
+	if err := cx.goCtx.Err(); err != nil {
+		return nil, err
+	}
+	it, err := cx.tx.GetIterator(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return NewCancellableIterator(cx.goCtx, it), nil
+}
+
+// ==========================
+// CancellableIterator
+// ==========================
+
+// CancellableIterator ends once its Go context is done. Since Next can't return an
+// error, callers tell a cancelled iteration from a complete one with the context's Err.
+type CancellableIterator struct {
+	done <-chan struct{}
+	it   Iterator
+}
+
+func NewCancellableIterator(goCtx context.Context, it Iterator) *CancellableIterator {
+	return &CancellableIterator{
+		done: goCtx.Done(),
+		it:   it,
+	}
+}
+
+func (cit *CancellableIterator) cancelled() bool {
+	select {
+	case <-cit.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (cit *CancellableIterator) GetContext() Context {
+	return cit.it.GetContext()
+}
+
+func (cit *CancellableIterator) Value() ([]byte, error) {
+	return cit.it.Value()
+}
+
+func (cit *CancellableIterator) Key() []byte {
+	return cit.it.Key()
+}
+
+func (cit *CancellableIterator) localKey() []byte {
+	return iteratorLocalKey(cit.it)
+}
+
+func (cit *CancellableIterator) Next() bool {
+	return !cit.cancelled() && cit.it.Next()
+}
+
+func (cit *CancellableIterator) Seek(key []byte) bool {
+	return !cit.cancelled() && cit.it.Seek(key)
+}
+
+func (cit *CancellableIterator) Close() {
+	cit.it.Close()
+}
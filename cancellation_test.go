@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+// TestCancellation cancels updates and scans on Bolt and Badger, times out opening a
+// Bolt database that is already open, and fails opening a Badger one.
+func TestCancellation(t *testing.T) {
+	require := require.New(t)
+
+	boltDb := newTestBoltDatabase("boltdb-cancellation", t)
+	defer boltDb.Erase()
+	defer boltDb.Close()
+	GenericCancellationTest(boltDb, t)
+
+	badgerDb := newTestBadgerDatabase("badgerdb-cancellation", t)
+	defer badgerDb.Erase()
+	defer badgerDb.Close()
+	GenericCancellationTest(badgerDb, t)
+
+	goCtx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := SetupContext(goCtx, NewBoltDatabase(boltDb.dir))
+	require.True(errors.Is(err, context.DeadlineExceeded))
+
+	err = SetupContext(context.Background(), NewBadgerDatabase(badgerDb.opts))
+	require.ErrorContains(err, "Problem opening database")
+}
+
+func GenericCancellationTest(db Database, t *testing.T) {
+	require := require.New(t)
+
+	ctx := db.GetContext([]byte("cancellation"))
+	require.NoError(UpdateContext(context.Background(), db, ctx, func(_ context.Context, tx Transaction, ctx Context) error {
+		for ii := 0; ii < 100; ii++ {
+			if err := tx.Set([]byte{byte(ii)}, []byte{byte(ii)}, ctx); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	// An update cancelled before it commits is rolled back.
+	goCtx, cancel := context.WithCancel(context.Background())
+	err := UpdateContext(goCtx, db, ctx, func(goCtx context.Context, tx Transaction, ctx Context) error {
+		if err := tx.Set([]byte("cancelled"), []byte("value"), ctx); err != nil {
+			return err
+		}
+		cancel()
+		require.Error(tx.Set([]byte("after"), []byte("value"), ctx))
+		return nil
+	})
+	require.True(errors.Is(err, context.Canceled))
+	require.NoError(db.View(ctx, func(tx Transaction, ctx Context) error {
+		_, found, err := getResult(tx.Get([]byte("cancelled"), ctx))
+		require.False(found)
+		return err
+	}))
+
+	// An update on a cancelled context doesn't start.
+	err = UpdateContext(goCtx, db, ctx, func(context.Context, Transaction, Context) error {
+		require.Fail("Update ran after cancellation")
+		return nil
+	})
+	require.True(errors.Is(err, context.Canceled))
+
+	// A scan stops once cancelled.
+	goCtx, cancel = context.WithCancel(context.Background())
+	visited := 0
+	err = ViewContext(goCtx, db, ctx, func(goCtx context.Context, tx Transaction, ctx Context) error {
+		it, err := tx.GetIterator(ctx)
+		if err != nil {
+			return err
+		}
+		defer it.Close()
+		for it.Next() {
+			if visited++; visited == 10 {
+				cancel()
+			}
+		}
+		return nil
+	})
+	require.True(errors.Is(err, context.Canceled))
+	require.Equal(10, visited)
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"hash/crc32"
+	"io"
+)
+
+const (
+	// valueChecksumSize is the size of the CRC-32C every checksummed value starts with.
+	valueChecksumSize = 4
+)
+
+var ErrValueChecksumMismatch = errors.New("ChecksummedDatabase: value does not match its checksum")
+
+// ==========================
+// ChecksummedDatabase
+// ==========================
+
+// ChecksummedDatabase stores a CRC-32C of every value in front of it, and checks it on
+// every read, so torn or corrupted values are reported instead of returned. Verify checks
+// every value of the database against its checksum.
+//
+// Every value must be written through the wrapper, since a value without the checksum
+// can't be told apart from a corrupted one. To cover what other wrappers store, the
+// ChecksummedDatabase goes directly on top of the backend. Backup, BackupSince and
+// Restore work on the stored, checksummed records.
+type ChecksummedDatabase struct {
+	db Database
+}
+
+func NewChecksummedDatabase(db Database) *ChecksummedDatabase {
+	return &ChecksummedDatabase{
+		db: db,
+	}
+}
+
+func (cdb *ChecksummedDatabase) Setup() error {
+	return cdb.db.Setup()
+}
+
+func (cdb *ChecksummedDatabase) GetContext(id []byte) Context {
+	return cdb.db.GetContext(id)
+}
+
+func (cdb *ChecksummedDatabase) Update(ctx Context, fn func(Transaction, Context) error) error {
+	return cdb.db.Update(ctx, func(tx Transaction, ctx Context) error {
+		return fn(NewChecksummedTransaction(tx), ctx)
+	})
+}
+
+func (cdb *ChecksummedDatabase) View(ctx Context, fn func(Transaction, Context) error) error {
+	return cdb.db.View(ctx, func(tx Transaction, ctx Context) error {
+		return fn(NewChecksummedTransaction(tx), ctx)
+	})
+}
+
+func (cdb *ChecksummedDatabase) NewWriteBatch() WriteBatch {
+	return NewChecksummedWriteBatch(cdb.db.NewWriteBatch())
+}
+
+func (cdb *ChecksummedDatabase) Backup(w io.Writer) error {
+	return cdb.db.Backup(w)
+}
+
+func (cdb *ChecksummedDatabase) BackupSince(w io.Writer, since uint64) (uint64, error) {
+	return cdb.db.BackupSince(w, since)
+}
+
+func (cdb *ChecksummedDatabase) Restore(r io.Reader) error {
+	return cdb.db.Restore(r)
+}
+
+func (cdb *ChecksummedDatabase) Close() error {
+	return cdb.db.Close()
+}
+
+func (cdb *ChecksummedDatabase) Erase() error {
+	return cdb.db.Erase()
+}
+
+func (cdb *ChecksummedDatabase) Id() DatabaseId {
+	return cdb.db.Id()
+}
+
+// checkIntegrity checks the backend, then every stored value against its checksum.
+func (cdb *ChecksummedDatabase) checkIntegrity(report *IntegrityReport) error {
+	if checker, ok := cdb.db.(integrityChecker); ok {
+		if err := checker.checkIntegrity(report); err != nil {
+			return err
+		}
+	}
+
+	report.Logical = true
+	contexts := make(map[string]bool)
+	err := forEachRecord(cdb.db, func(record *BackupRecord) error {
+		contexts[string(encodeContextPath(record.Path))] = true
+		report.Values++
+		if _, err := openChecksummedValue(record.Value); err != nil {
+			report.addIssue(record.Path, record.Key, err)
+		}
+		return nil
+	})
+	report.Contexts = len(contexts)
+	return errors.Wrapf(err, "Problem reading values")
+}
+
+func (cdb *ChecksummedDatabase) nestedContextIds(ctx Context) ([][]byte, error) {
+	return listNestedContextIds(cdb.db, ctx)
+}
+
+func sealChecksummedValue(value []byte) []byte {
+	stored := make([]byte, 0, valueChecksumSize+len(value))
+	stored = binary.BigEndian.AppendUint32(stored, crc32.Checksum(value, backupCrcTable))
+	return append(stored, value...)
+}
+
+// openChecksummedValue returns a copy of the value, since the stored value may only be
+// valid for the transaction.
+func openChecksummedValue(stored []byte) ([]byte, error) {
+	if len(stored) < valueChecksumSize {
+		return nil, errors.Wrapf(ErrValueChecksumMismatch, "Value of %v bytes is too short", len(stored))
+	}
+	value := stored[valueChecksumSize:]
+	if binary.BigEndian.Uint32(stored) != crc32.Checksum(value, backupCrcTable) {
+		return nil, ErrValueChecksumMismatch
+	}
+	return append([]byte{}, value...), nil
+}
+
+// ==========================
+// ChecksummedTransaction
+// ==========================
+
+type ChecksummedTransaction struct {
+	tx Transaction
+}
+
+func NewChecksummedTransaction(tx Transaction) *ChecksummedTransaction {
+	return &ChecksummedTransaction{
+		tx: tx,
+	}
+}
+
+func (stx *ChecksummedTransaction) Set(key []byte, value []byte, ctx Context) error {
+	return stx.tx.Set(key, sealChecksummedValue(value), ctx)
+}
+
+func (stx *ChecksummedTransaction) Delete(key []byte, ctx Context) error {
+	return stx.tx.Delete(key, ctx)
+}
+
+func (stx *ChecksummedTransaction) Get(key []byte, ctx Context) ([]byte, error) {
+	stored, err := stx.tx.Get(key, ctx)
+	if err != nil || stored == nil {
+		return stored, err
+	}
+	value, err := openChecksummedValue(stored)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Get: Key %x", key)
+	}
+	return value, nil
+}
+
+func (stx *ChecksummedTransaction) MultiGet(keys [][]byte, ctx Context) ([][]byte, []bool, error) {
+	values, found, err := stx.tx.MultiGet(keys, ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	for ii := range values {
+		if !found[ii] {
+			continue
+		}
+		if values[ii], err = openChecksummedValue(values[ii]); err != nil {
+			return nil, nil, errors.Wrapf(err, "MultiGet: Key %x", keys[ii])
+		}
+	}
+	return values, found, nil
+}
+
+func (stx *ChecksummedTransaction) GetIterator(ctx Context) (Iterator, error) {
+	it, err := stx.tx.GetIterator(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return NewChecksummedIterator(it), nil
+}
+
+// ==========================
+// ChecksummedWriteBatch
+// ==========================
+
+type ChecksummedWriteBatch struct {
+	wb WriteBatch
+}
+
+func NewChecksummedWriteBatch(wb WriteBatch) *ChecksummedWriteBatch {
+	return &ChecksummedWriteBatch{
+		wb: wb,
+	}
+}
+
+func (cwb *ChecksummedWriteBatch) Set(key []byte, value []byte, ctx Context) error {
+	return cwb.wb.Set(key, sealChecksummedValue(value), ctx)
+}
+
+func (cwb *ChecksummedWriteBatch) Delete(key []byte, ctx Context) error {
+	return cwb.wb.Delete(key, ctx)
+}
+
+func (cwb *ChecksummedWriteBatch) Flush() error {
+	return cwb.wb.Flush()
+}
+
+func (cwb *ChecksummedWriteBatch) Cancel() {
+	cwb.wb.Cancel()
+}
+
+// ==========================
+// ChecksummedIterator
+// ==========================
+
+type ChecksummedIterator struct {
+	it Iterator
+}
+
+func NewChecksummedIterator(it Iterator) *ChecksummedIterator {
+	return &ChecksummedIterator{
+		it: it,
+	}
+}
+
+func (cit *ChecksummedIterator) GetContext() Context {
+	return cit.it.GetContext()
+}
+
+func (cit *ChecksummedIterator) Value() ([]byte, error) {
+	stored, err := cit.it.Value()
+	if err != nil || stored == nil {
+		return stored, err
+	}
+	value, err := openChecksummedValue(stored)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Value: Key %x", cit.it.Key())
+	}
+	return value, nil
+}
+
+func (cit *ChecksummedIterator) Key() []byte {
+	return cit.it.Key()
+}
+
+func (cit *ChecksummedIterator) localKey() []byte {
+	return iteratorLocalKey(cit.it)
+}
+
+func (cit *ChecksummedIterator) Next() bool {
+	return cit.it.Next()
+}
+
+func (cit *ChecksummedIterator) Seek(key []byte) bool {
+	return cit.it.Seek(key)
+}
+
+func (cit *ChecksummedIterator) Close() {
+	cit.it.Close()
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+type CompressionCodec byte
+
+// Codecs are stored in the first byte of every value, so they must never be renumbered.
+const (
+	CompressionNone   CompressionCodec = 0
+	CompressionSnappy CompressionCodec = 1
+	CompressionZstd   CompressionCodec = 2
+)
+
+const (
+	// DefaultCompressionMinSize is the size below which values are stored raw, since
+	// the codecs' framing outweighs the savings on small values.
+	DefaultCompressionMinSize = 64
+)
+
+var ErrCompressedValueCorrupted = errors.New("CompressedDatabase: value cannot be decompressed")
+
+type CompressionOptions struct {
+	// Codec compresses new values. Values written with any other codec remain readable.
+	Codec CompressionCodec
+	// MinSize is the size below which values are stored raw.
+	MinSize int
+	// ZstdLevel is the zstd encoder level, used when Codec is CompressionZstd.
+	ZstdLevel zstd.EncoderLevel
+}
+
+func DefaultCompressionOptions() CompressionOptions {
+	return CompressionOptions{
+		Codec:     CompressionSnappy,
+		MinSize:   DefaultCompressionMinSize,
+		ZstdLevel: zstd.SpeedDefault,
+	}
+}
+
+type CompressionStats struct {
+	// RawBytes is the size of the values written, before compression.
+	RawBytes uint64
+	// StoredBytes is the size the written values were stored with, headers included.
+	StoredBytes uint64
+}
+
+// ==========================
+// CompressedDatabase
+// ==========================
+
+// CompressedDatabase compresses the values of any Database. Every stored value starts
+// with the CompressionCodec of the rest of it, so codecs can be changed or mixed, and
+// values below MinSize, or which don't shrink, are stored raw under CompressionNone.
+// Every value must be written through the wrapper, since a value without the header
+// can't be told apart from one with it.
+//
+// Encrypted values don't compress, so when combined with an EncryptedDatabase, the
+// CompressedDatabase goes on top. Backup, BackupSince and Restore work on the stored,
+// compressed records.
+type CompressedDatabase struct {
+	db   Database
+	opts CompressionOptions
+
+	// encoder is only created when Codec is CompressionZstd, and decoder when the codec
+	// is, or once a zstd value is read. Both are safe for concurrent EncodeAll and
+	// DecodeAll calls.
+	encoder     *zstd.Encoder
+	decoderLock sync.Mutex
+	decoder     *zstd.Decoder
+
+	rawBytes    atomic.Uint64
+	storedBytes atomic.Uint64
+}
+
+func NewCompressedDatabase(db Database, opts CompressionOptions) (*CompressedDatabase, error) {
+	if opts.Codec > CompressionZstd {
+		return nil, errors.Errorf("NewCompressedDatabase: Unknown codec %v", opts.Codec)
+	}
+	cdb := &CompressedDatabase{
+		db:   db,
+		opts: opts,
+	}
+	if opts.Codec == CompressionZstd {
+		var err error
+		if cdb.encoder, err = zstd.NewWriter(nil, zstd.WithEncoderLevel(opts.ZstdLevel)); err != nil {
+			return nil, errors.Wrapf(err, "NewCompressedDatabase: Problem creating zstd encoder")
+		}
+		if _, err := cdb.zstdDecoder(); err != nil {
+			cdb.encoder.Close()
+			return nil, errors.Wrapf(err, "NewCompressedDatabase: Problem creating zstd decoder")
+		}
+	}
+	return cdb, nil
+}
+
+func (cdb *CompressedDatabase) Setup() error {
+	return cdb.db.Setup()
+}
+
+func (cdb *CompressedDatabase) GetContext(id []byte) Context {
+	return cdb.db.GetContext(id)
+}
+
+func (cdb *CompressedDatabase) Update(ctx Context, fn func(Transaction, Context) error) error {
+	return cdb.db.Update(ctx, func(tx Transaction, ctx Context) error {
+		return fn(NewCompressedTransaction(cdb, tx), ctx)
+	})
+}
+
+func (cdb *CompressedDatabase) View(ctx Context, fn func(Transaction, Context) error) error {
+	return cdb.db.View(ctx, func(tx Transaction, ctx Context) error {
+		return fn(NewCompressedTransaction(cdb, tx), ctx)
+	})
+}
+
+func (cdb *CompressedDatabase) NewWriteBatch() WriteBatch {
+	return NewCompressedWriteBatch(cdb, cdb.db.NewWriteBatch())
+}
+
+func (cdb *CompressedDatabase) Backup(w io.Writer) error {
+	return cdb.db.Backup(w)
+}
+
+func (cdb *CompressedDatabase) BackupSince(w io.Writer, since uint64) (uint64, error) {
+	return cdb.db.BackupSince(w, since)
+}
+
+func (cdb *CompressedDatabase) Restore(r io.Reader) error {
+	return cdb.db.Restore(r)
+}
+
+func (cdb *CompressedDatabase) Close() error {
+	if cdb.encoder != nil {
+		cdb.encoder.Close()
+	}
+	cdb.decoderLock.Lock()
+	if cdb.decoder != nil {
+		cdb.decoder.Close()
+	}
+	cdb.decoderLock.Unlock()
+	return cdb.db.Close()
+}
+
+func (cdb *CompressedDatabase) Erase() error {
+	return cdb.db.Erase()
+}
+
+func (cdb *CompressedDatabase) Id() DatabaseId {
+	return cdb.db.Id()
+}
+
+func (cdb *CompressedDatabase) checkIntegrity(report *IntegrityReport) error {
+	return checkWrappedIntegrity(cdb.db, report)
+}
+
+func (cdb *CompressedDatabase) nestedContextIds(ctx Context) ([][]byte, error) {
+	return listNestedContextIds(cdb.db, ctx)
+}
+
+func (cdb *CompressedDatabase) Stats() CompressionStats {
+	return CompressionStats{
+		RawBytes:    cdb.rawBytes.Load(),
+		StoredBytes: cdb.storedBytes.Load(),
+	}
+}
+
+func (cdb *CompressedDatabase) compress(value []byte) []byte {
+	codec := cdb.opts.Codec
+	if len(value) < cdb.opts.MinSize {
+		codec = CompressionNone
+	}
+
+	var stored []byte
+	switch codec {
+	case CompressionSnappy:
+		// S2 writes snappy-compatible blocks, which any snappy decoder can read.
+		stored = make([]byte, 1+s2.MaxEncodedLen(len(value)))
+		stored = stored[:1+len(s2.EncodeSnappy(stored[1:], value))]
+	case CompressionZstd:
+		stored = cdb.encoder.EncodeAll(value, []byte{0})
+	}
+	// Keep values that didn't shrink raw, so reading them costs nothing.
+	if codec == CompressionNone || len(stored) > len(value) {
+		codec = CompressionNone
+		stored = append(make([]byte, 0, 1+len(value)), 0)
+		stored = append(stored, value...)
+	}
+	stored[0] = byte(codec)
+
+	cdb.rawBytes.Add(uint64(len(value)))
+	cdb.storedBytes.Add(uint64(len(stored)))
+	return stored
+}
+
+func (cdb *CompressedDatabase) decompress(stored []byte) ([]byte, error) {
+	if len(stored) == 0 {
+		return nil, ErrCompressedValueCorrupted
+	}
+
+	var value []byte
+	var err error
+	switch CompressionCodec(stored[0]) {
+	case CompressionNone:
+		// Copy, since the stored value may only be valid for the transaction.
+		value = append([]byte{}, stored[1:]...)
+	case CompressionSnappy:
+		value, err = s2.Decode(nil, stored[1:])
+	case CompressionZstd:
+		var decoder *zstd.Decoder
+		if decoder, err = cdb.zstdDecoder(); err == nil {
+			value, err = decoder.DecodeAll(stored[1:], nil)
+		}
+	default:
+		return nil, errors.Wrapf(ErrCompressedValueCorrupted, "Unknown codec %v", stored[0])
+	}
+	if err != nil {
+		return nil, errors.Wrapf(ErrCompressedValueCorrupted, "%v", err)
+	}
+	return value, nil
+}
+
+// zstdDecoder returns the zstd decoder, creating it if needed.
+func (cdb *CompressedDatabase) zstdDecoder() (*zstd.Decoder, error) {
+	cdb.decoderLock.Lock()
+	defer cdb.decoderLock.Unlock()
+
+	if cdb.decoder == nil {
+		decoder, err := zstd.NewReader(nil)
+		if err != nil {
+			return nil, err
+		}
+		cdb.decoder = decoder
+	}
+	return cdb.decoder, nil
+}
+
+// ==========================
+// CompressedTransaction
+// ==========================
+
+type CompressedTransaction struct {
+	db *CompressedDatabase
+	tx Transaction
+}
+
+func NewCompressedTransaction(db *CompressedDatabase, tx Transaction) *CompressedTransaction {
+	return &CompressedTransaction{
+		db: db,
+		tx: tx,
+	}
+}
+
+func (ztx *CompressedTransaction) Set(key []byte, value []byte, ctx Context) error {
+	return ztx.tx.Set(key, ztx.db.compress(value), ctx)
+}
+
+func (ztx *CompressedTransaction) Delete(key []byte, ctx Context) error {
+	return ztx.tx.Delete(key, ctx)
+}
+
+func (ztx *CompressedTransaction) Get(key []byte, ctx Context) ([]byte, error) {
+	stored, err := ztx.tx.Get(key, ctx)
+	if err != nil || stored == nil {
+		return stored, err
+	}
+	value, err := ztx.db.decompress(stored)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Get: Problem decompressing key %x", key)
+	}
+	return value, nil
+}
+
+func (ztx *CompressedTransaction) MultiGet(keys [][]byte, ctx Context) ([][]byte, []bool, error) {
+	values, found, err := ztx.tx.MultiGet(keys, ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	for ii := range values {
+		if !found[ii] {
+			continue
+		}
+		if values[ii], err = ztx.db.decompress(values[ii]); err != nil {
+			return nil, nil, errors.Wrapf(err, "MultiGet: Problem decompressing key %x", keys[ii])
+		}
+	}
+	return values, found, nil
+}
+
+func (ztx *CompressedTransaction) GetIterator(ctx Context) (Iterator, error) {
+	it, err := ztx.tx.GetIterator(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return NewCompressedIterator(ztx.db, it), nil
+}
+
+// ==========================
+// CompressedWriteBatch
+// ==========================
+
+type CompressedWriteBatch struct {
+	db *CompressedDatabase
+	wb WriteBatch
+}
+
+func NewCompressedWriteBatch(db *CompressedDatabase, wb WriteBatch) *CompressedWriteBatch {
+	return &CompressedWriteBatch{
+		db: db,
+		wb: wb,
+	}
+}
+
+func (cwb *CompressedWriteBatch) Set(key []byte, value []byte, ctx Context) error {
+	return cwb.wb.Set(key, cwb.db.compress(value), ctx)
+}
+
+func (cwb *CompressedWriteBatch) Delete(key []byte, ctx Context) error {
+	return cwb.wb.Delete(key, ctx)
+}
+
+func (cwb *CompressedWriteBatch) Flush() error {
+	return cwb.wb.Flush()
+}
+
+func (cwb *CompressedWriteBatch) Cancel() {
+	cwb.wb.Cancel()
+}
+
+// ==========================
+// CompressedIterator
+// ==========================
+
+type CompressedIterator struct {
+	db *CompressedDatabase
+	it Iterator
+}
+
+func NewCompressedIterator(db *CompressedDatabase, it Iterator) *CompressedIterator {
+	return &CompressedIterator{
+		db: db,
+		it: it,
+	}
+}
+
+func (cit *CompressedIterator) GetContext() Context {
+	return cit.it.GetContext()
+}
+
+func (cit *CompressedIterator) Value() ([]byte, error) {
+	stored, err := cit.it.Value()
+	if err != nil || stored == nil {
+		return stored, err
+	}
+	value, err := cit.db.decompress(stored)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Value: Problem decompressing key %x", cit.it.Key())
+	}
+	return value, nil
+}
+
+func (cit *CompressedIterator) Key() []byte {
+	return cit.it.Key()
+}
+
+func (cit *CompressedIterator) localKey() []byte {
+	return iteratorLocalKey(cit.it)
+}
+
+func (cit *CompressedIterator) Next() bool {
+	return cit.it.Next()
+}
+
+func (cit *CompressedIterator) Seek(key []byte) bool {
+	return cit.it.Seek(key)
+}
+
+func (cit *CompressedIterator) Close() {
+	cit.it.Close()
+}
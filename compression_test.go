@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+// TestCompressedDatabase writes values with snappy, then with zstd on the same database, and
+// reads both back along with values stored raw.
+func TestCompressedDatabase(t *testing.T) {
+	require := require.New(t)
+
+	raw := newTestBoltDatabase("boltdb-compressed", t)
+	defer raw.Erase()
+	defer raw.Close()
+	ctx := raw.GetContext([]byte("blocks"))
+
+	compressible := bytes.Repeat([]byte("transaction "), 100)
+	incompressible, err := RandomBytes(1000)
+	require.NoError(err)
+	values := map[string][]byte{
+		"snappy":         compressible,
+		"zstd":           append([]byte("zstd "), compressible...),
+		"small":          []byte("small"),
+		"incompressible": incompressible,
+	}
+	codecs := map[string]CompressionCodec{
+		"snappy":         CompressionSnappy,
+		"zstd":           CompressionZstd,
+		"small":          CompressionNone,
+		"incompressible": CompressionNone,
+	}
+
+	snappyOpts := DefaultCompressionOptions()
+	snappyDb, err := NewCompressedDatabase(raw, snappyOpts)
+	require.NoError(err)
+	zstdOpts := DefaultCompressionOptions()
+	zstdOpts.Codec = CompressionZstd
+	zstdDb, err := NewCompressedDatabase(raw, zstdOpts)
+	require.NoError(err)
+	// The zstd encoder and decoder are only created for the zstd codec.
+	require.Nil(snappyDb.encoder)
+	require.Nil(snappyDb.decoder)
+	require.NotNil(zstdDb.encoder)
+
+	for key, value := range values {
+		db := snappyDb
+		if key == "zstd" {
+			db = zstdDb
+		}
+		require.NoError(db.Update(ctx, func(tx Transaction, ctx Context) error {
+			return tx.Set([]byte(key), value, ctx)
+		}))
+	}
+	require.Less(snappyDb.Stats().StoredBytes*2, snappyDb.Stats().RawBytes)
+
+	require.NoError(raw.View(ctx, func(tx Transaction, ctx Context) error {
+		for key, codec := range codecs {
+			stored, err := tx.Get([]byte(key), ctx)
+			require.NoError(err)
+			require.Equal(byte(codec), stored[0], key)
+		}
+		return nil
+	}))
+	// Either wrapper reads every codec.
+	for _, db := range []*CompressedDatabase{snappyDb, zstdDb} {
+		require.NoError(db.View(ctx, func(tx Transaction, ctx Context) error {
+			for key, value := range values {
+				got, err := tx.Get([]byte(key), ctx)
+				require.NoError(err)
+				require.Equal(value, got, key)
+			}
+			return nil
+		}))
+	}
+	// The snappy wrapper created a decoder to read the zstd value.
+	require.NotNil(snappyDb.decoder)
+	GenericMultiGetTest(zstdDb, zstdDb.GetContext([]byte("multiget")), t)
+}
@@ -0,0 +1,64 @@
+package main
+
+// ConcurrencyPolicy is how a DatabaseContext runs Updates and Views concurrently.
+type ConcurrencyPolicy byte
+
+const (
+	// ConcurrencySerialized runs one Update at a time, and no View during an Update. It
+	// is the default.
+	ConcurrencySerialized ConcurrencyPolicy = iota
+	// ConcurrencySingleWriter runs one Update at a time, concurrently with Views. Bolt
+	// has a single writer and readers that see the last commit, so it loses nothing.
+	ConcurrencySingleWriter
+	// ConcurrencyPassThrough doesn't serialize Updates, and leaves concurrency to the
+	// backend. Badger's optimistic transactions fail with badger.ErrConflict when they
+	// read a key written by a transaction that committed in the meantime, and those
+	// Updates are retried as configured by DatabaseContextOptions.ConflictRetry, so their
+	// function may run more than once. Conflicts a database created with
+	// NewBadgerDatabaseWithConflictRetry gave up on are not retried again.
+	ConcurrencyPassThrough
+	// ConcurrencyAuto picks the policy of the backend, with BackendConcurrencyPolicy.
+	ConcurrencyAuto
+)
+
+func (policy ConcurrencyPolicy) String() string {
+	switch policy {
+	case ConcurrencySerialized:
+		return "serialized"
+	case ConcurrencySingleWriter:
+		return "single-writer"
+	case ConcurrencyPassThrough:
+		return "pass-through"
+	case ConcurrencyAuto:
+		return "auto"
+	}
+	return "unknown"
+}
+
+// BackendConcurrencyPolicy is the most concurrent policy of a backend, which ConcurrencyAuto
+// picks: pass-through for Badger, and a single writer for Bolt.
+func BackendConcurrencyPolicy(id DatabaseId) ConcurrencyPolicy {
+	if id == BADGERDB {
+		return ConcurrencyPassThrough
+	}
+	return ConcurrencySingleWriter
+}
+
+type DatabaseContextOptions struct {
+	// Concurrency is ConcurrencySerialized unless set. Set it to ConcurrencyAuto, or to a
+	// policy, to run transactions concurrently.
+	Concurrency ConcurrencyPolicy
+	// ConflictRetry configures the retries of conflicting Updates under
+	// ConcurrencyPassThrough.
+	ConflictRetry ConflictRetryOptions
+	// MemoryBudget throttles Updates while the memory of the process is over budget, if
+	// set. Views and write batches are not throttled.
+	MemoryBudget *MemoryBudgetOptions
+}
+
+func DefaultDatabaseContextOptions() DatabaseContextOptions {
+	return DatabaseContextOptions{
+		Concurrency:   ConcurrencySerialized,
+		ConflictRetry: DefaultConflictRetryOptions(),
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestDatabaseContextConcurrency checks that views run during an Update unless Updates
+// are serialized, and that concurrent Badger Updates are retried on conflict.
+func TestDatabaseContextConcurrency(t *testing.T) {
+	require := require.New(t)
+
+	boltDb := newTestBoltDatabase("boltdb-concurrency", t)
+	defer boltDb.Erase()
+	defer boltDb.Close()
+	badgerDb := newTestBadgerDatabase("badgerdb-concurrency", t)
+	defer badgerDb.Erase()
+	defer badgerDb.Close()
+
+	ctx := boltDb.GetContext([]byte("blocks"))
+	require.Equal(ConcurrencySerialized, NewDatabaseContext(boltDb, ctx).ConcurrencyPolicy())
+	autoOpts := DefaultDatabaseContextOptions()
+	autoOpts.Concurrency = ConcurrencyAuto
+	require.Equal(ConcurrencySingleWriter, NewDatabaseContextWithOptions(boltDb, ctx, autoOpts).ConcurrencyPolicy())
+	for _, policy := range []ConcurrencyPolicy{ConcurrencySerialized, ConcurrencySingleWriter} {
+		opts := DefaultDatabaseContextOptions()
+		opts.Concurrency = policy
+		db := NewDatabaseContextWithOptions(boltDb, ctx, opts)
+		updating := make(chan struct{})
+		release := make(chan struct{})
+		updated := make(chan error, 1)
+		go func() {
+			updated <- db.Update(ctx, func(tx Transaction, ctx Context) error {
+				close(updating)
+				<-release
+				return tx.Set([]byte("a"), []byte("1"), ctx)
+			})
+		}()
+		<-updating
+
+		viewed := make(chan error, 1)
+		go func() {
+			viewed <- db.View(ctx, func(tx Transaction, ctx Context) error {
+				_, err := tx.Get([]byte("a"), ctx)
+				return err
+			})
+		}()
+		select {
+		case err := <-viewed:
+			require.NoError(err)
+			require.Equal(ConcurrencySingleWriter, policy)
+			close(release)
+		case <-time.After(100 * time.Millisecond):
+			require.Equal(ConcurrencySerialized, policy)
+			close(release)
+			require.NoError(<-viewed)
+		}
+		require.NoError(<-updated)
+	}
+
+	// Every Update increments the same counter, so concurrent ones conflict.
+	ctx = badgerDb.GetContext([]byte("counters"))
+	require.Equal(ConcurrencySerialized, NewDatabaseContext(badgerDb, ctx).ConcurrencyPolicy())
+	db := NewDatabaseContextWithOptions(badgerDb, ctx, autoOpts)
+	require.Equal(ConcurrencyPassThrough, db.ConcurrencyPolicy())
+	var attempts atomic.Int64
+	var wg sync.WaitGroup
+	// Workers stop at their first error, which is checked once they are all done.
+	errs := make(chan error, 4)
+	for ii := 0; ii < 4; ii++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for jj := 0; jj < 25; jj++ {
+				err := db.Update(ctx, func(tx Transaction, ctx Context) error {
+					attempts.Add(1)
+					value, _, err := getResult(tx.Get([]byte("counter"), ctx))
+					if err != nil {
+						return err
+					}
+					counter, _ := strconv.Atoi(string(value))
+					return tx.Set([]byte("counter"), []byte(strconv.Itoa(counter+1)), ctx)
+				})
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(err)
+	}
+	require.NoError(db.View(ctx, func(tx Transaction, ctx Context) error {
+		value, err := tx.Get([]byte("counter"), ctx)
+		require.Equal("100", string(value))
+		return err
+	}))
+	require.GreaterOrEqual(attempts.Load(), int64(100))
+}
+
+// BenchmarkDatabaseContextConcurrency runs a mix of 90% views and 10% updates on every
+// backend, with Updates serialized and with the policy ConcurrencyAuto picks for the backend. Every
+// goroutine writes its own key, so Updates don't conflict.
+func BenchmarkDatabaseContextConcurrency(b *testing.B) {
+	backends := []struct {
+		name string
+		open func(dir string) Database
+	}{
+		{"bolt", func(dir string) Database { return NewBoltDatabase(dir) }},
+		{"badger", func(dir string) Database { return NewBadgerDatabase(DefaultBadgerOptions(dir)) }},
+	}
+	for _, backend := range backends {
+		for _, policy := range []ConcurrencyPolicy{ConcurrencySerialized, ConcurrencyAuto} {
+			b.Run(fmt.Sprintf("%v/%v", backend.name, policy), func(b *testing.B) {
+				dir, err := os.MkdirTemp("", "db-concurrency-bench")
+				require.NoError(b, err)
+				raw := backend.open(dir)
+				require.NoError(b, raw.Setup())
+				defer raw.Erase()
+				defer raw.Close()
+
+				ctx := raw.GetContext([]byte("bench"))
+				opts := DefaultDatabaseContextOptions()
+				opts.Concurrency = policy
+				db := NewDatabaseContextWithOptions(raw, ctx, opts)
+				value := make([]byte, 256)
+				require.NoError(b, db.Update(ctx, func(tx Transaction, ctx Context) error {
+					return tx.Set([]byte("shared"), value, ctx)
+				}))
+
+				var goroutines atomic.Int64
+				b.SetParallelism(4)
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					key := []byte(fmt.Sprintf("writer-%d", goroutines.Add(1)))
+					var err error
+					for ii := 0; pb.Next(); ii++ {
+						if ii%10 == 0 {
+							err = db.Update(ctx, func(tx Transaction, ctx Context) error {
+								return tx.Set(key, value, ctx)
+							})
+						} else {
+							err = db.View(ctx, func(tx Transaction, ctx Context) error {
+								_, err := tx.Get([]byte("shared"), ctx)
+								return err
+							})
+						}
+						if err != nil {
+							b.Error(err)
+							return
+						}
+					}
+				})
+			})
+		}
+	}
+}
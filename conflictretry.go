@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/dgraph-io/badger/v4"
+	"github.com/pkg/errors"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultConflictMaxAttempts is the number of times an Update runs before its
+	// conflict is returned.
+	DefaultConflictMaxAttempts = 10
+
+	// DefaultConflictInitialBackoff is the backoff before the first retry.
+	DefaultConflictInitialBackoff = time.Millisecond
+
+	// DefaultConflictMaxBackoff caps the backoff between two attempts.
+	DefaultConflictMaxBackoff = 100 * time.Millisecond
+)
+
+type ConflictRetryOptions struct {
+	// MaxAttempts is the number of times an Update runs before badger.ErrConflict is
+	// returned to the caller. One disables retries.
+	MaxAttempts int
+	// InitialBackoff is the backoff before the first retry. It doubles with every retry,
+	// up to MaxBackoff, and the actual wait is drawn at random between half the backoff
+	// and the backoff, so that conflicting writers don't retry in lockstep.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+func DefaultConflictRetryOptions() ConflictRetryOptions {
+	return ConflictRetryOptions{
+		MaxAttempts:    DefaultConflictMaxAttempts,
+		InitialBackoff: DefaultConflictInitialBackoff,
+		MaxBackoff:     DefaultConflictMaxBackoff,
+	}
+}
+
+type ConflictStats struct {
+	// Path is the context the Updates ran in, nil for contexts past MaxMetricContexts.
+	Path [][]byte
+	// Updates is the number of Updates run.
+	Updates uint64
+	// Attempts is the number of times the functions of those Updates ran.
+	Attempts uint64
+	// Conflicts is the number of attempts that failed with badger.ErrConflict.
+	Conflicts uint64
+	// Exhausted is the number of Updates that still conflicted after MaxAttempts.
+	Exhausted uint64
+}
+
+// ConflictRate is the fraction of attempts that conflicted.
+func (stats ConflictStats) ConflictRate() float64 {
+	if stats.Attempts == 0 {
+		return 0
+	}
+	return float64(stats.Conflicts) / float64(stats.Attempts)
+}
+
+// ==========================
+// conflictRetrier
+// ==========================
+
+// conflictRetrier reruns Updates that fail with badger.ErrConflict, and keeps their
+// statistics by context path.
+type conflictRetrier struct {
+	opts ConflictRetryOptions
+
+	lock     sync.Mutex
+	contexts map[string]*ConflictStats
+}
+
+func newConflictRetrier(opts ConflictRetryOptions) *conflictRetrier {
+	if opts.MaxAttempts < 1 {
+		opts.MaxAttempts = 1
+	}
+	return &conflictRetrier{
+		opts:     opts,
+		contexts: make(map[string]*ConflictStats),
+	}
+}
+
+// conflictExhaustedError marks a conflict whose Update was already retried, so that a
+// retrier running Updates against a database that retries them itself, like a
+// DatabaseContext over NewBadgerDatabaseWithConflictRetry, doesn't retry it again.
+type conflictExhaustedError struct {
+	error
+}
+
+func (err *conflictExhaustedError) Unwrap() error {
+	return err.error
+}
+
+// run calls attempt until it doesn't fail with badger.ErrConflict, at most
+// opts.MaxAttempts times. It returns goCtx.Err() if goCtx is done during a backoff.
+// Conflicts another retrier gave up on are returned as is, and counted by that retrier.
+func (cr *conflictRetrier) run(goCtx context.Context, path [][]byte, attempt func() error) error {
+	var attempts, conflicts uint64
+	var exhausted bool
+	defer func() {
+		cr.record(path, attempts, conflicts, exhausted)
+	}()
+
+	backoff := cr.opts.InitialBackoff
+	for {
+		attempts++
+		err := attempt()
+		var exhaustedErr *conflictExhaustedError
+		if !errors.Is(err, badger.ErrConflict) || errors.As(err, &exhaustedErr) {
+			return err
+		}
+		conflicts++
+		if int(attempts) >= cr.opts.MaxAttempts {
+			exhausted = true
+			return &conflictExhaustedError{errors.Wrapf(err, "Update: Conflicted %v times in context %q", attempts, path)}
+		}
+
+		if backoff > 0 {
+			timer := time.NewTimer(backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1)))
+			select {
+			case <-goCtx.Done():
+				timer.Stop()
+				return goCtx.Err()
+			case <-timer.C:
+			}
+		}
+		backoff *= 2
+		if backoff > cr.opts.MaxBackoff {
+			backoff = cr.opts.MaxBackoff
+		}
+	}
+}
+
+func (cr *conflictRetrier) record(path [][]byte, attempts uint64, conflicts uint64, exhausted bool) {
+	key := string(encodeContextPath(path))
+
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+
+	stats, exists := cr.contexts[key]
+	if !exists && len(cr.contexts) >= MaxMetricContexts {
+		key, path = "", nil
+		stats, exists = cr.contexts[key]
+	}
+	if !exists {
+		stats = &ConflictStats{Path: path}
+		cr.contexts[key] = stats
+	}
+	stats.Updates++
+	stats.Attempts += attempts
+	stats.Conflicts += conflicts
+	if exhausted {
+		stats.Exhausted++
+	}
+}
+
+// snapshot returns the statistics of every context, ordered by path.
+func (cr *conflictRetrier) snapshot() []ConflictStats {
+	cr.lock.Lock()
+	snapshot := make([]ConflictStats, 0, len(cr.contexts))
+	for _, stats := range cr.contexts {
+		snapshot = append(snapshot, *stats)
+	}
+	cr.lock.Unlock()
+
+	sort.Slice(snapshot, func(ii, jj int) bool {
+		return bytes.Compare(encodeContextPath(snapshot[ii].Path), encodeContextPath(snapshot[jj].Path)) < 0
+	})
+	return snapshot
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"github.com/dgraph-io/badger/v4"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// TestConflictRetry checks that conflicting Badger Updates are rerun until they commit,
+// that an Update conflicting on every attempt gives up after MaxAttempts, and that both
+// are counted for their context.
+func TestConflictRetry(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := os.MkdirTemp("", "badgerdb-conflicts")
+	require.NoError(err)
+	retryOpts := DefaultConflictRetryOptions()
+	retryOpts.MaxAttempts = 100
+	db := NewBadgerDatabaseWithConflictRetry(DefaultBadgerOptions(dir), retryOpts)
+	require.NoError(db.Setup())
+	defer db.Erase()
+	defer db.Close()
+
+	counters := db.GetContext([]byte("counters"))
+	increment := func(tx Transaction, ctx Context) error {
+		value, _, err := getResult(tx.Get([]byte("counter"), ctx))
+		if err != nil {
+			return err
+		}
+		counter, _ := strconv.Atoi(string(value))
+		return tx.Set([]byte("counter"), []byte(strconv.Itoa(counter+1)), ctx)
+	}
+	var wg sync.WaitGroup
+	// Workers stop at their first error, which is checked once they are all done.
+	errs := make(chan error, 8)
+	for ii := 0; ii < 8; ii++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for jj := 0; jj < 20; jj++ {
+				if err := db.Update(counters, increment); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(err)
+	}
+	require.NoError(db.View(counters, func(tx Transaction, ctx Context) error {
+		value, err := tx.Get([]byte("counter"), ctx)
+		require.Equal("160", string(value))
+		return err
+	}))
+
+	// Every attempt reads the key, which a batch overwrites before the attempt commits.
+	db.retry.opts.MaxAttempts = 3
+	locks := counters.NestContext([]byte("locks"))
+	var attempts int
+	err = db.Update(locks, func(tx Transaction, ctx Context) error {
+		attempts++
+		if _, _, err := getResult(tx.Get([]byte("lock"), ctx)); err != nil {
+			return err
+		}
+		wb := db.NewWriteBatch()
+		require.NoError(wb.Set([]byte("lock"), []byte(strconv.Itoa(attempts)), ctx))
+		require.NoError(wb.Flush())
+		return tx.Set([]byte("lock"), []byte("held"), ctx)
+	})
+	require.True(errors.Is(err, badger.ErrConflict))
+	require.Equal(3, attempts)
+
+	stats := db.ConflictStats()
+	require.Len(stats, 2)
+	require.Equal(counters.Path(), stats[0].Path)
+	require.Equal(uint64(160), stats[0].Updates)
+	require.Equal(stats[0].Updates+stats[0].Conflicts, stats[0].Attempts)
+	require.Zero(stats[0].Exhausted)
+	require.Equal(ConflictStats{Path: locks.Path(), Updates: 1, Attempts: 3, Conflicts: 3, Exhausted: 1}, stats[1])
+	require.InDelta(1.0, stats[1].ConflictRate(), 1e-9)
+
+	handler := NewMetricsHandler(nil)
+	handler.AddDatabase("main", db)
+	require.Contains(string(handler.Render()), `badger_update_conflicts_exhausted_total{database="main",backend="badger",path="counters/locks"} 1`)
+
+	// A DatabaseContext doesn't retry what the database already retried.
+	cdbOpts := DefaultDatabaseContextOptions()
+	cdbOpts.Concurrency = ConcurrencyAuto
+	cdb := NewDatabaseContextWithOptions(db, locks, cdbOpts)
+	attempts = 0
+	err = cdb.Update(locks, func(tx Transaction, ctx Context) error {
+		attempts++
+		if _, _, err := getResult(tx.Get([]byte("lock"), ctx)); err != nil {
+			return err
+		}
+		wb := db.NewWriteBatch()
+		require.NoError(wb.Set([]byte("lock"), []byte(strconv.Itoa(attempts)), ctx))
+		require.NoError(wb.Flush())
+		return tx.Set([]byte("lock"), []byte("held"), ctx)
+	})
+	require.True(errors.Is(err, badger.ErrConflict))
+	require.Equal(3, attempts)
+	require.Zero(cdb.ConflictStats()[0].Conflicts)
+	require.Equal(uint64(2), db.ConflictStats()[1].Exhausted)
+}
@@ -1,7 +1,13 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"github.com/dgraph-io/badger/v4"
+	"github.com/pkg/errors"
+	"io"
+	"sort"
 	"sync"
 )
 
@@ -17,29 +23,120 @@ type Database interface {
 	GetContext(id []byte) Context
 	Update(Context, func(Transaction, Context) error) error
 	View(Context, func(Transaction, Context) error) error
+	NewWriteBatch() WriteBatch
+	// Backup writes every context of the database to w in the portable backup format.
+	Backup(w io.Writer) error
+	// BackupSince writes the changes committed after version since to w, or a full
+	// backup if since is zero. It returns the version the backup ends at, to pass as
+	// since for the next incremental backup.
+	BackupSince(w io.Writer, since uint64) (uint64, error)
+	// Restore writes every record of a backup taken from any Database.
+	Restore(r io.Reader) error
 	Close() error
 	Erase() error
 	Id() DatabaseId
 }
 
+// ContextDatabase is implemented by databases whose transactions take a Go context, which
+// is handed to fn along with the transaction, so that work done in fn can be traced or
+// cancelled with the request it is part of.
+type ContextDatabase interface {
+	UpdateContext(goCtx context.Context, ctx Context, fn func(context.Context, Transaction, Context) error) error
+	ViewContext(goCtx context.Context, ctx Context, fn func(context.Context, Transaction, Context) error) error
+}
+
+// UpdateContext runs an update on db that stops with goCtx. The update isn't started if
+// goCtx is already done, operations fail and iterators stop once it is, and if it is done
+// by the time fn returns, the update is rolled back and goCtx.Err() is returned. Waiting
+// for Bolt's writer lock can't be interrupted, but the update is abandoned once it is
+// acquired.
+func UpdateContext(goCtx context.Context, db Database, ctx Context, fn func(context.Context, Transaction, Context) error) error {
+	if cdb, ok := db.(ContextDatabase); ok {
+		return cdb.UpdateContext(goCtx, ctx, fn)
+	}
+	return runContext(goCtx, db.Update, ctx, fn)
+}
+
+// ViewContext runs a view on db that stops with goCtx, like UpdateContext. A view whose
+// goCtx is done by the time fn returns returns goCtx.Err(), since an iterator it used may
+// have stopped early.
+func ViewContext(goCtx context.Context, db Database, ctx Context, fn func(context.Context, Transaction, Context) error) error {
+	if cdb, ok := db.(ContextDatabase); ok {
+		return cdb.ViewContext(goCtx, ctx, fn)
+	}
+	return runContext(goCtx, db.View, ctx, fn)
+}
+
 type Transaction interface {
 	Set(key []byte, value []byte, ctx Context) error
 	Delete(key []byte, ctx Context) error
 	Get(key []byte, ctx Context) ([]byte, error)
+	// MultiGet fetches a batch of keys in one pass. Values and found flags are
+	// returned in the same order as the requested keys.
+	MultiGet(keys [][]byte, ctx Context) (_values [][]byte, _found []bool, _err error)
 	GetIterator(Context) (Iterator, error)
 }
 
+// WriteBatch is a write-only batch of operations, committed in the background as the
+// batch grows and on Flush. A batch is not atomic: a failed or cancelled batch may
+// leave some of its writes committed. Keys and values passed to a batch must not be
+// modified until Flush returns.
+type WriteBatch interface {
+	Set(key []byte, value []byte, ctx Context) error
+	Delete(key []byte, ctx Context) error
+	Flush() error
+	Cancel()
+}
+
 type Iterator interface {
 	GetContext() Context
 	Value() ([]byte, error)
 	Key() []byte
 	Next() bool
+	// Seek moves to the first key of the context at or after key, and reports whether
+	// there is one. Unlike after GetIterator, the iterator is at that key right away,
+	// without calling Next.
+	Seek(key []byte) bool
 	Close()
 }
 
+// localKeyIterator is implemented by iterators that can report their current key
+// without the context prefix Badger iterators include. Wrappers delegate to the
+// iterator they wrap, so the prefix is stripped however deep the Badger iterator is.
+type localKeyIterator interface {
+	localKey() []byte
+}
+
+// iteratorLocalKey returns the current key of it without any backend context prefix,
+// so keys can be compared across backends.
+func iteratorLocalKey(it Iterator) []byte {
+	if lit, ok := it.(localKeyIterator); ok {
+		return lit.localKey()
+	}
+	return it.Key()
+}
+
 type Context interface {
 	Id() DatabaseId
 	NestContext(contextId []byte) Context
+	// Path is the list of ids the context was created from, starting with the id
+	// passed to GetContext, followed by the id of every nested context.
+	Path() [][]byte
+}
+
+// nestedContextLister is implemented by databases that can list the contexts nested in
+// a context, and by wrappers that pass the listing on to the database they wrap.
+type nestedContextLister interface {
+	nestedContextIds(ctx Context) ([][]byte, error)
+}
+
+// listNestedContextIds returns the ids of the contexts nested right under ctx in db.
+func listNestedContextIds(db Database, ctx Context) ([][]byte, error) {
+	lister, ok := db.(nestedContextLister)
+	if !ok {
+		return nil, errors.Errorf("Database %T can't list nested contexts", db)
+	}
+	return lister.nestedContextIds(ctx)
 }
 
 func AssertContext[C any](ctx Context, id DatabaseId) (C, error) {
@@ -56,15 +153,105 @@ func AssertContext[C any](ctx Context, id DatabaseId) (C, error) {
 	return c, nil
 }
 
+// DatabaseContext serializes Setup, Restore, Close and Erase with every transaction, and
+// runs transactions concurrently according to its ConcurrencyPolicy.
 type DatabaseContext struct {
 	sync.RWMutex
 
 	Db  Database
 	Ctx Context
+
+	policy ConcurrencyPolicy
+	// writer serializes Updates under ConcurrencySingleWriter.
+	writer sync.Mutex
+	// retry reruns conflicting Updates under ConcurrencyPassThrough.
+	retry *conflictRetrier
+	// governor throttles Updates while memory is over budget, if set.
+	governor *MemoryGovernor
 }
 
+// NewDatabaseContext returns a DatabaseContext that serializes Updates and Views. Use
+// NewDatabaseContextWithOptions to run them concurrently.
 func NewDatabaseContext(db Database, ctx Context) *DatabaseContext {
-	return &DatabaseContext{Db: db, Ctx: ctx}
+	return NewDatabaseContextWithOptions(db, ctx, DefaultDatabaseContextOptions())
+}
+
+// NewDatabaseContextWithMemoryBudget returns a DatabaseContext whose Updates wait, or are
+// rejected, while the memory of the process is over budget. Views and write batches are
+// not throttled.
+func NewDatabaseContextWithMemoryBudget(db Database, ctx Context, budget MemoryBudgetOptions) *DatabaseContext {
+	opts := DefaultDatabaseContextOptions()
+	opts.MemoryBudget = &budget
+	return NewDatabaseContextWithOptions(db, ctx, opts)
+}
+
+func NewDatabaseContextWithOptions(db Database, ctx Context, opts DatabaseContextOptions) *DatabaseContext {
+	cdb := &DatabaseContext{Db: db, Ctx: ctx, policy: opts.Concurrency}
+	if cdb.policy == ConcurrencyAuto {
+		cdb.policy = BackendConcurrencyPolicy(db.Id())
+	}
+	if cdb.policy == ConcurrencyPassThrough {
+		cdb.retry = newConflictRetrier(opts.ConflictRetry)
+	}
+	if opts.MemoryBudget != nil {
+		cdb.governor = NewMemoryGovernor(*opts.MemoryBudget)
+	}
+	return cdb
+}
+
+// ConcurrencyPolicy returns the policy of the context, resolved for its backend.
+func (cdb *DatabaseContext) ConcurrencyPolicy() ConcurrencyPolicy {
+	return cdb.policy
+}
+
+// ConflictStats returns the conflict statistics of every context, or nil if Updates are
+// serialized.
+func (cdb *DatabaseContext) ConflictStats() []ConflictStats {
+	if cdb.retry == nil {
+		return nil
+	}
+	return cdb.retry.snapshot()
+}
+
+// MemoryGovernor returns the governor of the context, or nil if it has no memory budget.
+func (cdb *DatabaseContext) MemoryGovernor() *MemoryGovernor {
+	return cdb.governor
+}
+
+// admit waits for the governor before an Update takes the lock, so that a throttled
+// writer doesn't block views.
+func (cdb *DatabaseContext) admit(goCtx context.Context) error {
+	if cdb.governor == nil {
+		return nil
+	}
+	return cdb.governor.Admit(goCtx)
+}
+
+// lockUpdate takes the locks an Update holds under the policy, and returns the function
+// releasing them.
+func (cdb *DatabaseContext) lockUpdate() func() {
+	switch cdb.policy {
+	case ConcurrencySerialized:
+		cdb.Lock()
+		return cdb.Unlock
+	case ConcurrencySingleWriter:
+		cdb.RLock()
+		cdb.writer.Lock()
+		return func() {
+			cdb.writer.Unlock()
+			cdb.RUnlock()
+		}
+	}
+	cdb.RLock()
+	return cdb.RUnlock
+}
+
+// update runs an Update, retrying conflicts if Updates aren't serialized.
+func (cdb *DatabaseContext) update(goCtx context.Context, ctx Context, run func() error) error {
+	if cdb.retry == nil {
+		return run()
+	}
+	return cdb.retry.run(goCtx, ctx.Path(), run)
 }
 
 func (cdb *DatabaseContext) Setup() error {
@@ -78,11 +265,17 @@ func (cdb *DatabaseContext) GetContext(id []byte) Context {
 	return cdb.Db.GetContext(id)
 }
 
+// Update runs f under the concurrency policy. Under ConcurrencyPassThrough, f may run
+// more than once.
 func (cdb *DatabaseContext) Update(ctx Context, f func(Transaction, Context) error) error {
-	cdb.Lock()
-	defer cdb.Unlock()
+	if err := cdb.admit(context.Background()); err != nil {
+		return err
+	}
+	defer cdb.lockUpdate()()
 
-	return cdb.Db.Update(ctx, f)
+	return cdb.update(context.Background(), ctx, func() error {
+		return cdb.Db.Update(ctx, f)
+	})
 }
 
 func (cdb *DatabaseContext) View(ctx Context, f func(Transaction, Context) error) error {
@@ -92,6 +285,55 @@ func (cdb *DatabaseContext) View(ctx Context, f func(Transaction, Context) error
 	return cdb.Db.View(ctx, f)
 }
 
+func (cdb *DatabaseContext) UpdateContext(goCtx context.Context, ctx Context,
+	f func(context.Context, Transaction, Context) error) error {
+
+	if err := cdb.admit(goCtx); err != nil {
+		return err
+	}
+	defer cdb.lockUpdate()()
+
+	return cdb.update(goCtx, ctx, func() error {
+		return UpdateContext(goCtx, cdb.Db, ctx, f)
+	})
+}
+
+func (cdb *DatabaseContext) ViewContext(goCtx context.Context, ctx Context,
+	f func(context.Context, Transaction, Context) error) error {
+
+	cdb.RLock()
+	defer cdb.RUnlock()
+
+	return ViewContext(goCtx, cdb.Db, ctx, f)
+}
+
+// NewWriteBatch hands out a batch of the underlying database. Batches commit outside
+// of Update, so they are not serialized with it.
+func (cdb *DatabaseContext) NewWriteBatch() WriteBatch {
+	return cdb.Db.NewWriteBatch()
+}
+
+func (cdb *DatabaseContext) Backup(w io.Writer) error {
+	cdb.RLock()
+	defer cdb.RUnlock()
+
+	return cdb.Db.Backup(w)
+}
+
+func (cdb *DatabaseContext) BackupSince(w io.Writer, since uint64) (uint64, error) {
+	cdb.RLock()
+	defer cdb.RUnlock()
+
+	return cdb.Db.BackupSince(w, since)
+}
+
+func (cdb *DatabaseContext) Restore(r io.Reader) error {
+	cdb.Lock()
+	defer cdb.Unlock()
+
+	return cdb.Db.Restore(r)
+}
+
 func (cdb *DatabaseContext) Close() error {
 	cdb.Lock()
 	defer cdb.Unlock()
@@ -114,6 +356,35 @@ func (cdb *DatabaseContext) NestContext(localId []byte) Context {
 	return cdb.Ctx.NestContext(localId)
 }
 
+func (cdb *DatabaseContext) Path() [][]byte {
+	return cdb.Ctx.Path()
+}
+
+// getResult maps the result of Transaction.Get to a found flag, since Badger reports
+// missing keys as an error while Bolt returns a nil value.
+func getResult(value []byte, err error) (_value []byte, _found bool, _err error) {
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return value, value != nil, nil
+}
+
+// sortedKeyOrder returns the indexes of keys in ascending key order, so that
+// batched lookups can walk the underlying storage front to back.
+func sortedKeyOrder(keys [][]byte) []int {
+	order := make([]int, len(keys))
+	for ii := range order {
+		order[ii] = ii
+	}
+	sort.SliceStable(order, func(ii, jj int) bool {
+		return bytes.Compare(keys[order[ii]], keys[order[jj]]) < 0
+	})
+	return order
+}
+
 type Key [32]byte
 
 func NewKey(key []byte) Key {
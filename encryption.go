@@ -0,0 +1,595 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"github.com/dgraph-io/badger/v4"
+	"github.com/pkg/errors"
+	"io"
+	"sort"
+	"sync"
+)
+
+const (
+	// EncryptionKeySize is the size of master keys and derived data keys, for AES-256.
+	EncryptionKeySize = 32
+
+	// BadgerEncryptionIndexCacheSize is 100 MB. Badger requires an index cache once
+	// tables are encrypted.
+	BadgerEncryptionIndexCacheSize = 100 << 20
+
+	// encryptedValueVersion is the version of the stored value format, whose header
+	// carries the version of the master key the value is encrypted under.
+	encryptedValueVersion byte = 0x01
+
+	// encryptedValueHasKey is set in the flags of a value that holds its plaintext key,
+	// which is the case when keys are stored hashed.
+	encryptedValueHasKey byte = 0x01
+
+	encryptedValueHeaderSize = 6
+)
+
+var (
+	ErrEncryptedValueCorrupted = errors.New("EncryptedDatabase: value cannot be decrypted")
+	ErrEncryptionKeyUnknown    = errors.New("EncryptedDatabase: no master key for the version of the value")
+
+	encryptionValueInfo  = []byte("BadgerBoltExperiment value key")
+	encryptionKeyInfo    = []byte("BadgerBoltExperiment key hash key")
+	encryptionBadgerInfo = []byte("BadgerBoltExperiment badger key")
+)
+
+type EncryptionOptions struct {
+	// MasterKey is the EncryptionKeySize bytes every data key is derived from. New
+	// values are always encrypted under it.
+	MasterKey []byte
+	// KeyVersion identifies MasterKey, and is stored with every value it encrypts.
+	KeyVersion uint32
+	// PreviousKeys are earlier master keys by version. They are only used to read
+	// values that have not been rotated to MasterKey yet, see StartKeyRotation.
+	PreviousKeys map[uint32][]byte
+	// HashKeys stores every key as its HMAC-SHA256 under a per-context key, so stored
+	// keys reveal neither their content nor their order. Values then carry their
+	// plaintext key, and iterators return keys in hash order. While PreviousKeys are
+	// set, a key may still be stored under the hash of a previous master key, so reads
+	// and deletes look it up under every version.
+	HashKeys bool
+}
+
+// ==========================
+// EncryptedDatabase
+// ==========================
+
+// EncryptedDatabase encrypts the values of any Database with AES-GCM. Every context
+// gets its own data keys, derived from the master key and the context path with HKDF,
+// and every value is authenticated together with its path and key, so a value copied
+// to another key or context fails to decrypt.
+//
+// Backup, BackupSince and Restore work on the stored records, so backups stay
+// encrypted and can only be read back through an EncryptedDatabase with the same
+// master key. For the same reason, Migrate should be given the underlying databases.
+type EncryptedDatabase struct {
+	db   Database
+	opts EncryptionOptions
+
+	// keyVersions lists the active key version followed by the previous ones, newest
+	// first, which is the order hashed keys are looked up in.
+	keyVersions []uint32
+
+	keysLock sync.RWMutex
+	// keys holds the data keys of every context used so far, by key version and
+	// encoded context path.
+	keys map[string]*contextEncryptionKeys
+}
+
+type contextEncryptionKeys struct {
+	aead    cipher.AEAD
+	hashKey []byte
+}
+
+func NewEncryptedDatabase(db Database, opts EncryptionOptions) (*EncryptedDatabase, error) {
+	if len(opts.MasterKey) != EncryptionKeySize {
+		return nil, errors.Errorf("NewEncryptedDatabase: Master key has %v bytes, expected %v",
+			len(opts.MasterKey), EncryptionKeySize)
+	}
+	if _, exists := opts.PreviousKeys[opts.KeyVersion]; exists {
+		return nil, errors.Errorf("NewEncryptedDatabase: Key version %v is both active and previous", opts.KeyVersion)
+	}
+
+	var previousVersions []uint32
+	for version, key := range opts.PreviousKeys {
+		if len(key) != EncryptionKeySize {
+			return nil, errors.Errorf("NewEncryptedDatabase: Master key version %v has %v bytes, expected %v",
+				version, len(key), EncryptionKeySize)
+		}
+		previousVersions = append(previousVersions, version)
+	}
+	sort.Slice(previousVersions, func(ii, jj int) bool {
+		return previousVersions[ii] > previousVersions[jj]
+	})
+
+	return &EncryptedDatabase{
+		db:          db,
+		opts:        opts,
+		keyVersions: append([]uint32{opts.KeyVersion}, previousVersions...),
+		keys:        make(map[string]*contextEncryptionKeys),
+	}, nil
+}
+
+// WithBadgerEncryption enables Badger's native encryption at rest, with a key derived
+// from masterKey. Badger then encrypts whole tables and value logs, keys included, so
+// there is no need for an EncryptedDatabase on top.
+func WithBadgerEncryption(opts badger.Options, masterKey []byte) (badger.Options, error) {
+	if len(masterKey) != EncryptionKeySize {
+		return opts, errors.Errorf("WithBadgerEncryption: Master key has %v bytes, expected %v",
+			len(masterKey), EncryptionKeySize)
+	}
+	opts = opts.WithEncryptionKey(hkdfSha256(masterKey, encryptionBadgerInfo, EncryptionKeySize))
+	if opts.IndexCacheSize == 0 {
+		opts = opts.WithIndexCacheSize(BadgerEncryptionIndexCacheSize)
+	}
+	return opts, nil
+}
+
+func (edb *EncryptedDatabase) Setup() error {
+	return edb.db.Setup()
+}
+
+func (edb *EncryptedDatabase) GetContext(id []byte) Context {
+	return edb.db.GetContext(id)
+}
+
+func (edb *EncryptedDatabase) Update(ctx Context, fn func(Transaction, Context) error) error {
+	return edb.db.Update(ctx, func(tx Transaction, ctx Context) error {
+		return fn(NewEncryptedTransaction(edb, tx), ctx)
+	})
+}
+
+func (edb *EncryptedDatabase) View(ctx Context, fn func(Transaction, Context) error) error {
+	return edb.db.View(ctx, func(tx Transaction, ctx Context) error {
+		return fn(NewEncryptedTransaction(edb, tx), ctx)
+	})
+}
+
+func (edb *EncryptedDatabase) NewWriteBatch() WriteBatch {
+	return NewEncryptedWriteBatch(edb, edb.db.NewWriteBatch())
+}
+
+func (edb *EncryptedDatabase) Backup(w io.Writer) error {
+	return edb.db.Backup(w)
+}
+
+func (edb *EncryptedDatabase) BackupSince(w io.Writer, since uint64) (uint64, error) {
+	return edb.db.BackupSince(w, since)
+}
+
+func (edb *EncryptedDatabase) Restore(r io.Reader) error {
+	return edb.db.Restore(r)
+}
+
+func (edb *EncryptedDatabase) Close() error {
+	return edb.db.Close()
+}
+
+func (edb *EncryptedDatabase) Erase() error {
+	return edb.db.Erase()
+}
+
+func (edb *EncryptedDatabase) Id() DatabaseId {
+	return edb.db.Id()
+}
+
+func (edb *EncryptedDatabase) checkIntegrity(report *IntegrityReport) error {
+	return checkWrappedIntegrity(edb.db, report)
+}
+
+func (edb *EncryptedDatabase) nestedContextIds(ctx Context) ([][]byte, error) {
+	return listNestedContextIds(edb.db, ctx)
+}
+
+func (edb *EncryptedDatabase) contextKeys(ctx Context, keyVersion uint32) (*contextEncryptionKeys, error) {
+	pathBytes := encodeContextPath(ctx.Path())
+	cacheKey := string(binary.BigEndian.AppendUint32(nil, keyVersion)) + string(pathBytes)
+	edb.keysLock.RLock()
+	keys, exists := edb.keys[cacheKey]
+	edb.keysLock.RUnlock()
+	if exists {
+		return keys, nil
+	}
+
+	masterKey := edb.opts.MasterKey
+	if keyVersion != edb.opts.KeyVersion {
+		if masterKey, exists = edb.opts.PreviousKeys[keyVersion]; !exists {
+			return nil, errors.Wrapf(ErrEncryptionKeyUnknown, "Key version %v", keyVersion)
+		}
+	}
+
+	valueInfo := append(append([]byte{}, encryptionValueInfo...), pathBytes...)
+	block, err := aes.NewCipher(hkdfSha256(masterKey, valueInfo, EncryptionKeySize))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	keys = &contextEncryptionKeys{aead: aead}
+	if edb.opts.HashKeys {
+		keyInfo := append(append([]byte{}, encryptionKeyInfo...), pathBytes...)
+		keys.hashKey = hkdfSha256(masterKey, keyInfo, EncryptionKeySize)
+	}
+
+	edb.keysLock.Lock()
+	defer edb.keysLock.Unlock()
+	edb.keys[cacheKey] = keys
+	return keys, nil
+}
+
+// storedKey returns the key under which key is stored with the given data keys.
+func (edb *EncryptedDatabase) storedKey(keys *contextEncryptionKeys, key []byte) []byte {
+	if !edb.opts.HashKeys {
+		return key
+	}
+	mac := hmac.New(sha256.New, keys.hashKey)
+	mac.Write(key)
+	return mac.Sum(nil)
+}
+
+// storedKeys returns every key under which key may be stored in ctx, the one of the
+// active key version first.
+func (edb *EncryptedDatabase) storedKeys(ctx Context, key []byte) ([][]byte, error) {
+	if !edb.opts.HashKeys {
+		return [][]byte{key}, nil
+	}
+	storedKeys := make([][]byte, len(edb.keyVersions))
+	for ii, version := range edb.keyVersions {
+		keys, err := edb.contextKeys(ctx, version)
+		if err != nil {
+			return nil, err
+		}
+		storedKeys[ii] = edb.storedKey(keys, key)
+	}
+	return storedKeys, nil
+}
+
+// set encrypts value and writes it with w, removing any copy of key stored under the
+// hash of a previous key version.
+func (edb *EncryptedDatabase) set(w BulkWriter, key []byte, value []byte, ctx Context) error {
+	storedKey, sealed, err := edb.seal(ctx, key, value)
+	if err != nil {
+		return errors.Wrapf(err, "Problem encrypting value")
+	}
+	if err := w.Set(storedKey, sealed, ctx); err != nil {
+		return err
+	}
+
+	storedKeys, err := edb.storedKeys(ctx, key)
+	if err != nil {
+		return err
+	}
+	for _, previousKey := range storedKeys[1:] {
+		if err := w.Delete(previousKey, ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (edb *EncryptedDatabase) delete(w BulkWriter, key []byte, ctx Context) error {
+	storedKeys, err := edb.storedKeys(ctx, key)
+	if err != nil {
+		return err
+	}
+	for _, storedKey := range storedKeys {
+		if err := w.Delete(storedKey, ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// seal encrypts value for key in ctx under the active key version, and returns it with
+// the key to store it under. The stored value is
+//
+//	Version uint8 Flags uint8 KeyVersion uint32 Nonce[12] AES-GCM(Plaintext)
+//
+// where Plaintext is the value, preceded by the length-prefixed key when Flags has
+// encryptedValueHasKey. The context path and stored key are authenticated as additional
+// data.
+func (edb *EncryptedDatabase) seal(ctx Context, key []byte, value []byte) (_storedKey []byte, _sealed []byte, _err error) {
+	keys, err := edb.contextKeys(ctx, edb.opts.KeyVersion)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	flags := byte(0)
+	plaintext := value
+	if edb.opts.HashKeys {
+		flags |= encryptedValueHasKey
+		plaintext = append(appendLengthPrefixed(nil, key), value...)
+	}
+	nonce, err := RandomBytes(int32(keys.aead.NonceSize()))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	storedKey := edb.storedKey(keys, key)
+	sealed := make([]byte, 0, encryptedValueHeaderSize+len(nonce)+len(plaintext)+keys.aead.Overhead())
+	sealed = append(sealed, encryptedValueVersion, flags)
+	sealed = binary.BigEndian.AppendUint32(sealed, edb.opts.KeyVersion)
+	sealed = append(sealed, nonce...)
+	sealed = keys.aead.Seal(sealed, nonce, plaintext, encodeRecordLocation(ctx.Path(), storedKey))
+	return storedKey, sealed, nil
+}
+
+// open decrypts the value stored under storedKey in ctx, and returns it with its key.
+func (edb *EncryptedDatabase) open(ctx Context, storedKey []byte, sealed []byte) (_key []byte, _value []byte, _err error) {
+	keyVersion, err := encryptedValueKeyVersion(sealed)
+	if err != nil {
+		return nil, nil, err
+	}
+	keys, err := edb.contextKeys(ctx, keyVersion)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nonceSize := keys.aead.NonceSize()
+	if len(sealed) < encryptedValueHeaderSize+nonceSize {
+		return nil, nil, ErrEncryptedValueCorrupted
+	}
+	flags := sealed[1]
+	nonce := sealed[encryptedValueHeaderSize : encryptedValueHeaderSize+nonceSize]
+	plaintext, err := keys.aead.Open(nil, nonce, sealed[encryptedValueHeaderSize+nonceSize:],
+		encodeRecordLocation(ctx.Path(), storedKey))
+	if err != nil {
+		return nil, nil, ErrEncryptedValueCorrupted
+	}
+	if flags&encryptedValueHasKey == 0 {
+		return storedKey, plaintext, nil
+	}
+
+	keyLength, n := binary.Uvarint(plaintext)
+	if n <= 0 || keyLength > uint64(len(plaintext)-n) {
+		return nil, nil, ErrEncryptedValueCorrupted
+	}
+	return plaintext[n : n+int(keyLength)], plaintext[n+int(keyLength):], nil
+}
+
+// encryptedValueKeyVersion returns the key version of a stored value.
+func encryptedValueKeyVersion(sealed []byte) (uint32, error) {
+	if len(sealed) < encryptedValueHeaderSize || sealed[0] != encryptedValueVersion {
+		return 0, ErrEncryptedValueCorrupted
+	}
+	return binary.BigEndian.Uint32(sealed[2:]), nil
+}
+
+// hkdfSha256 derives length bytes from secret with HKDF (RFC 5869), using SHA-256, an
+// empty salt, and info to separate the derived keys.
+func hkdfSha256(secret []byte, info []byte, length int) []byte {
+	extract := hmac.New(sha256.New, make([]byte, sha256.Size))
+	extract.Write(secret)
+	prk := extract.Sum(nil)
+
+	var derived, block []byte
+	for counter := byte(1); len(derived) < length; counter++ {
+		expand := hmac.New(sha256.New, prk)
+		expand.Write(block)
+		expand.Write(info)
+		expand.Write([]byte{counter})
+		block = expand.Sum(nil)
+		derived = append(derived, block...)
+	}
+	return derived[:length]
+}
+
+// ==========================
+// EncryptedTransaction
+// ==========================
+
+type EncryptedTransaction struct {
+	db *EncryptedDatabase
+	tx Transaction
+}
+
+func NewEncryptedTransaction(db *EncryptedDatabase, tx Transaction) *EncryptedTransaction {
+	return &EncryptedTransaction{
+		db: db,
+		tx: tx,
+	}
+}
+
+func (etx *EncryptedTransaction) Set(key []byte, value []byte, ctx Context) error {
+	return errors.Wrapf(etx.db.set(etx.tx, key, value, ctx), "Set:")
+}
+
+func (etx *EncryptedTransaction) Delete(key []byte, ctx Context) error {
+	return errors.Wrapf(etx.db.delete(etx.tx, key, ctx), "Delete:")
+}
+
+// Get looks the key up under every key version until it is found. If it is not, the
+// result of the last lookup is returned, so a missing key is reported the same way as
+// by the underlying database.
+func (etx *EncryptedTransaction) Get(key []byte, ctx Context) ([]byte, error) {
+	storedKeys, err := etx.db.storedKeys(ctx, key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Get:")
+	}
+
+	var sealed []byte
+	for _, storedKey := range storedKeys {
+		sealed, err = etx.tx.Get(storedKey, ctx)
+		if _, found, _ := getResult(sealed, err); !found {
+			continue
+		}
+		_, value, err := etx.db.open(ctx, storedKey, sealed)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Get: Problem decrypting key %x", key)
+		}
+		return value, nil
+	}
+	return sealed, err
+}
+
+func (etx *EncryptedTransaction) MultiGet(keys [][]byte, ctx Context) ([][]byte, []bool, error) {
+	// Look every key up under every key version in a single pass.
+	numVersions := 1
+	var storedKeys [][]byte
+	for _, key := range keys {
+		keyStoredKeys, err := etx.db.storedKeys(ctx, key)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "MultiGet:")
+		}
+		numVersions = len(keyStoredKeys)
+		storedKeys = append(storedKeys, keyStoredKeys...)
+	}
+
+	sealedValues, sealedFound, err := etx.tx.MultiGet(storedKeys, ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	values := make([][]byte, len(keys))
+	found := make([]bool, len(keys))
+	for ii := range keys {
+		for jj := ii * numVersions; jj < (ii+1)*numVersions; jj++ {
+			if !sealedFound[jj] {
+				continue
+			}
+			if _, values[ii], err = etx.db.open(ctx, storedKeys[jj], sealedValues[jj]); err != nil {
+				return nil, nil, errors.Wrapf(err, "MultiGet: Problem decrypting key %x", keys[ii])
+			}
+			found[ii] = true
+			break
+		}
+	}
+	return values, found, nil
+}
+
+func (etx *EncryptedTransaction) GetIterator(ctx Context) (Iterator, error) {
+	it, err := etx.tx.GetIterator(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return NewEncryptedIterator(etx.db, it), nil
+}
+
+// ==========================
+// EncryptedWriteBatch
+// ==========================
+
+type EncryptedWriteBatch struct {
+	db *EncryptedDatabase
+	wb WriteBatch
+}
+
+func NewEncryptedWriteBatch(db *EncryptedDatabase, wb WriteBatch) *EncryptedWriteBatch {
+	return &EncryptedWriteBatch{
+		db: db,
+		wb: wb,
+	}
+}
+
+func (ewb *EncryptedWriteBatch) Set(key []byte, value []byte, ctx Context) error {
+	return errors.Wrapf(ewb.db.set(ewb.wb, key, value, ctx), "Set:")
+}
+
+func (ewb *EncryptedWriteBatch) Delete(key []byte, ctx Context) error {
+	return errors.Wrapf(ewb.db.delete(ewb.wb, key, ctx), "Delete:")
+}
+
+func (ewb *EncryptedWriteBatch) Flush() error {
+	return ewb.wb.Flush()
+}
+
+func (ewb *EncryptedWriteBatch) Cancel() {
+	ewb.wb.Cancel()
+}
+
+// ==========================
+// EncryptedIterator
+// ==========================
+
+// EncryptedIterator decrypts the entries of an underlying iterator. With hashed keys,
+// Key returns the plaintext key read from the value, and nil if the value can't be
+// decrypted; otherwise it returns the key of the underlying iterator.
+type EncryptedIterator struct {
+	db *EncryptedDatabase
+	it Iterator
+
+	// opened caches the decrypted entry the iterator is at.
+	opened     bool
+	currentKey []byte
+	value      []byte
+	err        error
+}
+
+func NewEncryptedIterator(db *EncryptedDatabase, it Iterator) *EncryptedIterator {
+	return &EncryptedIterator{
+		db: db,
+		it: it,
+	}
+}
+
+func (eit *EncryptedIterator) GetContext() Context {
+	return eit.it.GetContext()
+}
+
+func (eit *EncryptedIterator) Value() ([]byte, error) {
+	eit.openCurrent()
+	return eit.value, eit.err
+}
+
+func (eit *EncryptedIterator) Key() []byte {
+	if !eit.db.opts.HashKeys {
+		return eit.it.Key()
+	}
+	eit.openCurrent()
+	return eit.currentKey
+}
+
+func (eit *EncryptedIterator) localKey() []byte {
+	if !eit.db.opts.HashKeys {
+		return iteratorLocalKey(eit.it)
+	}
+	eit.openCurrent()
+	return eit.currentKey
+}
+
+func (eit *EncryptedIterator) Next() bool {
+	eit.opened = false
+	return eit.it.Next()
+}
+
+// Seek moves to the stored form of key, so with hashed keys it positions the iterator
+// in hash order.
+func (eit *EncryptedIterator) Seek(key []byte) bool {
+	eit.opened = false
+	keys, err := eit.db.contextKeys(eit.it.GetContext(), eit.db.opts.KeyVersion)
+	if err != nil {
+		return false
+	}
+	return eit.it.Seek(eit.db.storedKey(keys, key))
+}
+
+func (eit *EncryptedIterator) Close() {
+	eit.it.Close()
+}
+
+func (eit *EncryptedIterator) openCurrent() {
+	if eit.opened {
+		return
+	}
+	eit.opened = true
+	eit.currentKey, eit.value, eit.err = nil, nil, nil
+
+	sealed, err := eit.it.Value()
+	if err != nil {
+		eit.err = err
+		return
+	}
+	eit.currentKey, eit.value, eit.err = eit.db.open(eit.it.GetContext(), iteratorLocalKey(eit.it), sealed)
+	if eit.err != nil {
+		eit.err = errors.Wrapf(eit.err, "Value: Problem decrypting key %x", eit.it.Key())
+	}
+}
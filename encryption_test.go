@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"os"
+	"testing"
+)
+
+// TestEncryptedDatabase encrypts Bolt with and without hashed keys, and opens Badger with
+// native encryption.
+func TestEncryptedDatabase(t *testing.T) {
+	require := require.New(t)
+
+	masterKey, err := RandomBytes(EncryptionKeySize)
+	require.NoError(err)
+
+	for _, hashKeys := range []bool{false, true} {
+		boltDb := newTestBoltDatabase("boltdb-encrypted", t)
+		db, err := NewEncryptedDatabase(boltDb, EncryptionOptions{MasterKey: masterKey, HashKeys: hashKeys})
+		require.NoError(err)
+		GenericEncryptedDatabaseTest(db, boltDb, t)
+		require.NoError(db.Close())
+		require.NoError(db.Erase())
+	}
+
+	// Badger iterators include the context prefix in their keys; it has to be stripped
+	// through the wrappers too, or every value fails to authenticate.
+	for _, hashKeys := range []bool{false, true} {
+		badgerDb := newTestBadgerDatabase("badgerdb-encrypted-wrapped", t)
+		wrapped := NewTracedDatabase(NewInstrumentedDatabase(badgerDb, NewDatabaseMetrics()), DefaultTracingOptions())
+		db, err := NewEncryptedDatabase(wrapped, EncryptionOptions{MasterKey: masterKey, HashKeys: hashKeys})
+		require.NoError(err)
+		GenericEncryptedDatabaseTest(db, badgerDb, t)
+		require.NoError(db.Close())
+		require.NoError(db.Erase())
+	}
+
+	badgerDir, err := os.MkdirTemp("", "badgerdb-encrypted")
+	require.NoError(err)
+	opts, err := WithBadgerEncryption(DefaultBadgerOptions(badgerDir), masterKey)
+	require.NoError(err)
+	badgerDb := NewBadgerDatabase(opts)
+	require.NoError(badgerDb.Setup())
+	defer badgerDb.Erase()
+	defer badgerDb.Close()
+	GenericMultiGetTest(badgerDb, badgerDb.GetContext([]byte("Encrypted")), t)
+}
+
+func GenericEncryptedDatabaseTest(db *EncryptedDatabase, raw Database, t *testing.T) {
+	require := require.New(t)
+
+	ctx := db.GetContext([]byte("users")).NestContext([]byte("emails"))
+	otherCtx := db.GetContext([]byte("users")).NestContext([]byte("names"))
+	plaintext := []byte("someone@example.com")
+	require.NoError(db.Update(ctx, func(tx Transaction, ctx Context) error {
+		for _, key := range []string{"alice", "bob", "carol"} {
+			if err := tx.Set([]byte(key), plaintext, ctx); err != nil {
+				return err
+			}
+		}
+		return tx.Set([]byte("alice"), plaintext, otherCtx)
+	}))
+
+	GenericMultiGetTest(db, db.GetContext([]byte("multiget")), t)
+
+	// Nothing readable reaches the underlying database.
+	require.NoError(forEachRecord(raw, func(record *BackupRecord) error {
+		require.False(bytes.Contains(record.Value, plaintext))
+		if db.opts.HashKeys {
+			require.Len(record.Key, sha256.Size)
+		}
+		return nil
+	}))
+
+	require.NoError(db.View(ctx, func(tx Transaction, ctx Context) error {
+		value, err := tx.Get([]byte("bob"), ctx)
+		require.NoError(err)
+		require.Equal(plaintext, value)
+
+		// The iterator skips its first entry, so only two of the three keys show up.
+		it, err := tx.GetIterator(ctx)
+		require.NoError(err)
+		defer it.Close()
+		var keys [][]byte
+		for it.Next() {
+			value, err := it.Value()
+			require.NoError(err)
+			require.Equal(plaintext, value)
+			keys = append(keys, iteratorLocalKey(it))
+		}
+		require.Len(keys, 2)
+		for _, key := range keys {
+			require.Contains([]string{"alice", "bob", "carol"}, string(key))
+		}
+		return nil
+	}))
+
+	// A value copied to another key, or to the same key in another context, is rejected.
+	require.NoError(raw.Update(ctx, func(tx Transaction, ctx Context) error {
+		keys, err := db.contextKeys(ctx, 0)
+		require.NoError(err)
+		otherKeys, err := db.contextKeys(otherCtx, 0)
+		require.NoError(err)
+
+		aliceKey, bobKey := db.storedKey(keys, []byte("alice")), db.storedKey(keys, []byte("bob"))
+		sealed, err := tx.Get(aliceKey, ctx)
+		require.NoError(err)
+		if err := tx.Set(bobKey, sealed, ctx); err != nil {
+			return err
+		}
+		return tx.Set(db.storedKey(otherKeys, []byte("alice")), sealed, otherCtx)
+	}))
+	require.NoError(db.View(ctx, func(tx Transaction, ctx Context) error {
+		_, err := tx.Get([]byte("bob"), ctx)
+		require.True(errors.Is(err, ErrEncryptedValueCorrupted))
+		_, err = tx.Get([]byte("alice"), otherCtx)
+		require.True(errors.Is(err, ErrEncryptedValueCorrupted))
+		return nil
+	}))
+}
@@ -2,15 +2,20 @@ module BadgerBoltExperiment
 
 go 1.20
 
-require github.com/pkg/errors v0.9.1
+require (
+	github.com/boltdb/bolt v1.3.1
+	github.com/dgraph-io/badger/v4 v4.1.0
+	github.com/dgraph-io/ristretto v0.1.1
+	github.com/klauspost/compress v1.12.3
+	github.com/pkg/errors v0.9.1
+	github.com/stretchr/testify v1.8.4
+	go.opencensus.io v0.22.5
+)
 
 require (
-	github.com/boltdb/bolt v1.3.1 // indirect
 	github.com/cespare/xxhash v1.1.0 // indirect
 	github.com/cespare/xxhash/v2 v2.1.2 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/dgraph-io/badger/v4 v4.1.0 // indirect
-	github.com/dgraph-io/ristretto v0.1.1 // indirect
 	github.com/dustin/go-humanize v1.0.0 // indirect
 	github.com/gogo/protobuf v1.3.2 // indirect
 	github.com/golang/glog v0.0.0-20160126235308-23def4e6c14b // indirect
@@ -18,10 +23,7 @@ require (
 	github.com/golang/protobuf v1.3.1 // indirect
 	github.com/golang/snappy v0.0.3 // indirect
 	github.com/google/flatbuffers v1.12.1 // indirect
-	github.com/klauspost/compress v1.12.3 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/stretchr/testify v1.8.4 // indirect
-	go.opencensus.io v0.22.5 // indirect
 	golang.org/x/net v0.7.0 // indirect
 	golang.org/x/sys v0.5.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+	"sync"
+)
+
+// Mutation is a Set or Delete of a transaction.
+type Mutation struct {
+	Path [][]byte
+	Key  []byte
+	// Value is nil for a Delete.
+	Value  []byte
+	Delete bool
+}
+
+// PreCommitHook is called with the mutations of an Update once its function returns,
+// before it commits. An error rolls the Update back, and is returned by Update.
+type PreCommitHook func(mutations []Mutation) error
+
+// PostCommitHook is called with the mutations of an Update once it commits.
+type PostCommitHook func(mutations []Mutation)
+
+// CommitHookDatabase is implemented by BadgerDatabase and BoltDatabase.
+//
+// Hooks see every Set and Delete of an Update in order, with the keys and values the
+// backend stores, so the values written through a CompressedDatabase or an
+// EncryptedDatabase are encoded. Pre-commit hooks run inside the transaction, and on
+// Bolt while holding the writer lock, so they must not write to the database. A Badger
+// Update retried on conflict runs its pre-commit hooks on every attempt. Writes that
+// don't go through Update, like Badger write batches, bulk loads and restores, bypass
+// the hooks, while Bolt write batches commit through Update.
+type CommitHookDatabase interface {
+	AddPreCommitHook(hook PreCommitHook)
+	AddPostCommitHook(hook PostCommitHook)
+}
+
+// ==========================
+// commitHooks
+// ==========================
+
+// commitHooks holds the hooks of a database. A transaction uses the hooks registered
+// when it starts.
+type commitHooks struct {
+	hooksLock  sync.RWMutex
+	preCommit  []PreCommitHook
+	postCommit []PostCommitHook
+}
+
+func (ch *commitHooks) AddPreCommitHook(hook PreCommitHook) {
+	ch.hooksLock.Lock()
+	defer ch.hooksLock.Unlock()
+
+	ch.preCommit = append(ch.preCommit, hook)
+}
+
+func (ch *commitHooks) AddPostCommitHook(hook PostCommitHook) {
+	ch.hooksLock.Lock()
+	defer ch.hooksLock.Unlock()
+
+	ch.postCommit = append(ch.postCommit, hook)
+}
+
+// beginMutations returns the mutation log of a new transaction, or nil if there are no
+// hooks, so that mutations are only recorded when a hook needs them.
+func (ch *commitHooks) beginMutations() *mutationLog {
+	ch.hooksLock.RLock()
+	defer ch.hooksLock.RUnlock()
+
+	if len(ch.preCommit) == 0 && len(ch.postCommit) == 0 {
+		return nil
+	}
+	return &mutationLog{
+		preCommit:  ch.preCommit[:len(ch.preCommit):len(ch.preCommit)],
+		postCommit: ch.postCommit[:len(ch.postCommit):len(ch.postCommit)],
+	}
+}
+
+// ==========================
+// mutationLog
+// ==========================
+
+// mutationLog records the mutations of a transaction for its hooks. A nil log records
+// nothing and runs no hook. Keys and values are copied, since callers may reuse them
+// once Set returns.
+type mutationLog struct {
+	mutations  []Mutation
+	preCommit  []PreCommitHook
+	postCommit []PostCommitHook
+}
+
+func (ml *mutationLog) set(path [][]byte, key []byte, value []byte) {
+	if ml == nil {
+		return
+	}
+	ml.mutations = append(ml.mutations, Mutation{
+		Path:  path,
+		Key:   append([]byte{}, key...),
+		Value: append([]byte{}, value...),
+	})
+}
+
+func (ml *mutationLog) delete(path [][]byte, key []byte) {
+	if ml == nil {
+		return
+	}
+	ml.mutations = append(ml.mutations, Mutation{
+		Path:   path,
+		Key:    append([]byte{}, key...),
+		Delete: true,
+	})
+}
+
+// runPreCommit runs the pre-commit hooks until one vetoes the commit.
+func (ml *mutationLog) runPreCommit() error {
+	if ml == nil {
+		return nil
+	}
+	for _, hook := range ml.preCommit {
+		if err := hook(ml.mutations); err != nil {
+			return errors.Wrapf(err, "Update: Commit vetoed by pre-commit hook")
+		}
+	}
+	return nil
+}
+
+func (ml *mutationLog) runPostCommit() {
+	if ml == nil {
+		return
+	}
+	for _, hook := range ml.postCommit {
+		hook(ml.mutations)
+	}
+}
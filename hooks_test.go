@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+// TestCommitHooks checks on Bolt and Badger that hooks see the mutations of an Update,
+// that a pre-commit hook can veto the commit, and that post-commit hooks only run for
+// committed Updates.
+func TestCommitHooks(t *testing.T) {
+	require := require.New(t)
+
+	boltDb := newTestBoltDatabase("boltdb-hooks", t)
+	defer boltDb.Erase()
+	defer boltDb.Close()
+	badgerDb := newTestBadgerDatabase("badgerdb-hooks", t)
+	defer badgerDb.Erase()
+	defer badgerDb.Close()
+
+	errNegative := errors.New("negative balance")
+	for _, db := range []interface {
+		Database
+		CommitHookDatabase
+	}{boltDb, badgerDb} {
+		var committed [][]Mutation
+		db.AddPreCommitHook(func(mutations []Mutation) error {
+			for _, mutation := range mutations {
+				if bytes.HasPrefix(mutation.Value, []byte("-")) {
+					return errNegative
+				}
+			}
+			return nil
+		})
+		db.AddPostCommitHook(func(mutations []Mutation) {
+			committed = append(committed, mutations)
+		})
+
+		ctx := db.GetContext([]byte("accounts"))
+		nestedCtx := ctx.NestContext([]byte("balances"))
+		key := []byte("alice")
+		require.NoError(db.Update(ctx, func(tx Transaction, ctx Context) error {
+			if err := tx.Set(key, []byte("10"), nestedCtx); err != nil {
+				return err
+			}
+			// Reusing the key doesn't change the recorded mutation.
+			key[0] = 'A'
+			return tx.Delete([]byte("bob"), ctx)
+		}))
+		require.Equal([][]Mutation{{
+			{Path: nestedCtx.Path(), Key: []byte("alice"), Value: []byte("10")},
+			{Path: ctx.Path(), Key: []byte("bob"), Delete: true},
+		}}, committed)
+
+		err := db.Update(ctx, func(tx Transaction, ctx Context) error {
+			return tx.Set([]byte("alice"), []byte("-5"), nestedCtx)
+		})
+		require.True(errors.Is(err, errNegative))
+		require.Len(committed, 1)
+		require.NoError(db.View(nestedCtx, func(tx Transaction, ctx Context) error {
+			value, err := tx.Get([]byte("alice"), ctx)
+			require.Equal("10", string(value))
+			return err
+		}))
+
+		require.Error(db.Update(ctx, func(tx Transaction, ctx Context) error {
+			require.NoError(tx.Set([]byte("carol"), []byte("1"), ctx))
+			return errors.New("rollback")
+		}))
+		require.Len(committed, 1)
+	}
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type DatabaseOperation string
+
+const (
+	OperationUpdate   DatabaseOperation = "update"
+	OperationView     DatabaseOperation = "view"
+	OperationSet      DatabaseOperation = "set"
+	OperationGet      DatabaseOperation = "get"
+	OperationMultiGet DatabaseOperation = "multiget"
+	OperationDelete   DatabaseOperation = "delete"
+	OperationNext     DatabaseOperation = "next"
+	OperationSeek     DatabaseOperation = "seek"
+	OperationFlush    DatabaseOperation = "flush"
+)
+
+const (
+	// MaxMetricContexts bounds the number of context paths metrics are broken down by.
+	// Operations on further contexts are recorded under a nil path, so that contexts
+	// created per user or per block can't grow the metrics without bound.
+	MaxMetricContexts = 1000
+)
+
+// LatencyBuckets are the upper bounds, in seconds, of the latency histogram buckets. They
+// grow by a factor of 4 from 10µs to about 40s, with a last bucket for anything slower.
+var LatencyBuckets = []float64{
+	0.00001, 0.00004, 0.00016, 0.00064, 0.00256, 0.01024, 0.04096, 0.16384, 0.65536, 2.62144, 10.48576, 41.94304,
+}
+
+// ==========================
+// DatabaseMetrics
+// ==========================
+
+// DatabaseMetrics collects the metrics of any number of InstrumentedDatabases, broken
+// down by backend, context path and operation.
+type DatabaseMetrics struct {
+	lock       sync.RWMutex
+	operations map[operationMetricsKey]*operationMetrics
+	paths      map[string]bool
+}
+
+type operationMetricsKey struct {
+	backend   DatabaseId
+	path      string
+	operation DatabaseOperation
+}
+
+type operationMetrics struct {
+	path [][]byte
+
+	count  atomic.Uint64
+	errors atomic.Uint64
+	bytes  atomic.Uint64
+	// latencies counts the operations per bucket of LatencyBuckets, and the last one those
+	// slower than every bucket.
+	latencies    []atomic.Uint64
+	latencyNanos atomic.Uint64
+}
+
+// OperationMetrics is a snapshot of the metrics of an operation on a context.
+type OperationMetrics struct {
+	Backend   DatabaseId
+	Path      [][]byte
+	Operation DatabaseOperation
+
+	Count  uint64
+	Errors uint64
+	// Bytes are the key and value bytes written by sets and deletes, and the value bytes
+	// read by gets and iterators.
+	Bytes uint64
+	// LatencyCounts are the number of operations per bucket of LatencyBuckets, followed
+	// by the number slower than every bucket. They are not cumulative.
+	LatencyCounts []uint64
+	LatencySum    time.Duration
+}
+
+func NewDatabaseMetrics() *DatabaseMetrics {
+	return &DatabaseMetrics{
+		operations: make(map[operationMetricsKey]*operationMetrics),
+		paths:      make(map[string]bool),
+	}
+}
+
+// record adds an operation of the given size and outcome, which started at start.
+func (dm *DatabaseMetrics) record(backend DatabaseId, path [][]byte, operation DatabaseOperation,
+	start time.Time, size int, err error) {
+
+	metrics := dm.get(backend, path, operation)
+	metrics.count.Add(1)
+	if err != nil {
+		metrics.errors.Add(1)
+	}
+	metrics.bytes.Add(uint64(size))
+	if !start.IsZero() {
+		latency := time.Since(start)
+		metrics.latencyNanos.Add(uint64(latency))
+		bucket := sort.SearchFloat64s(LatencyBuckets, latency.Seconds())
+		metrics.latencies[bucket].Add(1)
+	}
+}
+
+// recordBytes adds bytes to an operation without counting it again.
+func (dm *DatabaseMetrics) recordBytes(backend DatabaseId, path [][]byte, operation DatabaseOperation, size int) {
+	dm.get(backend, path, operation).bytes.Add(uint64(size))
+}
+
+func (dm *DatabaseMetrics) get(backend DatabaseId, path [][]byte, operation DatabaseOperation) *operationMetrics {
+	key := operationMetricsKey{
+		backend:   backend,
+		path:      string(encodeContextPath(path)),
+		operation: operation,
+	}
+	dm.lock.RLock()
+	metrics, exists := dm.operations[key]
+	dm.lock.RUnlock()
+	if exists {
+		return metrics
+	}
+
+	dm.lock.Lock()
+	defer dm.lock.Unlock()
+	if !dm.paths[key.path] && len(dm.paths) >= MaxMetricContexts {
+		key.path, path = "", nil
+	}
+	if metrics, exists := dm.operations[key]; exists {
+		return metrics
+	}
+	dm.paths[key.path] = true
+	metrics = &operationMetrics{
+		path:      path,
+		latencies: make([]atomic.Uint64, len(LatencyBuckets)+1),
+	}
+	dm.operations[key] = metrics
+	return metrics
+}
+
+// Snapshot returns the metrics of every operation recorded so far, ordered by backend,
+// path and operation.
+func (dm *DatabaseMetrics) Snapshot() []*OperationMetrics {
+	dm.lock.RLock()
+	snapshot := make([]*OperationMetrics, 0, len(dm.operations))
+	for key, metrics := range dm.operations {
+		latencyCounts := make([]uint64, len(metrics.latencies))
+		for ii := range metrics.latencies {
+			latencyCounts[ii] = metrics.latencies[ii].Load()
+		}
+		snapshot = append(snapshot, &OperationMetrics{
+			Backend:       key.backend,
+			Path:          metrics.path,
+			Operation:     key.operation,
+			Count:         metrics.count.Load(),
+			Errors:        metrics.errors.Load(),
+			Bytes:         metrics.bytes.Load(),
+			LatencyCounts: latencyCounts,
+			LatencySum:    time.Duration(metrics.latencyNanos.Load()),
+		})
+	}
+	dm.lock.RUnlock()
+
+	sort.Slice(snapshot, func(ii, jj int) bool {
+		left, right := snapshot[ii], snapshot[jj]
+		if left.Backend != right.Backend {
+			return left.Backend < right.Backend
+		}
+		if order := bytes.Compare(encodeContextPath(left.Path), encodeContextPath(right.Path)); order != 0 {
+			return order < 0
+		}
+		return left.Operation < right.Operation
+	})
+	return snapshot
+}
+
+// ==========================
+// InstrumentedDatabase
+// ==========================
+
+// InstrumentedDatabase records the count, errors, bytes and latency of the operations
+// made on any Database into a DatabaseMetrics. Transactions are attributed to the path
+// of the context they are opened with, and operations within them to the path of the
+// context they are given. Iterator operations are timed individually, so iterating
+// costs a clock read per key.
+type InstrumentedDatabase struct {
+	db      Database
+	metrics *DatabaseMetrics
+}
+
+func NewInstrumentedDatabase(db Database, metrics *DatabaseMetrics) *InstrumentedDatabase {
+	return &InstrumentedDatabase{
+		db:      db,
+		metrics: metrics,
+	}
+}
+
+func (idb *InstrumentedDatabase) Metrics() *DatabaseMetrics {
+	return idb.metrics
+}
+
+func (idb *InstrumentedDatabase) Setup() error {
+	return idb.db.Setup()
+}
+
+func (idb *InstrumentedDatabase) GetContext(id []byte) Context {
+	return idb.db.GetContext(id)
+}
+
+func (idb *InstrumentedDatabase) Update(ctx Context, fn func(Transaction, Context) error) error {
+	start := time.Now()
+	err := idb.db.Update(ctx, func(tx Transaction, ctx Context) error {
+		return fn(NewInstrumentedTransaction(idb, tx), ctx)
+	})
+	idb.metrics.record(idb.db.Id(), ctx.Path(), OperationUpdate, start, 0, err)
+	return err
+}
+
+func (idb *InstrumentedDatabase) View(ctx Context, fn func(Transaction, Context) error) error {
+	start := time.Now()
+	err := idb.db.View(ctx, func(tx Transaction, ctx Context) error {
+		return fn(NewInstrumentedTransaction(idb, tx), ctx)
+	})
+	idb.metrics.record(idb.db.Id(), ctx.Path(), OperationView, start, 0, err)
+	return err
+}
+
+func (idb *InstrumentedDatabase) NewWriteBatch() WriteBatch {
+	return NewInstrumentedWriteBatch(idb, idb.db.NewWriteBatch())
+}
+
+func (idb *InstrumentedDatabase) Backup(w io.Writer) error {
+	return idb.db.Backup(w)
+}
+
+func (idb *InstrumentedDatabase) BackupSince(w io.Writer, since uint64) (uint64, error) {
+	return idb.db.BackupSince(w, since)
+}
+
+func (idb *InstrumentedDatabase) Restore(r io.Reader) error {
+	return idb.db.Restore(r)
+}
+
+func (idb *InstrumentedDatabase) Close() error {
+	return idb.db.Close()
+}
+
+func (idb *InstrumentedDatabase) Erase() error {
+	return idb.db.Erase()
+}
+
+func (idb *InstrumentedDatabase) Id() DatabaseId {
+	return idb.db.Id()
+}
+
+func (idb *InstrumentedDatabase) checkIntegrity(report *IntegrityReport) error {
+	return checkWrappedIntegrity(idb.db, report)
+}
+
+func (idb *InstrumentedDatabase) nestedContextIds(ctx Context) ([][]byte, error) {
+	return listNestedContextIds(idb.db, ctx)
+}
+
+// ==========================
+// InstrumentedTransaction
+// ==========================
+
+type InstrumentedTransaction struct {
+	db *InstrumentedDatabase
+	tx Transaction
+}
+
+func NewInstrumentedTransaction(db *InstrumentedDatabase, tx Transaction) *InstrumentedTransaction {
+	return &InstrumentedTransaction{
+		db: db,
+		tx: tx,
+	}
+}
+
+func (itx *InstrumentedTransaction) Set(key []byte, value []byte, ctx Context) error {
+	start := time.Now()
+	err := itx.tx.Set(key, value, ctx)
+	itx.db.metrics.record(itx.db.Id(), ctx.Path(), OperationSet, start, len(key)+len(value), err)
+	return err
+}
+
+func (itx *InstrumentedTransaction) Delete(key []byte, ctx Context) error {
+	start := time.Now()
+	err := itx.tx.Delete(key, ctx)
+	itx.db.metrics.record(itx.db.Id(), ctx.Path(), OperationDelete, start, len(key), err)
+	return err
+}
+
+func (itx *InstrumentedTransaction) Get(key []byte, ctx Context) ([]byte, error) {
+	start := time.Now()
+	value, err := itx.tx.Get(key, ctx)
+	// A missing key isn't a failure, even though Badger returns it as an error.
+	_, _, resultErr := getResult(value, err)
+	itx.db.metrics.record(itx.db.Id(), ctx.Path(), OperationGet, start, len(value), resultErr)
+	return value, err
+}
+
+func (itx *InstrumentedTransaction) MultiGet(keys [][]byte, ctx Context) ([][]byte, []bool, error) {
+	start := time.Now()
+	values, found, err := itx.tx.MultiGet(keys, ctx)
+	size := 0
+	for _, value := range values {
+		size += len(value)
+	}
+	itx.db.metrics.record(itx.db.Id(), ctx.Path(), OperationMultiGet, start, size, err)
+	return values, found, err
+}
+
+func (itx *InstrumentedTransaction) GetIterator(ctx Context) (Iterator, error) {
+	it, err := itx.tx.GetIterator(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return NewInstrumentedIterator(itx.db, it, ctx.Path()), nil
+}
+
+// ==========================
+// InstrumentedWriteBatch
+// ==========================
+
+// InstrumentedWriteBatch counts the sets and deletes of a batch along with those of
+// transactions, without their latency, since they are only buffered. The latency of
+// writing them is that of Flush, which is recorded without a path.
+type InstrumentedWriteBatch struct {
+	db *InstrumentedDatabase
+	wb WriteBatch
+}
+
+func NewInstrumentedWriteBatch(db *InstrumentedDatabase, wb WriteBatch) *InstrumentedWriteBatch {
+	return &InstrumentedWriteBatch{
+		db: db,
+		wb: wb,
+	}
+}
+
+func (iwb *InstrumentedWriteBatch) Set(key []byte, value []byte, ctx Context) error {
+	err := iwb.wb.Set(key, value, ctx)
+	iwb.db.metrics.record(iwb.db.Id(), ctx.Path(), OperationSet, time.Time{}, len(key)+len(value), err)
+	return err
+}
+
+func (iwb *InstrumentedWriteBatch) Delete(key []byte, ctx Context) error {
+	err := iwb.wb.Delete(key, ctx)
+	iwb.db.metrics.record(iwb.db.Id(), ctx.Path(), OperationDelete, time.Time{}, len(key), err)
+	return err
+}
+
+func (iwb *InstrumentedWriteBatch) Flush() error {
+	start := time.Now()
+	err := iwb.wb.Flush()
+	iwb.db.metrics.record(iwb.db.Id(), nil, OperationFlush, start, 0, err)
+	return err
+}
+
+func (iwb *InstrumentedWriteBatch) Cancel() {
+	iwb.wb.Cancel()
+}
+
+// ==========================
+// InstrumentedIterator
+// ==========================
+
+type InstrumentedIterator struct {
+	db   *InstrumentedDatabase
+	it   Iterator
+	path [][]byte
+}
+
+func NewInstrumentedIterator(db *InstrumentedDatabase, it Iterator, path [][]byte) *InstrumentedIterator {
+	return &InstrumentedIterator{
+		db:   db,
+		it:   it,
+		path: path,
+	}
+}
+
+func (iit *InstrumentedIterator) GetContext() Context {
+	return iit.it.GetContext()
+}
+
+// Value adds the bytes read to the iterator's next operations.
+func (iit *InstrumentedIterator) Value() ([]byte, error) {
+	value, err := iit.it.Value()
+	iit.db.metrics.recordBytes(iit.db.Id(), iit.path, OperationNext, len(value))
+	return value, err
+}
+
+func (iit *InstrumentedIterator) Key() []byte {
+	return iit.it.Key()
+}
+
+func (iit *InstrumentedIterator) localKey() []byte {
+	return iteratorLocalKey(iit.it)
+}
+
+func (iit *InstrumentedIterator) Next() bool {
+	start := time.Now()
+	valid := iit.it.Next()
+	iit.db.metrics.record(iit.db.Id(), iit.path, OperationNext, start, 0, nil)
+	return valid
+}
+
+func (iit *InstrumentedIterator) Seek(key []byte) bool {
+	start := time.Now()
+	valid := iit.it.Seek(key)
+	iit.db.metrics.record(iit.db.Id(), iit.path, OperationSeek, start, 0, nil)
+	return valid
+}
+
+func (iit *InstrumentedIterator) Close() {
+	iit.it.Close()
+}
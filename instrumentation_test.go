@@ -0,0 +1,72 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+// TestInstrumentedDatabase runs the same operations on Bolt and Badger with shared metrics,
+// and checks they are broken down by backend and context path.
+func TestInstrumentedDatabase(t *testing.T) {
+	require := require.New(t)
+
+	metrics := NewDatabaseMetrics()
+	boltDb := newTestBoltDatabase("boltdb-instrumented", t)
+	defer boltDb.Erase()
+	defer boltDb.Close()
+	badgerDb := newTestBadgerDatabase("badgerdb-instrumented", t)
+	defer badgerDb.Erase()
+	defer badgerDb.Close()
+
+	for _, raw := range []Database{boltDb, badgerDb} {
+		db := NewInstrumentedDatabase(raw, metrics)
+		ctx := db.GetContext([]byte("blocks"))
+		nestedCtx := ctx.NestContext([]byte("headers"))
+		require.NoError(db.Update(ctx, func(tx Transaction, ctx Context) error {
+			for _, key := range []string{"a", "b", "c"} {
+				if err := tx.Set([]byte(key), []byte("value"), ctx); err != nil {
+					return err
+				}
+			}
+			return tx.Set([]byte("a"), []byte("value"), nestedCtx)
+		}))
+		require.NoError(db.View(ctx, func(tx Transaction, ctx Context) error {
+			// A missing key isn't counted as an error.
+			if _, _, err := getResult(tx.Get([]byte("missing"), ctx)); err != nil {
+				return err
+			}
+			it, err := tx.GetIterator(nestedCtx)
+			require.NoError(err)
+			defer it.Close()
+			require.True(it.Seek([]byte("a")))
+			_, err = it.Value()
+			return err
+		}))
+	}
+
+	found := make(map[operationMetricsKey]*OperationMetrics)
+	for _, operation := range metrics.Snapshot() {
+		found[operationMetricsKey{operation.Backend, string(encodeContextPath(operation.Path)), operation.Operation}] = operation
+	}
+	for _, backend := range []DatabaseId{BOLTDB, BADGERDB} {
+		blocks := string(encodeContextPath([][]byte{[]byte("blocks")}))
+		headers := string(encodeContextPath([][]byte{[]byte("blocks"), []byte("headers")}))
+
+		set := found[operationMetricsKey{backend, blocks, OperationSet}]
+		require.NotNil(set)
+		require.Equal(uint64(3), set.Count)
+		require.Equal(uint64(3*len("avalue")), set.Bytes)
+		var latencyCount uint64
+		for _, count := range set.LatencyCounts {
+			latencyCount += count
+		}
+		require.Equal(set.Count, latencyCount)
+
+		require.Equal(uint64(1), found[operationMetricsKey{backend, headers, OperationSet}].Count)
+		require.Equal(uint64(1), found[operationMetricsKey{backend, blocks, OperationUpdate}].Count)
+		require.Equal(uint64(1), found[operationMetricsKey{backend, blocks, OperationView}].Count)
+		require.Zero(found[operationMetricsKey{backend, blocks, OperationGet}].Errors)
+		require.Equal(uint64(len("value")), found[operationMetricsKey{backend, headers, OperationNext}].Bytes)
+		require.Equal(uint64(1), found[operationMetricsKey{backend, headers, OperationSeek}].Count)
+	}
+}
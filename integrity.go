@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+)
+
+const (
+	// maxIntegrityIssues bounds the issues a report keeps. A badly damaged file can
+	// produce an issue for every page.
+	maxIntegrityIssues = 1000
+)
+
+type IntegrityIssue struct {
+	// Path and Key locate a corrupted value, and are nil for issues with the file itself.
+	Path [][]byte
+	Key  []byte
+	Err  error
+}
+
+func (issue IntegrityIssue) String() string {
+	if issue.Key == nil {
+		return issue.Err.Error()
+	}
+	return fmt.Sprintf("%q/%x: %v", issue.Path, issue.Key, issue.Err)
+}
+
+type IntegrityReport struct {
+	// Physical is set if the backend's own structures were checked.
+	Physical bool
+	// Logical is set if every value was checked against the checksum it was written with.
+	Logical bool
+	// Contexts and Values are the number of contexts and values checked by the logical check.
+	Contexts int
+	Values   uint64
+	// Issues are the first maxIntegrityIssues problems found, out of TotalIssues.
+	Issues      []IntegrityIssue
+	TotalIssues uint64
+}
+
+// OK is true if no problem was found. It says nothing about what wasn't checked.
+func (report *IntegrityReport) OK() bool {
+	return report.TotalIssues == 0
+}
+
+func (report *IntegrityReport) addIssue(path [][]byte, key []byte, err error) {
+	report.TotalIssues++
+	if len(report.Issues) < maxIntegrityIssues {
+		report.Issues = append(report.Issues, IntegrityIssue{Path: path, Key: key, Err: err})
+	}
+}
+
+// integrityChecker is implemented by databases that can check their integrity, and by
+// wrappers that pass the check on to the database they wrap.
+type integrityChecker interface {
+	checkIntegrity(report *IntegrityReport) error
+}
+
+// Verify checks the integrity of db, for instance after an unclean shutdown. The backend
+// checks its own structures: Bolt checks its pages with Tx.Check, and Badger checks the
+// checksums of its tables and reads every value from the value log. If db is a
+// ChecksummedDatabase, or wraps one, every value is also checked against the checksum
+// it was written with.
+//
+// Problems found are collected in the report, and an error is only returned if the check
+// couldn't run. Verify reads the whole database and runs alongside other transactions.
+func Verify(db Database) (*IntegrityReport, error) {
+	report := &IntegrityReport{}
+	if err := checkWrappedIntegrity(db, report); err != nil {
+		return report, errors.Wrapf(err, "Verify:")
+	}
+	return report, nil
+}
+
+// checkWrappedIntegrity checks db, for wrappers which pass the check on.
+func checkWrappedIntegrity(db Database, report *IntegrityReport) error {
+	checker, ok := db.(integrityChecker)
+	if !ok {
+		return errors.Errorf("Database %T can't be verified", db)
+	}
+	return checker.checkIntegrity(report)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+// TestVerify checks Bolt and Badger physically and logically, before and after a value is
+// corrupted behind the ChecksummedDatabase's back.
+func TestVerify(t *testing.T) {
+	boltDb := newTestBoltDatabase("boltdb-verify", t)
+	defer boltDb.Erase()
+	defer boltDb.Close()
+	GenericVerifyTest(boltDb, t)
+
+	badgerDb := newTestBadgerDatabase("badgerdb-verify", t)
+	defer badgerDb.Erase()
+	defer badgerDb.Close()
+	GenericVerifyTest(badgerDb, t)
+}
+
+func GenericVerifyTest(raw Database, t *testing.T) {
+	require := require.New(t)
+
+	db := NewChecksummedDatabase(raw)
+	ctx := db.GetContext([]byte("blocks"))
+	nestedCtx := ctx.NestContext([]byte("headers"))
+	require.NoError(db.Update(ctx, func(tx Transaction, ctx Context) error {
+		for _, key := range []string{"a", "b", "c"} {
+			if err := tx.Set([]byte(key), []byte("value "+key), ctx); err != nil {
+				return err
+			}
+		}
+		return tx.Set([]byte("a"), []byte{}, nestedCtx)
+	}))
+
+	report, err := Verify(raw)
+	require.NoError(err)
+	require.True(report.OK())
+	require.True(report.Physical)
+	require.False(report.Logical)
+
+	report, err = Verify(db)
+	require.NoError(err)
+	require.True(report.OK(), "%v", report.Issues)
+	require.True(report.Logical)
+	require.Equal(2, report.Contexts)
+	require.Equal(uint64(4), report.Values)
+
+	// Flip a bit of a stored value.
+	require.NoError(raw.Update(ctx, func(tx Transaction, ctx Context) error {
+		stored, err := tx.Get([]byte("b"), ctx)
+		if err != nil {
+			return err
+		}
+		stored = append([]byte{}, stored...)
+		stored[len(stored)-1] ^= 1
+		return tx.Set([]byte("b"), stored, ctx)
+	}))
+	report, err = Verify(db)
+	require.NoError(err)
+	require.False(report.OK())
+	require.Len(report.Issues, 1)
+	require.Equal(ctx.Path(), report.Issues[0].Path)
+	require.Equal([]byte("b"), report.Issues[0].Key)
+
+	require.NoError(db.View(ctx, func(tx Transaction, ctx Context) error {
+		_, err := tx.Get([]byte("b"), ctx)
+		require.True(errors.Is(err, ErrValueChecksumMismatch))
+		value, err := tx.Get([]byte("a"), nestedCtx)
+		require.NoError(err)
+		require.Empty(value)
+		return nil
+	}))
+}
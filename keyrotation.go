@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/pkg/errors"
+	"sync"
+	"sync/atomic"
+)
+
+type KeyRotationOptions struct {
+	// MaxBatchBytes is the budget of stored key and value bytes read by a single
+	// transaction, including the values that don't need to be rewritten. Zero or less
+	// takes the default.
+	MaxBatchBytes int
+	// ConflictRetry configures the retries of a batch that conflicts with a concurrent
+	// write. The job fails once a batch conflicts MaxAttempts times.
+	ConflictRetry ConflictRetryOptions
+	// OnProgress, if set, is called after every committed batch.
+	OnProgress func(KeyRotationProgress)
+}
+
+func DefaultKeyRotationOptions() KeyRotationOptions {
+	return KeyRotationOptions{
+		MaxBatchBytes: DefaultBulkUpdateBatchBytes,
+		ConflictRetry: DefaultConflictRetryOptions(),
+	}
+}
+
+type KeyRotationProgress struct {
+	// Rewritten is the number of values re-encrypted under the active key version.
+	Rewritten uint64
+	// Current is the number of values that were already under the active key version.
+	// With hashed keys, a rewritten value moves to a new stored key, and may be visited
+	// again and counted here.
+	Current uint64
+	// Unreadable is the number of values that could not be decrypted and were left as
+	// they are.
+	Unreadable uint64
+	// Batches is the number of transactions committed so far.
+	Batches int
+	// Done is set once the whole context, and every context nested in it, has been
+	// visited.
+	Done bool
+}
+
+// ==========================
+// KeyRotationJob
+// ==========================
+
+// KeyRotationJob re-encrypts every value of a context, and of the contexts nested in it,
+// under the active key version, in transactions of bounded size. Nested contexts are
+// visited once their parent is done, and the job fails if the database can't list them. Each transaction reads the values it rewrites, so
+// writes made concurrently are never overwritten with older data, and reads keep
+// working throughout since values of any configured key version can be decrypted.
+// Once a job is done, the previous key versions can be dropped from the
+// EncryptionOptions.
+//
+// A job keeps no checkpoint. A stopped or failed job is resumed by starting a new one,
+// which skips the values that are already under the active key version.
+type KeyRotationJob struct {
+	db   *EncryptedDatabase
+	ctx  Context
+	opts KeyRotationOptions
+	// retry reruns the batches that conflict.
+	retry *conflictRetrier
+
+	stopped atomic.Bool
+	done    chan struct{}
+
+	progressLock sync.Mutex
+	progress     KeyRotationProgress
+	err          error
+}
+
+// StartKeyRotation starts a KeyRotationJob on ctx in the background.
+func (edb *EncryptedDatabase) StartKeyRotation(ctx Context, opts KeyRotationOptions) *KeyRotationJob {
+	if opts.MaxBatchBytes <= 0 {
+		opts.MaxBatchBytes = DefaultKeyRotationOptions().MaxBatchBytes
+	}
+	job := &KeyRotationJob{
+		db:    edb,
+		ctx:   ctx,
+		opts:  opts,
+		retry: newConflictRetrier(opts.ConflictRetry),
+		done:  make(chan struct{}),
+	}
+	go job.run()
+	return job
+}
+
+func (job *KeyRotationJob) Progress() KeyRotationProgress {
+	job.progressLock.Lock()
+	defer job.progressLock.Unlock()
+
+	return job.progress
+}
+
+// Stop makes the job return after its current batch.
+func (job *KeyRotationJob) Stop() {
+	job.stopped.Store(true)
+}
+
+// Wait blocks until the job is done or stopped.
+func (job *KeyRotationJob) Wait() (KeyRotationProgress, error) {
+	<-job.done
+
+	job.progressLock.Lock()
+	defer job.progressLock.Unlock()
+	return job.progress, job.err
+}
+
+func (job *KeyRotationJob) run() {
+	defer close(job.done)
+
+	// pending are the contexts left to visit, starting with the one being visited.
+	pending := []Context{job.ctx}
+	// start is the first stored key the next batch visits, nil for the first batch of
+	// a context.
+	var start []byte
+	for !job.stopped.Load() {
+		ctx := pending[0]
+		// A batch conflicts when a concurrent transaction wrote one of its values, and
+		// is retried with the new data.
+		var batch KeyRotationProgress
+		var next []byte
+		err := job.retry.run(context.Background(), ctx.Path(), func() error {
+			var err error
+			batch, next, err = job.rotateBatch(ctx, start)
+			return err
+		})
+		if err != nil {
+			job.fail(errors.Wrapf(err, "KeyRotationJob: Problem rotating context %q", ctx.Path()))
+			return
+		}
+		if next == nil {
+			ids, err := listNestedContextIds(job.db.db, ctx)
+			if err != nil {
+				job.fail(errors.Wrapf(err, "KeyRotationJob: Problem listing the contexts nested in %q", ctx.Path()))
+				return
+			}
+			pending = pending[1:]
+			for _, id := range ids {
+				pending = append(pending, ctx.NestContext(id))
+			}
+		}
+
+		job.progressLock.Lock()
+		job.progress.Rewritten += batch.Rewritten
+		job.progress.Current += batch.Current
+		job.progress.Unreadable += batch.Unreadable
+		job.progress.Batches++
+		job.progress.Done = len(pending) == 0
+		progress := job.progress
+		job.progressLock.Unlock()
+
+		if job.opts.OnProgress != nil {
+			job.opts.OnProgress(progress)
+		}
+		if progress.Done {
+			return
+		}
+		start = next
+	}
+}
+
+func (job *KeyRotationJob) fail(err error) {
+	job.progressLock.Lock()
+	defer job.progressLock.Unlock()
+
+	job.err = err
+}
+
+type keyRotationRewrite struct {
+	storedKey []byte
+	key       []byte
+	value     []byte
+}
+
+// rotateBatch rewrites the values of ctx from start on until the batch is full, and
+// returns the stored key the next batch starts at, or nil if the end of the context was
+// reached.
+func (job *KeyRotationJob) rotateBatch(ctx Context, start []byte) (_batch KeyRotationProgress, _next []byte, _err error) {
+	var batch KeyRotationProgress
+	var next []byte
+	err := job.db.db.Update(ctx, func(tx Transaction, ctx Context) error {
+		batch = KeyRotationProgress{}
+		rewrites, nextKey, err := job.collectBatch(tx, ctx, start, &batch)
+		if err != nil {
+			return err
+		}
+		next = nextKey
+
+		for _, rewrite := range rewrites {
+			storedKey, sealed, err := job.db.seal(ctx, rewrite.key, rewrite.value)
+			if err != nil {
+				return err
+			}
+			// With hashed keys, the stored key changes along with the key version.
+			if !bytes.Equal(storedKey, rewrite.storedKey) {
+				if err := tx.Delete(rewrite.storedKey, ctx); err != nil {
+					return err
+				}
+			}
+			if err := tx.Set(storedKey, sealed, ctx); err != nil {
+				return err
+			}
+		}
+		batch.Rewritten = uint64(len(rewrites))
+		return nil
+	})
+	return batch, next, err
+}
+
+// collectBatch decrypts the values to rewrite. The iterator is closed before anything
+// is written, since Bolt cursors don't survive writes to their bucket.
+func (job *KeyRotationJob) collectBatch(tx Transaction, ctx Context, start []byte,
+	batch *KeyRotationProgress) (_rewrites []*keyRotationRewrite, _next []byte, _err error) {
+
+	it, err := tx.GetIterator(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer it.Close()
+
+	var rewrites []*keyRotationRewrite
+	batchBytes := 0
+	valid := it.Seek(start)
+	for ; valid && batchBytes < job.opts.MaxBatchBytes; valid = it.Next() {
+		sealed, err := it.Value()
+		if err != nil {
+			return nil, nil, err
+		}
+		// Nested Bolt buckets show up with a nil value, and are visited once ctx is done.
+		if sealed == nil {
+			continue
+		}
+		// Values that are skipped count too, as the transaction still reads them.
+		batchBytes += len(it.Key()) + len(sealed)
+		if keyVersion, err := encryptedValueKeyVersion(sealed); err == nil && keyVersion == job.db.opts.KeyVersion {
+			batch.Current++
+			continue
+		}
+
+		storedKey := append([]byte{}, iteratorLocalKey(it)...)
+		key, value, err := job.db.open(ctx, storedKey, sealed)
+		if err != nil {
+			batch.Unreadable++
+			continue
+		}
+		rewrites = append(rewrites, &keyRotationRewrite{storedKey: storedKey, key: key, value: value})
+	}
+
+	if !valid {
+		return rewrites, nil, nil
+	}
+	return rewrites, append([]byte{}, iteratorLocalKey(it)...), nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+// TestKeyRotation rotates a context written under key version 0 to key version 1 on both
+// backends, with hashed keys on Bolt, along with a context nested two levels below it.
+func TestKeyRotation(t *testing.T) {
+	boltDb := newTestBoltDatabase("boltdb-keyrotation", t)
+	defer boltDb.Erase()
+	defer boltDb.Close()
+	GenericKeyRotationTest(boltDb, true, t)
+
+	badgerDb := newTestBadgerDatabase("badgerdb-keyrotation", t)
+	defer badgerDb.Erase()
+	defer badgerDb.Close()
+	GenericKeyRotationTest(badgerDb, false, t)
+}
+
+func GenericKeyRotationTest(raw Database, hashKeys bool, t *testing.T) {
+	require := require.New(t)
+
+	oldKey, err := RandomBytes(EncryptionKeySize)
+	require.NoError(err)
+	newKey, err := RandomBytes(EncryptionKeySize)
+	require.NoError(err)
+	oldDb, err := NewEncryptedDatabase(raw, EncryptionOptions{MasterKey: oldKey, HashKeys: hashKeys})
+	require.NoError(err)
+	db, err := NewEncryptedDatabase(raw, EncryptionOptions{
+		MasterKey:    newKey,
+		KeyVersion:   1,
+		PreviousKeys: map[uint32][]byte{0: oldKey},
+		HashKeys:     hashKeys,
+	})
+	require.NoError(err)
+	newDb, err := NewEncryptedDatabase(raw, EncryptionOptions{MasterKey: newKey, KeyVersion: 1, HashKeys: hashKeys})
+	require.NoError(err)
+
+	ctx := db.GetContext([]byte("accounts"))
+	var keys [][]byte
+	for ii := 0; ii < 100; ii++ {
+		keys = append(keys, []byte{'k', byte(ii)})
+	}
+	require.NoError(oldDb.Update(ctx, func(tx Transaction, ctx Context) error {
+		for _, key := range keys {
+			if err := tx.Set(key, key, ctx); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	// Only the innermost nested context is written to.
+	nestedCtx := ctx.NestContext([]byte("history")).NestContext([]byte("2026"))
+	require.NoError(oldDb.Update(nestedCtx, func(tx Transaction, ctx Context) error {
+		for _, key := range keys[:10] {
+			if err := tx.Set(key, key, ctx); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	// Overwrite one key under the new version before the rotation starts.
+	require.NoError(db.Update(ctx, func(tx Transaction, ctx Context) error {
+		return tx.Set(keys[0], []byte("updated"), ctx)
+	}))
+
+	requireValues := func(db *EncryptedDatabase) {
+		require.NoError(db.View(ctx, func(tx Transaction, ctx Context) error {
+			values, found, err := tx.MultiGet(keys, ctx)
+			require.NoError(err)
+			require.Equal([]byte("updated"), values[0])
+			for ii := 1; ii < len(keys); ii++ {
+				require.True(found[ii])
+				require.Equal(keys[ii], values[ii])
+			}
+			value, err := tx.Get(keys[1], ctx)
+			require.NoError(err)
+			require.Equal(keys[1], value)
+
+			values, found, err = tx.MultiGet(keys[:10], nestedCtx)
+			require.NoError(err)
+			for ii := range values {
+				require.True(found[ii])
+				require.Equal(keys[ii], values[ii])
+			}
+			return nil
+		}))
+	}
+	// Mixed key versions are readable during the rotation.
+	requireValues(db)
+
+	opts := DefaultKeyRotationOptions()
+	opts.MaxBatchBytes = 1000
+	var reports int
+	opts.OnProgress = func(KeyRotationProgress) {
+		reports++
+	}
+	progress, err := db.StartKeyRotation(ctx, opts).Wait()
+	require.NoError(err)
+	require.True(progress.Done)
+	require.Equal(uint64(109), progress.Rewritten)
+	require.Zero(progress.Unreadable)
+	require.Greater(progress.Batches, 1)
+	require.Equal(progress.Batches, reports)
+
+	// With zero options, the batch size takes its default, and nothing is left to rewrite.
+	progress, err = db.StartKeyRotation(ctx, KeyRotationOptions{}).Wait()
+	require.NoError(err)
+	require.True(progress.Done)
+	require.Zero(progress.Rewritten)
+	require.GreaterOrEqual(progress.Current, uint64(109))
+
+	// The previous key is no longer needed.
+	requireValues(newDb)
+	require.NoError(oldDb.View(ctx, func(tx Transaction, ctx Context) error {
+		value, err := tx.Get(keys[1], ctx)
+		if hashKeys {
+			// The key moved to its hash under the new key version.
+			require.NoError(err)
+			require.Nil(value)
+		} else {
+			require.True(errors.Is(err, ErrEncryptionKeyUnknown))
+		}
+		return nil
+	}))
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"io"
+	"math"
+)
+
+const (
+	// DefaultLargeValueChunkSize is 1 MB.
+	DefaultLargeValueChunkSize = 1 << 20
+
+	// DefaultLargeValueChunksPerTxn bounds a write transaction to 8 chunks.
+	DefaultLargeValueChunksPerTxn = 8
+
+	largeValueManifestSize = 28
+)
+
+var (
+	largeValueManifestContextId = []byte("__lv_manifest")
+	largeValueChunkContextId    = []byte("__lv_chunks")
+
+	ErrLargeValueNotFound = errors.New("LargeValueStore: value not found")
+)
+
+// ==========================
+// LargeValueStore
+// ==========================
+
+type LargeValueOptions struct {
+	// ChunkSize is the size in bytes of each chunk a value is split into.
+	ChunkSize int
+	// ChunksPerTxn is the number of chunks written in a single transaction. Memory used
+	// by a write is bounded by ChunkSize * ChunksPerTxn regardless of the value size.
+	ChunksPerTxn int
+}
+
+func DefaultLargeValueOptions() LargeValueOptions {
+	return LargeValueOptions{
+		ChunkSize:    DefaultLargeValueChunkSize,
+		ChunksPerTxn: DefaultLargeValueChunksPerTxn,
+	}
+}
+
+// LargeValueStore stores values that are too large to be held in memory as a single
+// byte slice. A value is split into chunks stored under a nested chunk context, and a
+// manifest stored under a nested manifest context points at the chunks making up the
+// current version of the value.
+//
+// Every write goes to a fresh generation of chunks, and the manifest is only swapped
+// once all chunks are committed, so readers observe either the old or the new value.
+// The chunks of the replaced generation are removed after the swap. If the process
+// dies mid-write, the chunks of the unfinished generation are left behind unreferenced.
+type LargeValueStore struct {
+	db   Database
+	opts LargeValueOptions
+}
+
+func NewLargeValueStore(db Database, opts LargeValueOptions) *LargeValueStore {
+	return &LargeValueStore{
+		db:   db,
+		opts: opts,
+	}
+}
+
+// Write stores everything read from r under key, atomically replacing any existing value.
+// It returns the number of bytes stored. Options that are zero or out of range are
+// rejected before anything is written.
+func (lvs *LargeValueStore) Write(ctx Context, key []byte, r io.Reader) (int64, error) {
+	if lvs.opts.ChunkSize <= 0 || lvs.opts.ChunkSize > math.MaxUint32 {
+		return 0, errors.Errorf("LargeValueStore.Write: Invalid chunk size %d", lvs.opts.ChunkSize)
+	}
+	if lvs.opts.ChunksPerTxn <= 0 {
+		return 0, errors.Errorf("LargeValueStore.Write: Invalid chunks per transaction %d", lvs.opts.ChunksPerTxn)
+	}
+	generationBytes, err := RandomBytes(8)
+	if err != nil {
+		return 0, errors.Wrapf(err, "LargeValueStore.Write: Problem generating generation")
+	}
+	manifest := &LargeValueManifest{
+		Generation: binary.BigEndian.Uint64(generationBytes),
+		ChunkSize:  uint32(lvs.opts.ChunkSize),
+	}
+
+	chunkCtx := ctx.NestContext(largeValueChunkContextId)
+	buffers := make([][]byte, lvs.opts.ChunksPerTxn)
+	for ii := range buffers {
+		buffers[ii] = make([]byte, lvs.opts.ChunkSize)
+	}
+
+	eof := false
+	for !eof {
+		// Fill the buffers before opening the transaction, so the transaction function
+		// never consumes the reader and stays safe to re-run.
+		var chunks [][]byte
+		for ii := 0; ii < len(buffers) && !eof; ii++ {
+			n, err := io.ReadFull(r, buffers[ii])
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				eof = true
+			} else if err != nil {
+				lvs.deleteChunks(ctx, key, manifest.Generation, manifest.NumChunks)
+				return 0, errors.Wrapf(err, "LargeValueStore.Write: Problem reading value")
+			}
+			if n > 0 {
+				chunks = append(chunks, buffers[ii][:n])
+			}
+		}
+		if len(chunks) == 0 {
+			break
+		}
+
+		firstChunk := manifest.NumChunks
+		err = lvs.db.Update(chunkCtx, func(tx Transaction, chunkCtx Context) error {
+			for ii, chunk := range chunks {
+				chunkKey := largeValueChunkKey(key, manifest.Generation, firstChunk+uint64(ii))
+				if err := tx.Set(chunkKey, chunk, chunkCtx); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			lvs.deleteChunks(ctx, key, manifest.Generation, manifest.NumChunks)
+			return 0, errors.Wrapf(err, "LargeValueStore.Write: Problem writing chunks")
+		}
+		for _, chunk := range chunks {
+			manifest.NumChunks++
+			manifest.Size += uint64(len(chunk))
+		}
+	}
+
+	// Swap the manifest to point at the new generation.
+	var oldManifest *LargeValueManifest
+	manifestCtx := ctx.NestContext(largeValueManifestContextId)
+	err = lvs.db.Update(manifestCtx, func(tx Transaction, manifestCtx Context) error {
+		var err error
+		if oldManifest, err = getLargeValueManifest(tx, key, manifestCtx); err != nil {
+			return err
+		}
+		return tx.Set(key, manifest.Encode(), manifestCtx)
+	})
+	if err != nil {
+		lvs.deleteChunks(ctx, key, manifest.Generation, manifest.NumChunks)
+		return 0, errors.Wrapf(err, "LargeValueStore.Write: Problem writing manifest")
+	}
+
+	if oldManifest != nil {
+		if err := lvs.deleteChunks(ctx, key, oldManifest.Generation, oldManifest.NumChunks); err != nil {
+			return 0, errors.Wrapf(err, "LargeValueStore.Write: Problem removing replaced chunks")
+		}
+	}
+	return int64(manifest.Size), nil
+}
+
+// Read streams the value stored under key to w, and returns the number of bytes written.
+// The whole value is read from a single consistent view of the database.
+func (lvs *LargeValueStore) Read(ctx Context, key []byte, w io.Writer) (int64, error) {
+	var written int64
+	err := lvs.db.View(ctx, func(tx Transaction, ctx Context) error {
+		manifest, err := getLargeValueManifest(tx, key, ctx.NestContext(largeValueManifestContextId))
+		if err != nil {
+			return err
+		}
+		if manifest == nil {
+			return ErrLargeValueNotFound
+		}
+
+		chunkCtx := ctx.NestContext(largeValueChunkContextId)
+		for ii := uint64(0); ii < manifest.NumChunks; ii++ {
+			chunk, err := tx.Get(largeValueChunkKey(key, manifest.Generation, ii), chunkCtx)
+			if err != nil || chunk == nil {
+				return errors.Errorf("Missing chunk %v of %v for generation %v", ii, manifest.NumChunks, manifest.Generation)
+			}
+			n, err := w.Write(chunk)
+			written += int64(n)
+			if err != nil {
+				return err
+			}
+		}
+		if uint64(written) != manifest.Size {
+			return errors.Errorf("Read %v bytes but manifest has size %v", written, manifest.Size)
+		}
+		return nil
+	})
+	if err != nil {
+		return written, errors.Wrapf(err, "LargeValueStore.Read:")
+	}
+	return written, nil
+}
+
+// Delete removes the value stored under key. Deleting a missing value is not an error.
+func (lvs *LargeValueStore) Delete(ctx Context, key []byte) error {
+	var manifest *LargeValueManifest
+	manifestCtx := ctx.NestContext(largeValueManifestContextId)
+	err := lvs.db.Update(manifestCtx, func(tx Transaction, manifestCtx Context) error {
+		var err error
+		if manifest, err = getLargeValueManifest(tx, key, manifestCtx); err != nil || manifest == nil {
+			return err
+		}
+		return tx.Delete(key, manifestCtx)
+	})
+	if err != nil {
+		return errors.Wrapf(err, "LargeValueStore.Delete:")
+	}
+	if manifest == nil {
+		return nil
+	}
+	return errors.Wrapf(lvs.deleteChunks(ctx, key, manifest.Generation, manifest.NumChunks), "LargeValueStore.Delete:")
+}
+
+// Size returns the size in bytes of the value stored under key.
+func (lvs *LargeValueStore) Size(ctx Context, key []byte) (int64, error) {
+	var manifest *LargeValueManifest
+	manifestCtx := ctx.NestContext(largeValueManifestContextId)
+	err := lvs.db.View(manifestCtx, func(tx Transaction, manifestCtx Context) error {
+		var err error
+		manifest, err = getLargeValueManifest(tx, key, manifestCtx)
+		return err
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "LargeValueStore.Size:")
+	}
+	if manifest == nil {
+		return 0, ErrLargeValueNotFound
+	}
+	return int64(manifest.Size), nil
+}
+
+func (lvs *LargeValueStore) deleteChunks(ctx Context, key []byte, generation uint64, numChunks uint64) error {
+	chunkCtx := ctx.NestContext(largeValueChunkContextId)
+	for start := uint64(0); start < numChunks; start += uint64(lvs.opts.ChunksPerTxn) {
+		err := lvs.db.Update(chunkCtx, func(tx Transaction, chunkCtx Context) error {
+			for ii := start; ii < numChunks && ii < start+uint64(lvs.opts.ChunksPerTxn); ii++ {
+				if err := tx.Delete(largeValueChunkKey(key, generation, ii), chunkCtx); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ==========================
+// LargeValueManifest
+// ==========================
+
+type LargeValueManifest struct {
+	Generation uint64
+	Size       uint64
+	ChunkSize  uint32
+	NumChunks  uint64
+}
+
+func (lvm *LargeValueManifest) Encode() []byte {
+	data := make([]byte, largeValueManifestSize)
+	binary.BigEndian.PutUint64(data[0:8], lvm.Generation)
+	binary.BigEndian.PutUint64(data[8:16], lvm.Size)
+	binary.BigEndian.PutUint32(data[16:20], lvm.ChunkSize)
+	binary.BigEndian.PutUint64(data[20:28], lvm.NumChunks)
+	return data
+}
+
+func DecodeLargeValueManifest(data []byte) (*LargeValueManifest, error) {
+	if len(data) != largeValueManifestSize {
+		return nil, errors.Errorf("DecodeLargeValueManifest: Invalid manifest length %v", len(data))
+	}
+	return &LargeValueManifest{
+		Generation: binary.BigEndian.Uint64(data[0:8]),
+		Size:       binary.BigEndian.Uint64(data[8:16]),
+		ChunkSize:  binary.BigEndian.Uint32(data[16:20]),
+		NumChunks:  binary.BigEndian.Uint64(data[20:28]),
+	}, nil
+}
+
+func getLargeValueManifest(tx Transaction, key []byte, manifestCtx Context) (*LargeValueManifest, error) {
+	values, found, err := tx.MultiGet([][]byte{key}, manifestCtx)
+	if err != nil {
+		return nil, err
+	}
+	if !found[0] {
+		return nil, nil
+	}
+	return DecodeLargeValueManifest(values[0])
+}
+
+// largeValueChunkKey is the key followed by the generation and the chunk index. The
+// suffix has a fixed length, so chunk keys of different keys can never collide.
+func largeValueChunkKey(key []byte, generation uint64, index uint64) []byte {
+	chunkKey := make([]byte, len(key)+16)
+	copy(chunkKey, key)
+	binary.BigEndian.PutUint64(chunkKey[len(key):], generation)
+	binary.BigEndian.PutUint64(chunkKey[len(key)+8:], index)
+	return chunkKey
+}
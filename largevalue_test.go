@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"os"
+	"testing"
+)
+
+// TestLargeValueStore writes, replaces and deletes a multi-chunk value on both backends.
+func TestLargeValueStore(t *testing.T) {
+	require := require.New(t)
+
+	boltDir, err := os.MkdirTemp("", "boltdb-largevalue")
+	require.NoError(err)
+	boltDb := NewBoltDatabase(boltDir)
+	require.NoError(boltDb.Setup())
+	defer boltDb.Erase()
+	defer boltDb.Close()
+	GenericLargeValueTest(boltDb, boltDb.GetContext([]byte("TestBucket")), t)
+
+	badgerDir, err := os.MkdirTemp("", "badgerdb-largevalue")
+	require.NoError(err)
+	badgerDb := NewBadgerDatabase(DefaultBadgerOptions(badgerDir))
+	require.NoError(badgerDb.Setup())
+	defer badgerDb.Erase()
+	defer badgerDb.Close()
+	GenericLargeValueTest(badgerDb, badgerDb.GetContext([]byte("TestPrefix")), t)
+}
+
+func GenericLargeValueTest(db Database, ctx Context, t *testing.T) {
+	require := require.New(t)
+
+	store := NewLargeValueStore(db, LargeValueOptions{ChunkSize: 64 << 10, ChunksPerTxn: 4})
+	key := []byte("blob")
+
+	// The value spans several transactions and ends with a partial chunk.
+	value, err := RandomBytes(5<<20 + 123)
+	require.NoError(err)
+	n, err := store.Write(ctx, key, bytes.NewReader(value))
+	require.NoError(err)
+	require.Equal(int64(len(value)), n)
+
+	var out bytes.Buffer
+	n, err = store.Read(ctx, key, &out)
+	require.NoError(err)
+	require.Equal(int64(len(value)), n)
+	require.True(bytes.Equal(value, out.Bytes()))
+
+	// Replace with a smaller value.
+	replacement, err := RandomBytes(100 << 10)
+	require.NoError(err)
+	_, err = store.Write(ctx, key, bytes.NewReader(replacement))
+	require.NoError(err)
+	size, err := store.Size(ctx, key)
+	require.NoError(err)
+	require.Equal(int64(len(replacement)), size)
+	out.Reset()
+	_, err = store.Read(ctx, key, &out)
+	require.NoError(err)
+	require.True(bytes.Equal(replacement, out.Bytes()))
+
+	// Invalid options are rejected, and leave the stored value alone.
+	for _, opts := range []LargeValueOptions{{}, {ChunkSize: 64 << 10}, {ChunksPerTxn: 4}, {ChunkSize: -1, ChunksPerTxn: 4}} {
+		n, err := NewLargeValueStore(db, opts).Write(ctx, key, bytes.NewReader(value))
+		require.Error(err)
+		require.Zero(n)
+	}
+	size, err = store.Size(ctx, key)
+	require.NoError(err)
+	require.Equal(int64(len(replacement)), size)
+
+	require.NoError(store.Delete(ctx, key))
+	_, err = store.Read(ctx, key, &out)
+	require.True(errors.Is(err, ErrLargeValueNotFound))
+	require.NoError(store.Delete(ctx, key))
+}
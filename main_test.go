@@ -19,6 +19,10 @@ type TestConfig struct {
 	BatchItemsRetrieved int
 	// BatchItemsIterated is the number of items iterated over in each batch as part of the experiment.
 	BatchItemsIterated int
+	// UseWriteBatch writes each batch through a WriteBatch instead of an Update transaction.
+	UseWriteBatch bool
+	// UseMultiGet retrieves the items of each batch with a single MultiGet instead of a Get per item.
+	UseMultiGet bool
 }
 
 // TestBolt_5GB_Experiment_10MB_Batch is a BoltDB test in which we write 5GB of data to the database.
@@ -135,7 +139,7 @@ func TestBadger_Default_5GB_Experiment_10MB_Batch(t *testing.T) {
 	require.NoError(err)
 
 	opts := DefaultBadgerOptions(dir)
-	db := NewBadgerDatabase(opts, false)
+	db := NewBadgerDatabase(opts)
 	require.NoError(db.Setup())
 	defer db.Erase()
 	defer db.Close()
@@ -163,7 +167,7 @@ func TestBadger_Performance_5GB_Experiment_10MB_Batch(t *testing.T) {
 	require.NoError(err)
 
 	opts := PerformanceBadgerOptions(dir)
-	db := NewBadgerDatabase(opts, false)
+	db := NewBadgerDatabase(opts)
 	require.NoError(db.Setup())
 	defer db.Erase()
 	defer db.Close()
@@ -191,7 +195,7 @@ func TestBadger_Performance_5GB_Experiment_25MB_Batch(t *testing.T) {
 	require.NoError(err)
 
 	opts := PerformanceBadgerOptions(dir)
-	db := NewBadgerDatabase(opts, false)
+	db := NewBadgerDatabase(opts)
 	require.NoError(db.Setup())
 	defer db.Erase()
 	defer db.Close()
@@ -219,7 +223,7 @@ func TestBadger_Performance_5GB_Experiment_100MB_Batch(t *testing.T) {
 	require.NoError(err)
 
 	opts := PerformanceBadgerOptions(dir)
-	db := NewBadgerDatabase(opts, false)
+	db := NewBadgerDatabase(opts)
 	require.NoError(db.Setup())
 	defer db.Erase()
 	defer db.Close()
@@ -241,13 +245,14 @@ func TestBadger_Default_WriteBatch_5GB_Experiment_10MB_Batch(t *testing.T) {
 		BatchItemsRemoved:         20,
 		BatchItemsRetrieved:       20,
 		BatchItemsIterated:        20,
+		UseWriteBatch:             true,
 	}
 	dir, err := os.MkdirTemp("", "badgerdb-default-writebatch-5gb-10mb")
 	t.Logf("BadgerDB directory: %s\nIt should be automatically removed at the end of the test", dir)
 	require.NoError(err)
 
 	opts := DefaultBadgerOptions(dir)
-	db := NewBadgerDatabase(opts, true)
+	db := NewBadgerDatabase(opts)
 	require.NoError(db.Setup())
 	defer db.Erase()
 	defer db.Close()
@@ -269,13 +274,14 @@ func TestBadger_Default_WriteBatch_5GB_Experiment_25MB_Batch(t *testing.T) {
 		BatchItemsRemoved:         20,
 		BatchItemsRetrieved:       20,
 		BatchItemsIterated:        20,
+		UseWriteBatch:             true,
 	}
 	dir, err := os.MkdirTemp("", "badgerdb-default-writebatch-5gb-25mb")
 	t.Logf("BadgerDB directory: %s\nIt should be automatically removed at the end of the test", dir)
 	require.NoError(err)
 
 	opts := DefaultBadgerOptions(dir)
-	db := NewBadgerDatabase(opts, true)
+	db := NewBadgerDatabase(opts)
 	require.NoError(db.Setup())
 	defer db.Erase()
 	defer db.Close()
@@ -297,13 +303,14 @@ func TestBadger_Default_WriteBatch_5GB_Experiment_100MB_Batch(t *testing.T) {
 		BatchItemsRemoved:         20,
 		BatchItemsRetrieved:       20,
 		BatchItemsIterated:        20,
+		UseWriteBatch:             true,
 	}
 	dir, err := os.MkdirTemp("", "badgerdb-default-writebatch-5gb-100mb")
 	t.Logf("BadgerDB directory: %s\nIt should be automatically removed at the end of the test", dir)
 	require.NoError(err)
 
 	opts := DefaultBadgerOptions(dir)
-	db := NewBadgerDatabase(opts, true)
+	db := NewBadgerDatabase(opts)
 	require.NoError(db.Setup())
 	defer db.Erase()
 	defer db.Close()
@@ -325,13 +332,14 @@ func TestBadger_Performance_WriteBatch_5GB_Experiment_10MB_Batch(t *testing.T) {
 		BatchItemsRemoved:         20,
 		BatchItemsRetrieved:       20,
 		BatchItemsIterated:        20,
+		UseWriteBatch:             true,
 	}
 	dir, err := os.MkdirTemp("", "badgerdb-performance-writebatch-5gb-10mb")
 	t.Logf("BadgerDB directory: %s\nIt should be automatically removed at the end of the test", dir)
 	require.NoError(err)
 
 	opts := PerformanceBadgerOptions(dir)
-	db := NewBadgerDatabase(opts, true)
+	db := NewBadgerDatabase(opts)
 	require.NoError(db.Setup())
 	defer db.Erase()
 	defer db.Close()
@@ -353,13 +361,14 @@ func TestBadger_Performance_WriteBatch_5GB_Experiment_25MB_Batch(t *testing.T) {
 		BatchItemsRemoved:         20,
 		BatchItemsRetrieved:       20,
 		BatchItemsIterated:        20,
+		UseWriteBatch:             true,
 	}
 	dir, err := os.MkdirTemp("", "badgerdb-performance-writebatch-5gb-25mb")
 	t.Logf("BadgerDB directory: %s\nIt should be automatically removed at the end of the test", dir)
 	require.NoError(err)
 
 	opts := PerformanceBadgerOptions(dir)
-	db := NewBadgerDatabase(opts, true)
+	db := NewBadgerDatabase(opts)
 	require.NoError(db.Setup())
 	defer db.Erase()
 	defer db.Close()
@@ -381,13 +390,14 @@ func TestBadger_Performance_WriteBatch_5GB_Experiment_100MB_Batch(t *testing.T)
 		BatchItemsRemoved:         20,
 		BatchItemsRetrieved:       20,
 		BatchItemsIterated:        20,
+		UseWriteBatch:             true,
 	}
 	dir, err := os.MkdirTemp("", "badgerdb-performance-writebatch-5gb-100mb")
 	t.Logf("BadgerDB directory: %s\nIt should be automatically removed at the end of the test", dir)
 	require.NoError(err)
 
 	opts := PerformanceBadgerOptions(dir)
-	db := NewBadgerDatabase(opts, true)
+	db := NewBadgerDatabase(opts)
 	require.NoError(db.Setup())
 	defer db.Erase()
 	defer db.Close()
@@ -396,6 +406,169 @@ func TestBadger_Performance_WriteBatch_5GB_Experiment_100MB_Batch(t *testing.T)
 	GenericTest(db, badgerCtx, testConfig, t)
 }
 
+// TestBolt_MultiGet_5GB_Experiment_10MB_Batch is a BoltDB test in which we write 5GB of data to the database.
+// In the test, we write data in batches of 10MB, totalling 500 batches. For each batch we perform identical operations
+// as in TestBolt_5GB_Experiment_10MB_Batch, but retrieve the items with a single MultiGet.
+func TestBolt_MultiGet_5GB_Experiment_10MB_Batch(t *testing.T) {
+	require := require.New(t)
+
+	testConfig := &TestConfig{
+		ExperimentNumberOfBatches: 500,
+		BatchSizeBytes:            10000000,
+		BatchSizeItems:            100,
+		BatchItemsRemoved:         20,
+		BatchItemsRetrieved:       20,
+		BatchItemsIterated:        20,
+		UseMultiGet:               true,
+	}
+
+	dir, err := os.MkdirTemp("", "boltdb-multiget-5gb-10mb")
+	t.Logf("BoltDB directory: %s\nIt should be automatically removed at the end of the test", dir)
+	require.NoError(err)
+
+	db := NewBoltDatabase(dir)
+	require.NoError(db.Setup())
+	defer db.Erase()
+	defer db.Close()
+
+	ctx := db.GetContext([]byte("TestBucket"))
+	GenericTest(db, ctx, testConfig, t)
+}
+
+// TestBadger_Default_MultiGet_5GB_Experiment_10MB_Batch is a BadgerDB test in which we write 5GB of data to the database.
+// In the test, we write data in batches of 10MB, totalling 500 batches. For each batch we perform identical operations
+// as in TestBolt_5GB_Experiment_10MB_Batch. This experiment uses the "Default" Badger config, and retrieves the items
+// with a single MultiGet.
+func TestBadger_Default_MultiGet_5GB_Experiment_10MB_Batch(t *testing.T) {
+	require := require.New(t)
+
+	testConfig := &TestConfig{
+		ExperimentNumberOfBatches: 500,
+		BatchSizeBytes:            10000000,
+		BatchSizeItems:            100,
+		BatchItemsRemoved:         20,
+		BatchItemsRetrieved:       20,
+		BatchItemsIterated:        20,
+		UseMultiGet:               true,
+	}
+	dir, err := os.MkdirTemp("", "badgerdb-default-multiget-5gb-10mb")
+	t.Logf("BadgerDB directory: %s\nIt should be automatically removed at the end of the test", dir)
+	require.NoError(err)
+
+	opts := DefaultBadgerOptions(dir)
+	db := NewBadgerDatabase(opts)
+	require.NoError(db.Setup())
+	defer db.Erase()
+	defer db.Close()
+
+	badgerCtx := db.GetContext([]byte{})
+	GenericTest(db, badgerCtx, testConfig, t)
+}
+
+// TestMultiGet checks that MultiGet returns values and found flags in request order on both backends.
+func TestMultiGet(t *testing.T) {
+	require := require.New(t)
+
+	boltDir, err := os.MkdirTemp("", "boltdb-multiget")
+	require.NoError(err)
+	boltDb := NewBoltDatabase(boltDir)
+	require.NoError(boltDb.Setup())
+	defer boltDb.Erase()
+	defer boltDb.Close()
+	GenericMultiGetTest(boltDb, boltDb.GetContext([]byte("TestBucket")).NestContext([]byte("Nested")), t)
+
+	badgerDir, err := os.MkdirTemp("", "badgerdb-multiget")
+	require.NoError(err)
+	badgerDb := NewBadgerDatabase(DefaultBadgerOptions(badgerDir))
+	require.NoError(badgerDb.Setup())
+	defer badgerDb.Erase()
+	defer badgerDb.Close()
+	GenericMultiGetTest(badgerDb, badgerDb.GetContext([]byte("TestPrefix")).NestContext([]byte("Nested")), t)
+}
+
+func GenericMultiGetTest(db Database, ctx Context, t *testing.T) {
+	require := require.New(t)
+
+	require.NoError(db.Update(ctx, func(tx Transaction, ctx Context) error {
+		for _, key := range []string{"a", "c", "e"} {
+			if err := tx.Set([]byte(key), []byte("value-"+key), ctx); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	keys := [][]byte{[]byte("e"), []byte("b"), []byte("a"), []byte("e"), []byte("d"), []byte("c")}
+	require.NoError(db.View(ctx, func(tx Transaction, ctx Context) error {
+		values, found, err := tx.MultiGet(keys, ctx)
+		require.NoError(err)
+		require.Equal([]bool{true, false, true, true, false, true}, found)
+		require.Equal([][]byte{[]byte("value-e"), nil, []byte("value-a"), []byte("value-e"), nil, []byte("value-c")}, values)
+		return nil
+	}))
+
+	// MultiGet works in an Update while an iterator is open, and sees its writes.
+	require.NoError(db.Update(ctx, func(tx Transaction, ctx Context) error {
+		it, err := tx.GetIterator(ctx)
+		require.NoError(err)
+		defer it.Close()
+		require.NoError(tx.Set([]byte("b"), []byte("value-b"), ctx))
+		values, found, err := tx.MultiGet(keys[:3], ctx)
+		require.NoError(err)
+		require.Equal([]bool{true, true, true}, found)
+		require.Equal([][]byte{[]byte("value-e"), []byte("value-b"), []byte("value-a")}, values)
+		return nil
+	}))
+}
+
+// TestWriteBatch writes and deletes keys through a WriteBatch on both backends.
+func TestWriteBatch(t *testing.T) {
+	require := require.New(t)
+
+	boltDir, err := os.MkdirTemp("", "boltdb-writebatch")
+	require.NoError(err)
+	boltDb := NewBoltDatabase(boltDir)
+	require.NoError(boltDb.Setup())
+	defer boltDb.Erase()
+	defer boltDb.Close()
+	GenericWriteBatchTest(boltDb, boltDb.GetContext([]byte("TestBucket")), t)
+
+	badgerDir, err := os.MkdirTemp("", "badgerdb-writebatch")
+	require.NoError(err)
+	badgerDb := NewBadgerDatabase(DefaultBadgerOptions(badgerDir))
+	require.NoError(badgerDb.Setup())
+	defer badgerDb.Erase()
+	defer badgerDb.Close()
+	GenericWriteBatchTest(badgerDb, badgerDb.GetContext([]byte("TestPrefix")), t)
+}
+
+func GenericWriteBatchTest(db Database, ctx Context, t *testing.T) {
+	require := require.New(t)
+
+	keys := make([][]byte, 1000)
+	wb := db.NewWriteBatch()
+	for ii := range keys {
+		keys[ii] = NewKey([]byte{byte(ii >> 8), byte(ii)}).Bytes()
+		require.NoError(wb.Set(keys[ii], make([]byte, 1<<10), ctx))
+	}
+	require.NoError(wb.Flush())
+
+	wb = db.NewWriteBatch()
+	for ii := 0; ii < len(keys); ii += 2 {
+		require.NoError(wb.Delete(keys[ii], ctx))
+	}
+	require.NoError(wb.Flush())
+
+	require.NoError(db.View(ctx, func(tx Transaction, ctx Context) error {
+		_, found, err := tx.MultiGet(keys, ctx)
+		require.NoError(err)
+		for ii := range keys {
+			require.Equal(ii%2 == 1, found[ii])
+		}
+		return nil
+	}))
+}
+
 func GenericTest(db Database, ctx Context, config *TestConfig, t *testing.T) {
 	timer := NewTimer()
 	p := NewProfiler()
@@ -440,14 +613,14 @@ func GenericBatchTest(db Database, ctx Context, p *Profiler, timer *Timer, confi
 
 	// Delete keys from DB and confirm they are deleted.
 	DeleteFromDB(db, removedKeys, ctx, t)
-	deletedValues := GetFromDb(db, removedKeys, ctx, t)
+	deletedValues := GetFromDb(db, removedKeys, ctx, config, t)
 	for _, val := range deletedValues {
 		require.Nil(val)
 	}
 	p.Measure()
 
 	// Retrieve keys from DB and confirm they match the original values.
-	retrievedValues := GetFromDb(db, retrievedKeys, ctx, t)
+	retrievedValues := GetFromDb(db, retrievedKeys, ctx, config, t)
 	for i, val := range retrievedValues {
 		require.Equal(kvMap[retrievedKeys[i]], val)
 	}
@@ -471,6 +644,16 @@ func WriteBatchToDb(db Database, ctx Context, config *TestConfig, t *testing.T)
 		require.NoError(err)
 	}
 
+	if config.UseWriteBatch {
+		wb := db.NewWriteBatch()
+		defer wb.Cancel()
+		for key, val := range kvMap {
+			require.NoError(wb.Set(key.Bytes(), val, ctx))
+		}
+		require.NoError(wb.Flush())
+		return kvMap
+	}
+
 	require.NoError(db.Update(ctx, func(tx Transaction, ctx Context) error {
 		for key, val := range kvMap {
 			if err := tx.Set(key.Bytes(), val, ctx); err != nil {
@@ -494,10 +677,19 @@ func DeleteFromDB(db Database, keys []Key, ctx Context, t *testing.T) {
 	}))
 }
 
-func GetFromDb(db Database, keys []Key, ctx Context, t *testing.T) [][]byte {
+func GetFromDb(db Database, keys []Key, ctx Context, config *TestConfig, t *testing.T) [][]byte {
 	require := require.New(t)
 	var values [][]byte
 	require.NoError(db.View(ctx, func(tx Transaction, ctx Context) error {
+		if config.UseMultiGet {
+			keyBytes := make([][]byte, len(keys))
+			for ii, key := range keys {
+				keyBytes[ii] = key.Bytes()
+			}
+			var err error
+			values, _, err = tx.MultiGet(keyBytes, ctx)
+			return err
+		}
 		for _, key := range keys {
 			val, err := tx.Get(key.Bytes(), ctx)
 			if err != nil {
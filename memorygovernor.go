@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/pkg/errors"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMemoryResumeRatio is the fraction of the budget memory must fall under for
+	// throttled writers to resume.
+	DefaultMemoryResumeRatio = 0.9
+
+	// DefaultMemorySampleInterval is the minimum time between two memory samples.
+	DefaultMemorySampleInterval = 100 * time.Millisecond
+)
+
+var ErrMemoryBudgetExceeded = errors.New("memory budget exceeded")
+
+type MemoryBudgetOptions struct {
+	// MaxHeapBytes is the budget for the Go heap. Zero disables the heap budget.
+	MaxHeapBytes uint64
+	// MaxRSSBytes is the budget for the resident set size of the process, which also
+	// counts memory mapped files and memory allocated outside the Go heap. Zero disables
+	// the RSS budget. The RSS is read from /proc, and isn't budgeted on other platforms.
+	MaxRSSBytes uint64
+	// ResumeRatio is the fraction of the budgets memory must fall under for throttled
+	// writers to resume, so that they don't resume and throttle again at every sample.
+	ResumeRatio float64
+	// SampleInterval is the minimum time between two memory samples. Reading the heap
+	// size stops the world, so it isn't read for every Update.
+	SampleInterval time.Duration
+	// MaxWait is how long an Update waits for memory to fall before it is rejected with
+	// ErrMemoryBudgetExceeded. Zero rejects Updates right away, and a negative MaxWait
+	// blocks them until memory falls or their Go context is done.
+	MaxWait time.Duration
+	// OnThrottle is called when writers are throttled and when they resume. It is called
+	// under the governor's lock, so it must not call into the database.
+	OnThrottle func(MemoryThrottleEvent)
+}
+
+func DefaultMemoryBudgetOptions() MemoryBudgetOptions {
+	return MemoryBudgetOptions{
+		ResumeRatio:    DefaultMemoryResumeRatio,
+		SampleInterval: DefaultMemorySampleInterval,
+		MaxWait:        -1,
+	}
+}
+
+type MemoryThrottleEvent struct {
+	Time time.Time
+	// Throttled is true when writers start being throttled, and false when they resume.
+	Throttled bool
+	HeapBytes uint64
+	RSSBytes  uint64
+	// Duration is how long writers were throttled, when they resume.
+	Duration time.Duration
+}
+
+type MemoryGovernorStats struct {
+	Throttled bool
+	// Throttles is the number of times writers were throttled.
+	Throttles uint64
+	// Blocked is the number of Updates that waited for memory to fall.
+	Blocked uint64
+	// Rejected is the number of Updates rejected with ErrMemoryBudgetExceeded.
+	Rejected uint64
+	// Collections is the number of garbage collections forced to release memory.
+	Collections uint64
+	HeapBytes   uint64
+	RSSBytes    uint64
+}
+
+// ==========================
+// MemoryGovernor
+// ==========================
+
+// MemoryGovernor bounds the memory of the process by throttling new writers while the
+// Go heap or the RSS is over budget. Throttling forces a garbage collection that returns
+// freed memory to the OS, at most once per sample. Badger doesn't expose a way to flush
+// its memtables, which are flushed once full, so with either engine the memory released
+// is that of the Go heap. Transactions already running are not interrupted, so memory
+// can still exceed the budget by what they allocate.
+type MemoryGovernor struct {
+	sync.Mutex
+
+	opts MemoryBudgetOptions
+
+	sampled time.Time
+	// sampling is set while a caller of throttled samples memory.
+	sampling  bool
+	heapBytes uint64
+	rssBytes  uint64
+
+	throttledAt time.Time
+	stats       MemoryGovernorStats
+}
+
+func NewMemoryGovernor(opts MemoryBudgetOptions) *MemoryGovernor {
+	return &MemoryGovernor{
+		opts: opts,
+	}
+}
+
+func (mg *MemoryGovernor) Stats() MemoryGovernorStats {
+	mg.Lock()
+	defer mg.Unlock()
+
+	stats := mg.stats
+	stats.Throttled = !mg.throttledAt.IsZero()
+	stats.HeapBytes = mg.heapBytes
+	stats.RSSBytes = mg.rssBytes
+	return stats
+}
+
+// Admit returns once memory is under budget, or ErrMemoryBudgetExceeded if it didn't
+// fall within opts.MaxWait. It returns goCtx.Err() if goCtx is done while waiting.
+func (mg *MemoryGovernor) Admit(goCtx context.Context) error {
+	if !mg.throttled() {
+		return nil
+	}
+	if mg.opts.MaxWait == 0 {
+		mg.reject()
+		return errors.Wrapf(ErrMemoryBudgetExceeded, "MemoryGovernor: Rejected update")
+	}
+
+	mg.Lock()
+	mg.stats.Blocked++
+	mg.Unlock()
+
+	var deadline <-chan time.Time
+	if mg.opts.MaxWait > 0 {
+		timer := time.NewTimer(mg.opts.MaxWait)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	ticker := time.NewTicker(mg.sampleInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-goCtx.Done():
+			return goCtx.Err()
+		case <-deadline:
+			mg.reject()
+			return errors.Wrapf(ErrMemoryBudgetExceeded, "MemoryGovernor: Rejected update after %v", mg.opts.MaxWait)
+		case <-ticker.C:
+			if !mg.throttled() {
+				return nil
+			}
+		}
+	}
+}
+
+func (mg *MemoryGovernor) reject() {
+	mg.Lock()
+	defer mg.Unlock()
+
+	mg.stats.Rejected++
+}
+
+func (mg *MemoryGovernor) sampleInterval() time.Duration {
+	if mg.opts.SampleInterval <= 0 {
+		return DefaultMemorySampleInterval
+	}
+	return mg.opts.SampleInterval
+}
+
+// throttled samples memory if the last sample is older than the sample interval, and
+// reports whether writers are throttled. A single caller samples at a time, without
+// holding the lock, so that the others don't wait for the garbage collection and see
+// the state of the previous sample meanwhile.
+func (mg *MemoryGovernor) throttled() bool {
+	mg.Lock()
+	now := time.Now()
+	if mg.sampling || now.Sub(mg.sampled) < mg.sampleInterval() {
+		defer mg.Unlock()
+		return !mg.throttledAt.IsZero()
+	}
+	mg.sampled = now
+	mg.sampling = true
+	mg.Unlock()
+
+	heapBytes, rssBytes := mg.sample()
+	mg.Lock()
+	mg.heapBytes, mg.rssBytes = heapBytes, rssBytes
+	if mg.throttledAt.IsZero() {
+		if !mg.overBudget(1) {
+			mg.sampling = false
+			mg.Unlock()
+			return false
+		}
+		mg.throttledAt = now
+		mg.stats.Throttles++
+		mg.emit(true, 0)
+	}
+	mg.stats.Collections++
+	mg.Unlock()
+
+	// Collect garbage once per sample while throttled, and resample to see its effect.
+	debug.FreeOSMemory()
+	heapBytes, rssBytes = mg.sample()
+
+	mg.Lock()
+	defer mg.Unlock()
+	mg.sampling = false
+	mg.heapBytes, mg.rssBytes = heapBytes, rssBytes
+	if mg.overBudget(mg.opts.ResumeRatio) {
+		return true
+	}
+	duration := now.Sub(mg.throttledAt)
+	mg.throttledAt = time.Time{}
+	mg.emit(false, duration)
+	return false
+}
+
+// sample reads the Go heap, and the RSS if it has a budget.
+func (mg *MemoryGovernor) sample() (_heapBytes uint64, _rssBytes uint64) {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	var rssBytes uint64
+	if mg.opts.MaxRSSBytes > 0 {
+		rssBytes = readRSS()
+	}
+	return m.HeapAlloc, rssBytes
+}
+
+// overBudget reports whether memory is above ratio times one of the budgets.
+func (mg *MemoryGovernor) overBudget(ratio float64) bool {
+	if ratio <= 0 || ratio > 1 {
+		ratio = 1
+	}
+	if mg.opts.MaxHeapBytes > 0 && float64(mg.heapBytes) > ratio*float64(mg.opts.MaxHeapBytes) {
+		return true
+	}
+	return mg.opts.MaxRSSBytes > 0 && float64(mg.rssBytes) > ratio*float64(mg.opts.MaxRSSBytes)
+}
+
+func (mg *MemoryGovernor) emit(throttled bool, duration time.Duration) {
+	if mg.opts.OnThrottle == nil {
+		return
+	}
+	mg.opts.OnThrottle(MemoryThrottleEvent{
+		Time:      time.Now(),
+		Throttled: throttled,
+		HeapBytes: mg.heapBytes,
+		RSSBytes:  mg.rssBytes,
+		Duration:  duration,
+	})
+}
+
+// readRSS returns the resident set size of the process from /proc/self/statm, or zero
+// if it can't be read.
+func readRSS() uint64 {
+	statm, err := os.ReadFile("/proc/self/statm")
+	if err != nil {
+		return 0
+	}
+	fields := bytes.Fields(statm)
+	if len(fields) < 2 {
+		return 0
+	}
+	pages, err := strconv.ParseUint(string(fields[1]), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return pages * uint64(os.Getpagesize())
+}
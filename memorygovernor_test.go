@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestMemoryGovernor checks that Updates are rejected or blocked while the heap is over
+// budget, that views are not, and that blocked Updates resume once memory is freed.
+func TestMemoryGovernor(t *testing.T) {
+	require := require.New(t)
+
+	db := newTestBoltDatabase("boltdb-memory", t)
+	defer db.Erase()
+	defer db.Close()
+	ctx := db.GetContext([]byte("blocks"))
+	set := func(tx Transaction, ctx Context) error {
+		return tx.Set([]byte("a"), []byte("1"), ctx)
+	}
+
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	var eventsLock sync.Mutex
+	var events []MemoryThrottleEvent
+	opts := DefaultMemoryBudgetOptions()
+	opts.MaxHeapBytes = m.HeapAlloc + 64<<20
+	opts.SampleInterval = 10 * time.Millisecond
+	opts.OnThrottle = func(event MemoryThrottleEvent) {
+		eventsLock.Lock()
+		defer eventsLock.Unlock()
+		events = append(events, event)
+	}
+
+	rejecting := opts
+	rejecting.MaxWait = 0
+	rejectingDb := NewDatabaseContextWithMemoryBudget(db, ctx, rejecting)
+	blockingDb := NewDatabaseContextWithMemoryBudget(db, ctx, opts)
+	require.NoError(blockingDb.Update(ctx, set))
+
+	ballast := make([]byte, 128<<20)
+	ballast[len(ballast)-1] = 1
+	// Wait for the sample taken before the allocation to expire.
+	time.Sleep(opts.SampleInterval)
+	require.True(errors.Is(rejectingDb.Update(ctx, set), ErrMemoryBudgetExceeded))
+	require.Equal(uint64(1), rejectingDb.MemoryGovernor().Stats().Rejected)
+
+	goCtx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(blockingDb.UpdateContext(goCtx, ctx, func(_ context.Context, tx Transaction, ctx Context) error {
+		return set(tx, ctx)
+	}), context.DeadlineExceeded)
+	require.NoError(blockingDb.View(ctx, func(tx Transaction, ctx Context) error {
+		_, err := tx.Get([]byte("a"), ctx)
+		return err
+	}))
+	require.True(blockingDb.MemoryGovernor().Stats().Throttled)
+
+	done := make(chan error)
+	go func() {
+		done <- blockingDb.Update(ctx, set)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(byte(1), ballast[len(ballast)-1])
+	ballast = nil
+	require.NoError(<-done)
+
+	stats := blockingDb.MemoryGovernor().Stats()
+	require.False(stats.Throttled)
+	require.Equal(uint64(1), stats.Throttles)
+	require.Equal(uint64(2), stats.Blocked)
+	require.Positive(stats.Collections)
+
+	eventsLock.Lock()
+	defer eventsLock.Unlock()
+	require.GreaterOrEqual(len(events), 3)
+	require.True(events[len(events)-2].Throttled)
+	require.False(events[len(events)-1].Throttled)
+	require.Positive(events[len(events)-1].Duration)
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"github.com/pkg/errors"
+	"hash/fnv"
+	"sort"
+)
+
+var (
+	migrationCheckpointContextId = []byte("__migration")
+
+	ErrMigrationVerificationFailed = errors.New("Migrate: target does not match source")
+	ErrMigrationTargetWritten      = errors.New("Migrate: target was written outside of the migration")
+)
+
+type MigrationOptions struct {
+	// JobId identifies the migration. Progress is checkpointed under this id in the
+	// target, in the same transaction as each batch of records, and a rerun with the
+	// same id resumes after the last committed record.
+	JobId []byte
+	// MaxBatchBytes is the budget of key and value bytes copied in a single transaction.
+	MaxBatchBytes int
+	// FallbackPath is the context that receives records the source could not attribute
+	// to a context, e.g. Badger keys written outside of any cataloged context. If nil,
+	// such records fail the migration.
+	FallbackPath [][]byte
+	// Verify compares per-context checksums of the source and the target once the
+	// copy completes.
+	Verify bool
+}
+
+func DefaultMigrationOptions() MigrationOptions {
+	return MigrationOptions{
+		JobId:         []byte("default"),
+		MaxBatchBytes: DefaultBulkUpdateBatchBytes,
+		Verify:        true,
+	}
+}
+
+type MigrationResult struct {
+	// Copied is the number of records copied by this run.
+	Copied uint64
+	// Skipped is the number of records skipped because a previous run copied them.
+	Skipped uint64
+	// Batches is the number of transactions committed in the target.
+	Batches int
+	// SourceChecksums and TargetChecksums are only set when verification is enabled.
+	SourceChecksums []*ContextChecksum
+	TargetChecksums []*ContextChecksum
+	// Mismatched are the paths of contexts whose checksums differ.
+	Mismatched [][][]byte
+}
+
+// Migrate copies every context of source into target. Contexts are translated through
+// their path, so Badger prefixes become nested Bolt buckets and the reverse.
+//
+// The source is read from a consistent snapshot, so writes and deletes made to the
+// source once the migration has started are not copied, and writes to the source have
+// to be stopped for the target to end up identical. The target must not receive writes
+// until the migration is done: a new migration refuses a target that holds anything but
+// migration checkpoints, and a key found in the target before it is copied fails the
+// migration with ErrMigrationTargetWritten. Other writes to the target are reported by
+// the verification.
+func Migrate(source Database, target Database, opts MigrationOptions) (*MigrationResult, error) {
+	mig := &migration{
+		source:        source,
+		target:        target,
+		opts:          opts,
+		checkpointCtx: target.GetContext(migrationCheckpointContextId),
+		contexts:      make(map[string]Context),
+		result:        &MigrationResult{},
+	}
+	if len(opts.JobId) == 0 {
+		return mig.result, errors.New("Migrate: JobId is required")
+	}
+	if err := mig.loadCheckpoint(); err != nil {
+		return mig.result, errors.Wrapf(err, "Migrate: Problem loading checkpoint")
+	}
+	if mig.checkpoint == nil {
+		if err := mig.checkTargetEmpty(); err != nil {
+			return mig.result, errors.Wrapf(err, "Migrate: Problem checking target")
+		}
+	}
+
+	err := forEachRecord(source, mig.copyRecord)
+	if err == nil {
+		err = mig.commit(true)
+	}
+	if err != nil {
+		return mig.result, errors.Wrapf(err, "Migrate: Problem copying records")
+	}
+
+	if !opts.Verify {
+		return mig.result, nil
+	}
+	if err := mig.verify(); err != nil {
+		return mig.result, err
+	}
+	return mig.result, nil
+}
+
+type migration struct {
+	source        Database
+	target        Database
+	opts          MigrationOptions
+	checkpointCtx Context
+	contexts      map[string]Context
+	result        *MigrationResult
+
+	// checkpoint is the last record committed to the target, in source order.
+	checkpoint   *BackupRecord
+	pending      []*BackupRecord
+	pendingBytes int
+}
+
+func (mig *migration) copyRecord(record *BackupRecord) error {
+	if len(record.Path) == 0 && mig.opts.FallbackPath == nil {
+		return errors.Errorf("Record with key %x does not belong to any context", record.Key)
+	}
+	if mig.checkpoint != nil && !backupRecordLess(mig.source.Id(), mig.checkpoint, record) {
+		mig.result.Skipped++
+		return nil
+	}
+
+	mig.pending = append(mig.pending, record)
+	mig.pendingBytes += len(record.Key) + len(record.Value)
+	if mig.pendingBytes < mig.opts.MaxBatchBytes {
+		return nil
+	}
+	return mig.commit(false)
+}
+
+// commit writes the pending records together with the checkpoint. The last commit
+// clears the checkpoint instead, so the job id can be reused.
+func (mig *migration) commit(last bool) error {
+	if len(mig.pending) == 0 && !last {
+		return nil
+	}
+
+	err := mig.target.Update(mig.checkpointCtx, func(tx Transaction, checkpointCtx Context) error {
+		for _, record := range mig.pending {
+			ctx := mig.context(record.Path)
+			// Records after the checkpoint were never committed, so a key that is
+			// already there was written by someone else.
+			_, found, err := tx.MultiGet([][]byte{record.Key}, ctx)
+			if err != nil {
+				return errors.Wrapf(err, "Problem reading key %x in context %q", record.Key, record.Path)
+			}
+			if found[0] {
+				return errors.Wrapf(ErrMigrationTargetWritten, "Key %x in context %q exists before it is copied",
+					record.Key, record.Path)
+			}
+			if err := tx.Set(record.Key, record.Value, ctx); err != nil {
+				return errors.Wrapf(err, "Problem copying key %x in context %q", record.Key, record.Path)
+			}
+		}
+		if last {
+			return tx.Delete(mig.opts.JobId, checkpointCtx)
+		}
+		checkpoint := mig.pending[len(mig.pending)-1]
+		return tx.Set(mig.opts.JobId, encodeRecordLocation(checkpoint.Path, checkpoint.Key), checkpointCtx)
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(mig.pending) > 0 {
+		mig.checkpoint = mig.pending[len(mig.pending)-1]
+	}
+	mig.result.Copied += uint64(len(mig.pending))
+	mig.result.Batches++
+	mig.pending = nil
+	mig.pendingBytes = 0
+	return nil
+}
+
+func (mig *migration) context(path [][]byte) Context {
+	if len(path) == 0 {
+		path = mig.opts.FallbackPath
+	}
+	pathKey := string(encodeContextPath(path))
+	ctx, exists := mig.contexts[pathKey]
+	if !exists {
+		ctx = GetContextForPath(mig.target, path)
+		mig.contexts[pathKey] = ctx
+	}
+	return ctx
+}
+
+func (mig *migration) loadCheckpoint() error {
+	return mig.target.View(mig.checkpointCtx, func(tx Transaction, checkpointCtx Context) error {
+		values, found, err := tx.MultiGet([][]byte{mig.opts.JobId}, checkpointCtx)
+		if err != nil || !found[0] {
+			return err
+		}
+		path, key, err := decodeRecordLocation(values[0])
+		mig.checkpoint = &BackupRecord{Path: path, Key: key}
+		return err
+	})
+}
+
+// checkTargetEmpty fails with ErrMigrationTargetWritten if the target holds anything
+// but migration checkpoints.
+func (mig *migration) checkTargetEmpty() error {
+	return forEachRecord(mig.target, func(record *BackupRecord) error {
+		if len(record.Path) == 1 && bytes.Equal(record.Path[0], migrationCheckpointContextId) {
+			return nil
+		}
+		return errors.Wrapf(ErrMigrationTargetWritten, "Key %x in context %q", record.Key, record.Path)
+	})
+}
+
+func (mig *migration) verify() error {
+	var err error
+	if mig.result.SourceChecksums, err = ComputeContextChecksums(mig.source); err != nil {
+		return errors.Wrapf(err, "Migrate: Problem computing source checksums")
+	}
+	if mig.result.TargetChecksums, err = ComputeContextChecksums(mig.target); err != nil {
+		return errors.Wrapf(err, "Migrate: Problem computing target checksums")
+	}
+
+	targetChecksums := make(map[string]*ContextChecksum)
+	for _, checksum := range mig.result.TargetChecksums {
+		targetChecksums[string(encodeContextPath(checksum.Path))] = checksum
+	}
+	for _, checksum := range mig.result.SourceChecksums {
+		path := checksum.Path
+		if len(path) == 0 {
+			path = mig.opts.FallbackPath
+		}
+		pathKey := string(encodeContextPath(path))
+		targetChecksum, exists := targetChecksums[pathKey]
+		delete(targetChecksums, pathKey)
+		if !exists || targetChecksum.Records != checksum.Records || targetChecksum.Checksum != checksum.Checksum {
+			mig.result.Mismatched = append(mig.result.Mismatched, path)
+		}
+	}
+	// Contexts only present in the target.
+	for _, checksum := range targetChecksums {
+		mig.result.Mismatched = append(mig.result.Mismatched, checksum.Path)
+	}
+
+	if len(mig.result.Mismatched) > 0 {
+		return errors.Wrapf(ErrMigrationVerificationFailed, "%v contexts differ, e.g. %q",
+			len(mig.result.Mismatched), mig.result.Mismatched[0])
+	}
+	return nil
+}
+
+// backupRecordLess reports whether a comes before b in the order in which a backup of
+// the given database emits records. Bolt walks buckets depth first in key order, which
+// is the order of the path segments followed by the key. Badger emits records in order
+// of their prefixed key, which is the context prefix encoding the path followed by the key.
+func backupRecordLess(sourceId DatabaseId, a *BackupRecord, b *BackupRecord) bool {
+	if sourceId == BADGERDB {
+		return bytes.Compare(append(badgerContextPrefix(a.Path), a.Key...),
+			append(badgerContextPrefix(b.Path), b.Key...)) < 0
+	}
+
+	aSegments := append(append([][]byte{}, a.Path...), a.Key)
+	bSegments := append(append([][]byte{}, b.Path...), b.Key)
+	for ii := 0; ii < len(aSegments) && ii < len(bSegments); ii++ {
+		if cmp := bytes.Compare(aSegments[ii], bSegments[ii]); cmp != 0 {
+			return cmp < 0
+		}
+	}
+	return len(aSegments) < len(bSegments)
+}
+
+// ==========================
+// ContextChecksum
+// ==========================
+
+// ContextChecksum summarizes the records of a context. Checksum is the sum of the FNV-1a
+// hashes of every key and value, so it does not depend on the order in which a backend
+// returns records.
+type ContextChecksum struct {
+	Path     [][]byte
+	Records  uint64
+	Checksum uint64
+}
+
+// ComputeContextChecksums computes the checksum of every context of db, sorted by path.
+// Contexts without records are omitted.
+func ComputeContextChecksums(db Database) ([]*ContextChecksum, error) {
+	checksums := make(map[string]*ContextChecksum)
+	err := forEachRecord(db, func(record *BackupRecord) error {
+		pathKey := string(encodeContextPath(record.Path))
+		checksum, exists := checksums[pathKey]
+		if !exists {
+			checksum = &ContextChecksum{Path: record.Path}
+			checksums[pathKey] = checksum
+		}
+
+		hasher := fnv.New64a()
+		hasher.Write(appendLengthPrefixed(nil, record.Key))
+		hasher.Write(record.Value)
+		checksum.Records++
+		checksum.Checksum += hasher.Sum64()
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "ComputeContextChecksums:")
+	}
+
+	sorted := make([]*ContextChecksum, 0, len(checksums))
+	for _, checksum := range checksums {
+		sorted = append(sorted, checksum)
+	}
+	sort.Slice(sorted, func(ii, jj int) bool {
+		return bytes.Compare(encodeContextPath(sorted[ii].Path), encodeContextPath(sorted[jj].Path)) < 0
+	})
+	return sorted, nil
+}
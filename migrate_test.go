@@ -0,0 +1,96 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+// failingUpdateDatabase fails every Update after the first updatesLeft ones.
+type failingUpdateDatabase struct {
+	Database
+	updatesLeft int
+}
+
+func (fdb *failingUpdateDatabase) Update(ctx Context, fn func(Transaction, Context) error) error {
+	if fdb.updatesLeft == 0 {
+		return errors.New("injected failure")
+	}
+	fdb.updatesLeft--
+	return fdb.Database.Update(ctx, fn)
+}
+
+// TestMigrate_BadgerToBolt interrupts a Badger to Bolt migration, resumes it and verifies the result.
+func TestMigrate_BadgerToBolt(t *testing.T) {
+	require := require.New(t)
+
+	source := newTestBadgerDatabase("badgerdb-migrate-source", t)
+	defer source.Erase()
+	defer source.Close()
+	populateBackupTestDatabase(source, t)
+
+	target := newTestBoltDatabase("boltdb-migrate-target", t)
+	defer target.Erase()
+	defer target.Close()
+
+	opts := DefaultMigrationOptions()
+	opts.MaxBatchBytes = 500
+	result, err := Migrate(source, &failingUpdateDatabase{Database: target, updatesLeft: 2}, opts)
+	require.Error(err)
+	require.Equal(2, result.Batches)
+
+	result, err = Migrate(source, target, opts)
+	require.NoError(err)
+	require.Greater(result.Skipped, uint64(0))
+	require.Equal(uint64(30), result.Skipped+result.Copied)
+	require.Len(result.SourceChecksums, 3)
+	require.Equal(result.SourceChecksums, result.TargetChecksums)
+
+	// A new migration refuses a target that already holds records.
+	_, err = Migrate(source, target, opts)
+	require.True(errors.Is(err, ErrMigrationTargetWritten))
+}
+
+// TestMigrate_TargetWritten writes to the target of an interrupted migration, both to a
+// key that is yet to be copied and to a key that the source doesn't have.
+func TestMigrate_TargetWritten(t *testing.T) {
+	require := require.New(t)
+
+	source := newTestBadgerDatabase("badgerdb-migrate-source", t)
+	defer source.Erase()
+	defer source.Close()
+	populateBackupTestDatabase(source, t)
+
+	target := newTestBoltDatabase("boltdb-migrate-target", t)
+	defer target.Erase()
+	defer target.Close()
+
+	opts := DefaultMigrationOptions()
+	opts.MaxBatchBytes = 500
+	_, err := Migrate(source, &failingUpdateDatabase{Database: target, updatesLeft: 1}, opts)
+	require.Error(err)
+
+	// The last record of the source can't have been copied by the first batch.
+	var last *BackupRecord
+	require.NoError(forEachRecord(source, func(record *BackupRecord) error {
+		last = record
+		return nil
+	}))
+	lastCtx := GetContextForPath(target, last.Path)
+	require.NoError(target.Update(lastCtx, func(tx Transaction, ctx Context) error {
+		return tx.Set(last.Key, []byte("newer"), ctx)
+	}))
+	_, err = Migrate(source, target, opts)
+	require.True(errors.Is(err, ErrMigrationTargetWritten))
+
+	// A key the source doesn't have is caught by the verification.
+	require.NoError(target.Update(lastCtx, func(tx Transaction, ctx Context) error {
+		if err := tx.Delete(last.Key, ctx); err != nil {
+			return err
+		}
+		return tx.Set([]byte("extra"), []byte("value"), ctx)
+	}))
+	result, err := Migrate(source, target, opts)
+	require.True(errors.Is(err, ErrMigrationVerificationFailed))
+	require.Equal([][][]byte{last.Path}, result.Mismatched)
+}
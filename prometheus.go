@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/dgraph-io/ristretto"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+const prometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// ==========================
+// MetricsHandler
+// ==========================
+
+// MetricsHandler serves metrics in the Prometheus text exposition format: the operation
+// metrics of a DatabaseMetrics, the internals of the databases added to it, and Go
+// runtime memory statistics. Backends expose their internals through metricsCollector,
+// so the databases added should be the backends rather than wrappers around them.
+type MetricsHandler struct {
+	metrics *DatabaseMetrics
+
+	lock      sync.RWMutex
+	names     []string
+	databases []Database
+}
+
+// metricsCollector is implemented by backends that expose internal metrics.
+type metricsCollector interface {
+	collectMetrics(pb *prometheusBuffer, labels []string)
+}
+
+func NewMetricsHandler(metrics *DatabaseMetrics) *MetricsHandler {
+	return &MetricsHandler{
+		metrics: metrics,
+	}
+}
+
+// AddDatabase exposes the internals of db, labelled with name.
+func (mh *MetricsHandler) AddDatabase(name string, db Database) {
+	mh.lock.Lock()
+	defer mh.lock.Unlock()
+
+	mh.names = append(mh.names, name)
+	mh.databases = append(mh.databases, db)
+}
+
+func (mh *MetricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", prometheusContentType)
+	w.Write(mh.Render())
+}
+
+// Render returns every metric in the Prometheus text exposition format.
+func (mh *MetricsHandler) Render() []byte {
+	pb := newPrometheusBuffer()
+	if mh.metrics != nil {
+		collectOperationMetrics(pb, mh.metrics.Snapshot())
+	}
+
+	mh.lock.RLock()
+	for ii, db := range mh.databases {
+		if collector, ok := db.(metricsCollector); ok {
+			collector.collectMetrics(pb, []string{"database", mh.names[ii], "backend", db.Id().String()})
+		}
+	}
+	mh.lock.RUnlock()
+
+	collectRuntimeMetrics(pb)
+	return pb.Bytes()
+}
+
+func collectOperationMetrics(pb *prometheusBuffer, snapshot []*OperationMetrics) {
+	for _, operation := range snapshot {
+		labels := []string{
+			"backend", operation.Backend.String(),
+			"path", formatContextPath(operation.Path),
+			"operation", string(operation.Operation),
+		}
+		pb.counter("db_operations_total", "Number of database operations.", labels, float64(operation.Count))
+		pb.counter("db_operation_errors_total", "Number of database operations that failed.", labels, float64(operation.Errors))
+		pb.counter("db_operation_bytes_total", "Key and value bytes written, and value bytes read.", labels, float64(operation.Bytes))
+
+		name := "db_operation_duration_seconds"
+		pb.family(name, "Latency of database operations.", "histogram")
+		var cumulative uint64
+		for ii, count := range operation.LatencyCounts {
+			cumulative += count
+			le := "+Inf"
+			if ii < len(LatencyBuckets) {
+				le = strconv.FormatFloat(LatencyBuckets[ii], 'g', -1, 64)
+			}
+			pb.sample(name, name+"_bucket", append(labels[:len(labels):len(labels)], "le", le), float64(cumulative))
+		}
+		pb.sample(name, name+"_sum", labels, operation.LatencySum.Seconds())
+		pb.sample(name, name+"_count", labels, float64(cumulative))
+	}
+}
+
+func collectRuntimeMetrics(pb *prometheusBuffer) {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	pb.gauge("go_memstats_alloc_bytes", "Bytes of allocated heap objects.", nil, float64(m.Alloc))
+	pb.counter("go_memstats_alloc_bytes_total", "Cumulative bytes allocated for heap objects.", nil, float64(m.TotalAlloc))
+	pb.gauge("go_memstats_sys_bytes", "Bytes of memory obtained from the OS.", nil, float64(m.Sys))
+	pb.counter("go_gc_cycles_total", "Number of completed GC cycles.", nil, float64(m.NumGC))
+	pb.gauge("go_goroutines", "Number of goroutines that currently exist.", nil, float64(runtime.NumGoroutine()))
+}
+
+func (bdb *BadgerDatabase) collectMetrics(pb *prometheusBuffer, labels []string) {
+	lsm, vlog := bdb.db.Size()
+	pb.gauge("badger_lsm_size_bytes", "Size of the LSM tree, refreshed by Badger every minute.", labels, float64(lsm))
+	pb.gauge("badger_vlog_size_bytes", "Size of the value log, refreshed by Badger every minute.", labels, float64(vlog))
+	pb.gauge("badger_tables", "Number of LSM tables.", labels, float64(len(bdb.db.Tables())))
+
+	for _, cache := range []struct {
+		name    string
+		metrics *ristretto.Metrics
+	}{
+		{"block", bdb.db.BlockCacheMetrics()},
+		{"index", bdb.db.IndexCacheMetrics()},
+	} {
+		// The metrics of a disabled cache are nil, and read as zero.
+		cacheLabels := append(labels[:len(labels):len(labels)], "cache", cache.name)
+		pb.counter("badger_cache_hits_total", "Cache hits.", cacheLabels, float64(cache.metrics.Hits()))
+		pb.counter("badger_cache_misses_total", "Cache misses.", cacheLabels, float64(cache.metrics.Misses()))
+		pb.counter("badger_cache_keys_added_total", "Keys added to the cache.", cacheLabels, float64(cache.metrics.KeysAdded()))
+		pb.counter("badger_cache_keys_evicted_total", "Keys evicted from the cache.", cacheLabels, float64(cache.metrics.KeysEvicted()))
+		pb.counter("badger_cache_cost_added_total", "Cost added to the cache.", cacheLabels, float64(cache.metrics.CostAdded()))
+		pb.counter("badger_cache_cost_evicted_total", "Cost evicted from the cache.", cacheLabels, float64(cache.metrics.CostEvicted()))
+		pb.counter("badger_cache_sets_dropped_total", "Cache sets dropped under contention.", cacheLabels, float64(cache.metrics.SetsDropped()))
+		pb.counter("badger_cache_sets_rejected_total", "Cache sets rejected by the admission policy.", cacheLabels, float64(cache.metrics.SetsRejected()))
+	}
+
+	if bdb.gc != nil {
+		stats := bdb.gc.snapshot()
+		pb.counter("badger_vlog_gc_runs_total", "Value log collections run.", labels, float64(stats.Runs))
+		pb.counter("badger_vlog_gc_skipped_total", "Value log collections skipped under write load.", labels, float64(stats.Skipped))
+		pb.counter("badger_vlog_gc_rewrites_total", "Value log files rewritten.", labels, float64(stats.Rewrites))
+		pb.counter("badger_vlog_gc_reclaimed_bytes_total", "Value log bytes reclaimed.", labels, float64(stats.ReclaimedBytes))
+		pb.counter("badger_vlog_gc_errors_total", "Value log collections that failed.", labels, float64(stats.Errors))
+	}
+
+	for _, stats := range bdb.ConflictStats() {
+		pathLabels := append(labels[:len(labels):len(labels)], "path", formatContextPath(stats.Path))
+		pb.counter("badger_update_attempts_total", "Update attempts, including retries.", pathLabels, float64(stats.Attempts))
+		pb.counter("badger_update_conflicts_total", "Update attempts that conflicted.", pathLabels, float64(stats.Conflicts))
+		pb.counter("badger_update_conflicts_exhausted_total", "Updates that conflicted on every attempt.", pathLabels, float64(stats.Exhausted))
+	}
+}
+
+// collectMetrics exposes bolt.DB.Stats. They start over when an online compaction
+// swaps the file, which Prometheus handles as a counter reset.
+func (bdb *BoltDatabase) collectMetrics(pb *prometheusBuffer, labels []string) {
+	bdb.lock.RLock()
+	if bdb.failed != nil {
+		bdb.lock.RUnlock()
+		return
+	}
+	stats := bdb.db.Stats()
+	bdb.lock.RUnlock()
+
+	pb.gauge("bolt_free_pages", "Free pages on the freelist.", labels, float64(stats.FreePageN))
+	pb.gauge("bolt_pending_pages", "Pages freed but still in use by open transactions.", labels, float64(stats.PendingPageN))
+	pb.gauge("bolt_free_alloc_bytes", "Bytes allocated in free pages.", labels, float64(stats.FreeAlloc))
+	pb.gauge("bolt_freelist_inuse_bytes", "Bytes used by the freelist.", labels, float64(stats.FreelistInuse))
+	pb.counter("bolt_read_transactions_total", "Read transactions started.", labels, float64(stats.TxN))
+	pb.gauge("bolt_open_read_transactions", "Read transactions currently open.", labels, float64(stats.OpenTxN))
+	collectBoltTxStats(pb, labels, stats.TxStats)
+}
+
+func collectBoltTxStats(pb *prometheusBuffer, labels []string, stats bolt.TxStats) {
+	pb.counter("bolt_tx_pages_allocated_total", "Page allocations.", labels, float64(stats.PageCount))
+	pb.counter("bolt_tx_pages_allocated_bytes_total", "Bytes of pages allocated.", labels, float64(stats.PageAlloc))
+	pb.counter("bolt_tx_cursors_total", "Cursors created.", labels, float64(stats.CursorCount))
+	pb.counter("bolt_tx_nodes_total", "Nodes allocated.", labels, float64(stats.NodeCount))
+	pb.counter("bolt_tx_node_derefs_total", "Node dereferences.", labels, float64(stats.NodeDeref))
+	pb.counter("bolt_tx_rebalances_total", "Node rebalances.", labels, float64(stats.Rebalance))
+	pb.counter("bolt_tx_rebalance_seconds_total", "Time spent rebalancing.", labels, stats.RebalanceTime.Seconds())
+	pb.counter("bolt_tx_splits_total", "Nodes split.", labels, float64(stats.Split))
+	pb.counter("bolt_tx_spills_total", "Nodes spilled.", labels, float64(stats.Spill))
+	pb.counter("bolt_tx_spill_seconds_total", "Time spent spilling.", labels, stats.SpillTime.Seconds())
+	pb.counter("bolt_tx_writes_total", "Writes performed.", labels, float64(stats.Write))
+	pb.counter("bolt_tx_write_seconds_total", "Time spent writing to disk.", labels, stats.WriteTime.Seconds())
+}
+
+func (id DatabaseId) String() string {
+	switch id {
+	case BADGERDB:
+		return "badger"
+	case BOLTDB:
+		return "bolt"
+	}
+	return strconv.Itoa(int(id))
+}
+
+// formatContextPath joins the ids of a path with slashes. Ids that aren't printable
+// UTF-8 are written in hex, so that binary ids make valid label values.
+func formatContextPath(path [][]byte) string {
+	segments := make([]string, len(path))
+	for ii, id := range path {
+		segments[ii] = string(id)
+		if !printableContextId(id) {
+			segments[ii] = fmt.Sprintf("0x%x", id)
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+func printableContextId(id []byte) bool {
+	if len(id) == 0 || !utf8.Valid(id) {
+		return false
+	}
+	for _, r := range string(id) {
+		if r == '/' || !strconv.IsPrint(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// ==========================
+// prometheusBuffer
+// ==========================
+
+// prometheusBuffer groups samples by family, as the exposition format requires, in the
+// order families are first written to.
+type prometheusBuffer struct {
+	families []*prometheusFamily
+	byName   map[string]*prometheusFamily
+}
+
+type prometheusFamily struct {
+	name    string
+	help    string
+	typ     string
+	samples bytes.Buffer
+}
+
+func newPrometheusBuffer() *prometheusBuffer {
+	return &prometheusBuffer{
+		byName: make(map[string]*prometheusFamily),
+	}
+}
+
+func (pb *prometheusBuffer) family(name string, help string, typ string) *prometheusFamily {
+	if family, exists := pb.byName[name]; exists {
+		return family
+	}
+	family := &prometheusFamily{name: name, help: help, typ: typ}
+	pb.families = append(pb.families, family)
+	pb.byName[name] = family
+	return family
+}
+
+func (pb *prometheusBuffer) counter(name string, help string, labels []string, value float64) {
+	pb.family(name, help, "counter")
+	pb.sample(name, name, labels, value)
+}
+
+func (pb *prometheusBuffer) gauge(name string, help string, labels []string, value float64) {
+	pb.family(name, help, "gauge")
+	pb.sample(name, name, labels, value)
+}
+
+// sample adds a sample to a family declared beforehand. labels alternate names and values.
+func (pb *prometheusBuffer) sample(familyName string, name string, labels []string, value float64) {
+	samples := &pb.byName[familyName].samples
+	samples.WriteString(name)
+	if len(labels) > 0 {
+		samples.WriteByte('{')
+		for ii := 0; ii+1 < len(labels); ii += 2 {
+			if ii > 0 {
+				samples.WriteByte(',')
+			}
+			samples.WriteString(labels[ii])
+			samples.WriteString(`="`)
+			samples.WriteString(prometheusLabelEscaper.Replace(labels[ii+1]))
+			samples.WriteByte('"')
+		}
+		samples.WriteByte('}')
+	}
+	samples.WriteByte(' ')
+	samples.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	samples.WriteByte('\n')
+}
+
+var prometheusLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (pb *prometheusBuffer) Bytes() []byte {
+	var out bytes.Buffer
+	for _, family := range pb.families {
+		fmt.Fprintf(&out, "# HELP %s %s\n# TYPE %s %s\n", family.name, family.help, family.name, family.typ)
+		out.Write(family.samples.Bytes())
+	}
+	return out.Bytes()
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestMetricsHandler scrapes the handler after operations on Bolt and Badger, and checks
+// the output is grouped into families with escaped labels.
+func TestMetricsHandler(t *testing.T) {
+	require := require.New(t)
+
+	metrics := NewDatabaseMetrics()
+	handler := NewMetricsHandler(metrics)
+	boltDb := newTestBoltDatabase("boltdb-prometheus", t)
+	defer boltDb.Erase()
+	defer boltDb.Close()
+	badgerDb := newTestBadgerDatabase("badgerdb-prometheus", t)
+	defer badgerDb.Erase()
+	defer badgerDb.Close()
+	handler.AddDatabase("chain", boltDb)
+	handler.AddDatabase("state", badgerDb)
+
+	for _, raw := range []Database{boltDb, badgerDb} {
+		db := NewInstrumentedDatabase(raw, metrics)
+		ctx := db.GetContext([]byte("blocks")).NestContext([]byte{0xff, '"'})
+		require.NoError(db.Update(ctx, func(tx Transaction, ctx Context) error {
+			return tx.Set([]byte("key"), []byte("value"), ctx)
+		}))
+	}
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	require.Equal(prometheusContentType, recorder.Header().Get("Content-Type"))
+	body := recorder.Body.String()
+
+	for _, line := range []string{
+		`db_operations_total{backend="bolt",path="blocks/0xff22",operation="set"} 1`,
+		`db_operation_bytes_total{backend="badger",path="blocks/0xff22",operation="set"} 8`,
+		`db_operation_duration_seconds_bucket{backend="bolt",path="blocks/0xff22",operation="update",le="+Inf"} 1`,
+		`db_operation_duration_seconds_count{backend="badger",path="blocks/0xff22",operation="update"} 1`,
+		`badger_cache_hits_total{database="state",backend="badger",cache="index"} 0`,
+		`bolt_open_read_transactions{database="chain",backend="bolt"} 0`,
+	} {
+		require.Contains(body, line+"\n")
+	}
+	require.Contains(body, "# TYPE go_memstats_alloc_bytes gauge\n")
+
+	// Every family is declared once, before its samples.
+	declared := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSpace(body), "\n") {
+		if strings.HasPrefix(line, "# TYPE ") {
+			name := strings.Fields(line)[2]
+			require.False(declared[name], name)
+			declared[name] = true
+		}
+	}
+	require.Equal(`a\"b\\c\nd`, prometheusLabelEscaper.Replace("a\"b\\c\nd"))
+	require.Equal("blocks/0x2f", formatContextPath([][]byte{[]byte("blocks"), []byte("/")}))
+}
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"github.com/pkg/errors"
+	"io"
+	"math"
+	"sync"
+	"time"
+)
+
+type WritePriority byte
+
+const (
+	// PriorityForeground is for latency-sensitive writes.
+	PriorityForeground WritePriority = 0
+	// PriorityBackground is for compactions, migrations and bulk imports, which only
+	// write while no foreground write is waiting.
+	PriorityBackground WritePriority = 1
+
+	numWritePriorities = 2
+)
+
+func (priority WritePriority) String() string {
+	switch priority {
+	case PriorityForeground:
+		return "foreground"
+	case PriorityBackground:
+		return "background"
+	}
+	return "unknown"
+}
+
+type RateLimitOptions struct {
+	// TransactionsPerSecond limits the number of Updates. Zero doesn't limit them.
+	TransactionsPerSecond float64
+	// BytesPerSecond limits the bytes of the keys and values written by Updates and
+	// write batches. Zero doesn't limit them.
+	BytesPerSecond float64
+	// TransactionBurst and ByteBurst are the sizes of the buckets, the number of
+	// transactions or bytes that can be written at once after an idle period. Zero
+	// defaults to one second of the rate.
+	TransactionBurst float64
+	ByteBurst        float64
+}
+
+type RateLimitStats struct {
+	// QueueDepth is the number of writers waiting.
+	QueueDepth int
+	// MaxQueueDepth is the highest QueueDepth seen.
+	MaxQueueDepth int
+	// Admitted is the number of Updates and batch writes admitted.
+	Admitted uint64
+	// Waited is the number of Updates and batch writes that had to wait to be admitted.
+	Waited uint64
+	// Cancelled is the number of Updates whose Go context was done while waiting.
+	Cancelled uint64
+	// WaitTime is the total time writers waited.
+	WaitTime time.Duration
+	// Bytes is the number of bytes written.
+	Bytes uint64
+}
+
+// ==========================
+// RateLimitedDatabase
+// ==========================
+
+// RateLimitedDatabase admits Updates and write batches through token buckets that limit
+// the transactions and the bytes written per second. The bytes of an Update are only
+// known once it returns, so they are charged afterwards, and the bucket can go into debt
+// that delays the writers after it.
+//
+// Writers wait in one queue per priority, and a writer is only admitted once no writer
+// of a higher priority is waiting, so background writers yield to foreground ones and
+// can be starved by them. Every RateLimitedDatabase returned by WithPriority shares the
+// same buckets and queues.
+type RateLimitedDatabase struct {
+	db       Database
+	limiter  *rateLimiter
+	priority WritePriority
+}
+
+// NewRateLimitedDatabase returns a database whose writers are PriorityForeground.
+func NewRateLimitedDatabase(db Database, opts RateLimitOptions) *RateLimitedDatabase {
+	return &RateLimitedDatabase{
+		db:       db,
+		limiter:  newRateLimiter(opts),
+		priority: PriorityForeground,
+	}
+}
+
+// WithPriority returns the database for writers of another priority, to hand to a
+// migration or a bulk import.
+func (rdb *RateLimitedDatabase) WithPriority(priority WritePriority) (*RateLimitedDatabase, error) {
+	if priority >= numWritePriorities {
+		return nil, errors.Errorf("WithPriority: Unknown priority %v", priority)
+	}
+	return &RateLimitedDatabase{
+		db:       rdb.db,
+		limiter:  rdb.limiter,
+		priority: priority,
+	}, nil
+}
+
+// Stats returns the queue metrics of every priority.
+func (rdb *RateLimitedDatabase) Stats() map[WritePriority]RateLimitStats {
+	return rdb.limiter.snapshot()
+}
+
+func (rdb *RateLimitedDatabase) Setup() error {
+	return rdb.db.Setup()
+}
+
+func (rdb *RateLimitedDatabase) GetContext(id []byte) Context {
+	return rdb.db.GetContext(id)
+}
+
+func (rdb *RateLimitedDatabase) Update(ctx Context, fn func(Transaction, Context) error) error {
+	return rdb.UpdateContext(context.Background(), ctx, func(_ context.Context, tx Transaction, ctx Context) error {
+		return fn(tx, ctx)
+	})
+}
+
+func (rdb *RateLimitedDatabase) View(ctx Context, fn func(Transaction, Context) error) error {
+	return rdb.db.View(ctx, fn)
+}
+
+// UpdateContext waits to be admitted until goCtx is done.
+func (rdb *RateLimitedDatabase) UpdateContext(goCtx context.Context, ctx Context,
+	fn func(context.Context, Transaction, Context) error) error {
+
+	if err := rdb.limiter.wait(goCtx, rdb.priority, 1); err != nil {
+		return err
+	}
+	var written int
+	defer func() {
+		rdb.limiter.charge(rdb.priority, written)
+	}()
+	return UpdateContext(goCtx, rdb.db, ctx, func(goCtx context.Context, tx Transaction, ctx Context) error {
+		rtx := NewRateLimitedTransaction(tx)
+		// Every attempt is charged, since each one wrote to the database.
+		defer func() {
+			written += rtx.written
+		}()
+		return fn(goCtx, rtx, ctx)
+	})
+}
+
+func (rdb *RateLimitedDatabase) ViewContext(goCtx context.Context, ctx Context,
+	fn func(context.Context, Transaction, Context) error) error {
+
+	return ViewContext(goCtx, rdb.db, ctx, fn)
+}
+
+func (rdb *RateLimitedDatabase) NewWriteBatch() WriteBatch {
+	return NewRateLimitedWriteBatch(rdb, rdb.db.NewWriteBatch())
+}
+
+func (rdb *RateLimitedDatabase) Backup(w io.Writer) error {
+	return rdb.db.Backup(w)
+}
+
+func (rdb *RateLimitedDatabase) BackupSince(w io.Writer, since uint64) (uint64, error) {
+	return rdb.db.BackupSince(w, since)
+}
+
+func (rdb *RateLimitedDatabase) Restore(r io.Reader) error {
+	return rdb.db.Restore(r)
+}
+
+func (rdb *RateLimitedDatabase) Close() error {
+	return rdb.db.Close()
+}
+
+func (rdb *RateLimitedDatabase) Erase() error {
+	return rdb.db.Erase()
+}
+
+func (rdb *RateLimitedDatabase) Id() DatabaseId {
+	return rdb.db.Id()
+}
+
+func (rdb *RateLimitedDatabase) checkIntegrity(report *IntegrityReport) error {
+	return checkWrappedIntegrity(rdb.db, report)
+}
+
+func (rdb *RateLimitedDatabase) nestedContextIds(ctx Context) ([][]byte, error) {
+	return listNestedContextIds(rdb.db, ctx)
+}
+
+// ==========================
+// RateLimitedTransaction
+// ==========================
+
+// RateLimitedTransaction counts the bytes written by a transaction, to charge them once
+// it returns.
+type RateLimitedTransaction struct {
+	tx Transaction
+
+	written int
+}
+
+func NewRateLimitedTransaction(tx Transaction) *RateLimitedTransaction {
+	return &RateLimitedTransaction{
+		tx: tx,
+	}
+}
+
+func (rtx *RateLimitedTransaction) Set(key []byte, value []byte, ctx Context) error {
+	rtx.written += len(key) + len(value)
+	return rtx.tx.Set(key, value, ctx)
+}
+
+func (rtx *RateLimitedTransaction) Delete(key []byte, ctx Context) error {
+	rtx.written += len(key)
+	return rtx.tx.Delete(key, ctx)
+}
+
+func (rtx *RateLimitedTransaction) Get(key []byte, ctx Context) ([]byte, error) {
+	return rtx.tx.Get(key, ctx)
+}
+
+func (rtx *RateLimitedTransaction) MultiGet(keys [][]byte, ctx Context) ([][]byte, []bool, error) {
+	return rtx.tx.MultiGet(keys, ctx)
+}
+
+func (rtx *RateLimitedTransaction) GetIterator(ctx Context) (Iterator, error) {
+	return rtx.tx.GetIterator(ctx)
+}
+
+// ==========================
+// RateLimitedWriteBatch
+// ==========================
+
+// RateLimitedWriteBatch waits for the byte bucket to be out of debt before every write,
+// and charges the write right away. Batch writes don't take transaction tokens.
+type RateLimitedWriteBatch struct {
+	db *RateLimitedDatabase
+	wb WriteBatch
+}
+
+func NewRateLimitedWriteBatch(db *RateLimitedDatabase, wb WriteBatch) *RateLimitedWriteBatch {
+	return &RateLimitedWriteBatch{
+		db: db,
+		wb: wb,
+	}
+}
+
+func (rwb *RateLimitedWriteBatch) Set(key []byte, value []byte, ctx Context) error {
+	if err := rwb.admit(len(key) + len(value)); err != nil {
+		return err
+	}
+	return rwb.wb.Set(key, value, ctx)
+}
+
+func (rwb *RateLimitedWriteBatch) Delete(key []byte, ctx Context) error {
+	if err := rwb.admit(len(key)); err != nil {
+		return err
+	}
+	return rwb.wb.Delete(key, ctx)
+}
+
+func (rwb *RateLimitedWriteBatch) admit(size int) error {
+	if err := rwb.db.limiter.wait(context.Background(), rwb.db.priority, 0); err != nil {
+		return err
+	}
+	rwb.db.limiter.charge(rwb.db.priority, size)
+	return nil
+}
+
+func (rwb *RateLimitedWriteBatch) Flush() error {
+	return rwb.wb.Flush()
+}
+
+func (rwb *RateLimitedWriteBatch) Cancel() {
+	rwb.wb.Cancel()
+}
+
+// ==========================
+// rateLimiter
+// ==========================
+
+// rateLimiter holds the token buckets and the queues of waiting writers. Writers are
+// admitted in priority order and first come first served within a priority, by
+// dispatch, which runs whenever a writer arrives or leaves and when the tokens the
+// writer at the head of the queues needs have been refilled.
+type rateLimiter struct {
+	sync.Mutex
+
+	opts RateLimitOptions
+
+	transactions float64
+	bytes        float64
+	refilled     time.Time
+
+	queues [numWritePriorities]*list.List
+	timer  *time.Timer
+
+	stats [numWritePriorities]RateLimitStats
+}
+
+type rateLimitWaiter struct {
+	// transactions is the number of transaction tokens the writer takes.
+	transactions float64
+	enqueued     time.Time
+	ready        chan struct{}
+}
+
+func newRateLimiter(opts RateLimitOptions) *rateLimiter {
+	if opts.TransactionBurst <= 0 {
+		opts.TransactionBurst = math.Max(opts.TransactionsPerSecond, 1)
+	}
+	if opts.ByteBurst <= 0 {
+		opts.ByteBurst = math.Max(opts.BytesPerSecond, 1)
+	}
+	rl := &rateLimiter{
+		opts:         opts,
+		transactions: opts.TransactionBurst,
+		bytes:        opts.ByteBurst,
+		refilled:     time.Now(),
+	}
+	for ii := range rl.queues {
+		rl.queues[ii] = list.New()
+	}
+	return rl
+}
+
+// wait returns once the writer is admitted, having taken its transaction tokens, or
+// goCtx.Err() if goCtx is done first.
+func (rl *rateLimiter) wait(goCtx context.Context, priority WritePriority, transactions float64) error {
+	if err := goCtx.Err(); err != nil {
+		return err
+	}
+
+	rl.Lock()
+	waiter := &rateLimitWaiter{transactions: transactions, enqueued: time.Now(), ready: make(chan struct{})}
+	element := rl.queues[priority].PushBack(waiter)
+	stats := &rl.stats[priority]
+	stats.QueueDepth++
+	rl.dispatch()
+	if !rl.admitted(waiter) {
+		stats.Waited++
+		if stats.QueueDepth > stats.MaxQueueDepth {
+			stats.MaxQueueDepth = stats.QueueDepth
+		}
+	}
+	rl.Unlock()
+
+	select {
+	case <-waiter.ready:
+		return nil
+	case <-goCtx.Done():
+	}
+
+	rl.Lock()
+	defer rl.Unlock()
+	if rl.admitted(waiter) {
+		// Admitted while cancelled, so give the tokens back, and count it as cancelled
+		// only.
+		if rl.opts.TransactionsPerSecond > 0 {
+			rl.transactions += transactions
+		}
+		stats.Admitted--
+	} else {
+		rl.queues[priority].Remove(element)
+		stats.QueueDepth--
+	}
+	stats.Cancelled++
+	rl.dispatch()
+	return goCtx.Err()
+}
+
+func (rl *rateLimiter) admitted(waiter *rateLimitWaiter) bool {
+	select {
+	case <-waiter.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// charge takes bytes written from the byte bucket, which may go into debt.
+func (rl *rateLimiter) charge(priority WritePriority, bytes int) {
+	if bytes == 0 {
+		return
+	}
+	rl.Lock()
+	defer rl.Unlock()
+
+	rl.refill()
+	rl.stats[priority].Bytes += uint64(bytes)
+	if rl.opts.BytesPerSecond > 0 {
+		rl.bytes -= float64(bytes)
+	}
+}
+
+// dispatch admits the writers at the head of the queues, in priority order, as long as
+// there are tokens for them. Otherwise it schedules itself for when there will be.
+func (rl *rateLimiter) dispatch() {
+	rl.refill()
+	now := time.Now()
+	for priority, queue := range rl.queues {
+		for queue.Len() > 0 {
+			waiter := queue.Front().Value.(*rateLimitWaiter)
+			if delay := rl.delay(waiter); delay > 0 {
+				rl.schedule(delay)
+				return
+			}
+			if rl.opts.TransactionsPerSecond > 0 {
+				rl.transactions -= waiter.transactions
+			}
+			queue.Remove(queue.Front())
+			stats := &rl.stats[priority]
+			stats.QueueDepth--
+			stats.Admitted++
+			stats.WaitTime += now.Sub(waiter.enqueued)
+			close(waiter.ready)
+		}
+	}
+}
+
+// delay returns how long until the buckets have the tokens waiter needs.
+func (rl *rateLimiter) delay(waiter *rateLimitWaiter) time.Duration {
+	var seconds float64
+	if rl.opts.TransactionsPerSecond > 0 && rl.transactions < waiter.transactions {
+		seconds = (waiter.transactions - rl.transactions) / rl.opts.TransactionsPerSecond
+	}
+	if rl.opts.BytesPerSecond > 0 && rl.bytes < 0 {
+		seconds = math.Max(seconds, -rl.bytes/rl.opts.BytesPerSecond)
+	}
+	if seconds == 0 {
+		return 0
+	}
+	// Round up, so that the tokens are there when dispatch runs again.
+	return time.Duration(seconds*float64(time.Second)) + time.Millisecond
+}
+
+func (rl *rateLimiter) schedule(delay time.Duration) {
+	if rl.timer != nil {
+		// The pending dispatch reschedules itself if it is too early.
+		return
+	}
+	rl.timer = time.AfterFunc(delay, func() {
+		rl.Lock()
+		defer rl.Unlock()
+
+		rl.timer = nil
+		rl.dispatch()
+	})
+}
+
+func (rl *rateLimiter) refill() {
+	now := time.Now()
+	elapsed := now.Sub(rl.refilled).Seconds()
+	rl.refilled = now
+	rl.transactions = math.Min(rl.transactions+elapsed*rl.opts.TransactionsPerSecond, rl.opts.TransactionBurst)
+	rl.bytes = math.Min(rl.bytes+elapsed*rl.opts.BytesPerSecond, rl.opts.ByteBurst)
+}
+
+func (rl *rateLimiter) snapshot() map[WritePriority]RateLimitStats {
+	rl.Lock()
+	defer rl.Unlock()
+
+	stats := make(map[WritePriority]RateLimitStats, numWritePriorities)
+	for priority, priorityStats := range rl.stats {
+		stats[WritePriority(priority)] = priorityStats
+	}
+	return stats
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+// TestRateLimitedDatabase checks that Updates are limited by transactions and bytes per
+// second, and that waiting foreground writers are admitted before background ones.
+func TestRateLimitedDatabase(t *testing.T) {
+	require := require.New(t)
+
+	raw := newTestBoltDatabase("boltdb-ratelimit", t)
+	defer raw.Erase()
+	defer raw.Close()
+	db := NewRateLimitedDatabase(raw, RateLimitOptions{TransactionsPerSecond: 20, TransactionBurst: 1, BytesPerSecond: 1000})
+	background, err := db.WithPriority(PriorityBackground)
+	require.NoError(err)
+	_, err = db.WithPriority(numWritePriorities)
+	require.Error(err)
+	ctx := db.GetContext([]byte("blocks"))
+	set := func(key string, size int) func(Transaction, Context) error {
+		return func(tx Transaction, ctx Context) error {
+			return tx.Set([]byte(key), make([]byte, size-len(key)), ctx)
+		}
+	}
+
+	start := time.Now()
+	for ii := 0; ii < 5; ii++ {
+		require.NoError(db.Update(ctx, set("a", 10)))
+	}
+	// The first transaction takes the only token, and the next 4 wait 50ms each.
+	require.GreaterOrEqual(time.Since(start), 200*time.Millisecond)
+
+	// Going 1000 bytes into debt delays the next writer by a second, which a background
+	// writer waiting first spends queued behind a foreground one. Only one of them gets
+	// a transaction token once the debt is paid, so they commit 50ms apart.
+	require.NoError(background.Update(ctx, set("b", 2000)))
+	order := make(chan WritePriority, 2)
+	go func() {
+		require.NoError(background.Update(ctx, set("c", 1)))
+		order <- PriorityBackground
+	}()
+	require.Eventually(func() bool {
+		return db.Stats()[PriorityBackground].QueueDepth == 1
+	}, time.Second, time.Millisecond)
+	go func() {
+		require.NoError(db.Update(ctx, set("d", 1)))
+		order <- PriorityForeground
+	}()
+	require.Eventually(func() bool {
+		return db.Stats()[PriorityForeground].QueueDepth == 1
+	}, time.Second, time.Millisecond)
+
+	goCtx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(db.UpdateContext(goCtx, ctx, func(_ context.Context, tx Transaction, ctx Context) error {
+		return set("e", 1)(tx, ctx)
+	}), context.DeadlineExceeded)
+
+	require.Equal(PriorityForeground, <-order)
+	require.Equal(PriorityBackground, <-order)
+
+	stats := db.Stats()
+	require.Equal(uint64(6), stats[PriorityForeground].Admitted)
+	require.Equal(uint64(1), stats[PriorityForeground].Cancelled)
+	require.Equal(uint64(51), stats[PriorityForeground].Bytes)
+	require.Equal(2, stats[PriorityForeground].MaxQueueDepth)
+	require.Zero(stats[PriorityForeground].QueueDepth)
+	require.Equal(uint64(2), stats[PriorityBackground].Admitted)
+	require.Equal(uint64(2), stats[PriorityBackground].Waited)
+	require.GreaterOrEqual(stats[PriorityBackground].WaitTime, 900*time.Millisecond)
+}
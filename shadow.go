@@ -0,0 +1,589 @@
+package main
+
+import (
+	"bytes"
+	"github.com/pkg/errors"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+// ShadowStats counts the work a ShadowDatabase mirrored to its shadow.
+type ShadowStats struct {
+	// Reads is the number of reads compared against the shadow.
+	Reads uint64
+	// Mismatches is the number of compared reads where the shadow disagreed with the primary.
+	Mismatches uint64
+	// ShadowReadErrors is the number of reads that could not be compared because the
+	// shadow failed.
+	ShadowReadErrors uint64
+	// ShadowWrites is the number of transactions and batches replayed on the shadow.
+	ShadowWrites uint64
+	// ShadowWriteErrors is the number of replays that failed on the shadow. Each one
+	// leaves the shadow behind the primary.
+	ShadowWriteErrors uint64
+}
+
+// ==========================
+// ShadowDatabase
+// ==========================
+
+// ShadowDatabase serves every read and write from a primary Database and mirrors the
+// writes to a shadow Database, typically of another backend, so the two can be
+// compared under production traffic before cutting over.
+//
+// Reads made in View are compared against the shadow, and mismatches are logged and
+// counted, but callers always get the primary's result. The primary is authoritative:
+// a transaction is replayed on the shadow only once it has committed on the primary,
+// and a failure on the shadow is logged and counted instead of returned.
+type ShadowDatabase struct {
+	primary Database
+	shadow  Database
+
+	// updateLock orders the replays on the shadow the same way as the commits on the
+	// primary, at the cost of serializing Update. View holds it for reading while it
+	// opens both transactions, so that they see the same commits.
+	updateLock sync.RWMutex
+
+	reads             atomic.Uint64
+	mismatches        atomic.Uint64
+	shadowReadErrors  atomic.Uint64
+	shadowWrites      atomic.Uint64
+	shadowWriteErrors atomic.Uint64
+}
+
+func NewShadowDatabase(primary Database, shadow Database) *ShadowDatabase {
+	return &ShadowDatabase{
+		primary: primary,
+		shadow:  shadow,
+	}
+}
+
+func (sdb *ShadowDatabase) Setup() error {
+	if err := sdb.primary.Setup(); err != nil {
+		return errors.Wrapf(err, "Setup: Problem setting up primary")
+	}
+	return errors.Wrapf(sdb.shadow.Setup(), "Setup: Problem setting up shadow")
+}
+
+func (sdb *ShadowDatabase) GetContext(id []byte) Context {
+	return NewShadowContext(sdb.primary.GetContext(id), sdb.shadow.GetContext(id))
+}
+
+// Update runs fn in a primary transaction, recording its writes, and replays them on
+// the shadow in a single transaction once the primary commits. Reads made in Update
+// are not compared, since the shadow has not seen the transaction's writes yet.
+func (sdb *ShadowDatabase) Update(ctx Context, fn func(Transaction, Context) error) error {
+	shadowCtx, err := AssertContext[*ShadowContext](ctx, sdb.Id())
+	if err != nil {
+		return errors.Wrapf(err, "Update:")
+	}
+
+	sdb.updateLock.Lock()
+	defer sdb.updateLock.Unlock()
+
+	var mutations []*shadowMutation
+	err = sdb.primary.Update(shadowCtx.primary, func(tx Transaction, _ Context) error {
+		stx := NewShadowTransaction(sdb, tx, nil, false)
+		err := fn(stx, ctx)
+		mutations = stx.mutations
+		return err
+	})
+	if err != nil || len(mutations) == 0 {
+		return err
+	}
+
+	err = sdb.shadow.Update(shadowCtx.shadow, func(tx Transaction, _ Context) error {
+		for _, mutation := range mutations {
+			if err := mutation.apply(tx); err != nil {
+				return errors.Wrapf(err, "Problem replaying key %x in context %q", mutation.key, mutation.ctx.Path())
+			}
+		}
+		return nil
+	})
+	sdb.recordShadowWrite(err)
+	return nil
+}
+
+// View runs fn in a primary transaction and a shadow transaction at once, comparing
+// every read. If the shadow transaction cannot be opened, fn still runs against the
+// primary alone.
+func (sdb *ShadowDatabase) View(ctx Context, fn func(Transaction, Context) error) error {
+	shadowCtx, err := AssertContext[*ShadowContext](ctx, sdb.Id())
+	if err != nil {
+		return errors.Wrapf(err, "View:")
+	}
+
+	// An Update between opening the primary and the shadow transaction would show up
+	// as a mismatch, so both are opened while no Update runs.
+	sdb.updateLock.RLock()
+	locked := true
+	unlock := func() {
+		if locked {
+			locked = false
+			sdb.updateLock.RUnlock()
+		}
+	}
+	defer unlock()
+
+	return sdb.primary.View(shadowCtx.primary, func(primaryTx Transaction, _ Context) error {
+		called := false
+		err := sdb.shadow.View(shadowCtx.shadow, func(shadowTx Transaction, _ Context) error {
+			called = true
+			unlock()
+			return fn(NewShadowTransaction(sdb, primaryTx, shadowTx, true), ctx)
+		})
+		if called {
+			return err
+		}
+
+		unlock()
+		sdb.shadowReadErrors.Add(1)
+		log.Printf("ShadowDatabase: Problem opening shadow transaction: %v", err)
+		return fn(NewShadowTransaction(sdb, primaryTx, nil, true), ctx)
+	})
+}
+
+func (sdb *ShadowDatabase) NewWriteBatch() WriteBatch {
+	return NewShadowWriteBatch(sdb, sdb.primary.NewWriteBatch(), sdb.shadow.NewWriteBatch())
+}
+
+// Backup backs up the primary.
+func (sdb *ShadowDatabase) Backup(w io.Writer) error {
+	return sdb.primary.Backup(w)
+}
+
+func (sdb *ShadowDatabase) BackupSince(w io.Writer, since uint64) (uint64, error) {
+	return sdb.primary.BackupSince(w, since)
+}
+
+// Restore restores the backup into both databases, reading it only once.
+func (sdb *ShadowDatabase) Restore(r io.Reader) error {
+	pr, pw := io.Pipe()
+	shadowErr := make(chan error, 1)
+	go func() {
+		err := sdb.shadow.Restore(pr)
+		// Drain whatever the shadow did not read, so a failed shadow never stalls the primary.
+		io.Copy(io.Discard, pr)
+		shadowErr <- err
+	}()
+
+	err := sdb.primary.Restore(io.TeeReader(r, pw))
+	pw.CloseWithError(err)
+	if err != nil {
+		<-shadowErr
+		return errors.Wrapf(err, "Restore: Problem restoring primary")
+	}
+	return errors.Wrapf(<-shadowErr, "Restore: Problem restoring shadow")
+}
+
+func (sdb *ShadowDatabase) Close() error {
+	primaryErr := sdb.primary.Close()
+	shadowErr := sdb.shadow.Close()
+	if primaryErr != nil {
+		return errors.Wrapf(primaryErr, "Close: Problem closing primary")
+	}
+	return errors.Wrapf(shadowErr, "Close: Problem closing shadow")
+}
+
+func (sdb *ShadowDatabase) Erase() error {
+	primaryErr := sdb.primary.Erase()
+	shadowErr := sdb.shadow.Erase()
+	if primaryErr != nil {
+		return errors.Wrapf(primaryErr, "Erase: Problem erasing primary")
+	}
+	return errors.Wrapf(shadowErr, "Erase: Problem erasing shadow")
+}
+
+func (sdb *ShadowDatabase) Id() DatabaseId {
+	return sdb.primary.Id()
+}
+
+func (sdb *ShadowDatabase) Stats() ShadowStats {
+	return ShadowStats{
+		Reads:             sdb.reads.Load(),
+		Mismatches:        sdb.mismatches.Load(),
+		ShadowReadErrors:  sdb.shadowReadErrors.Load(),
+		ShadowWrites:      sdb.shadowWrites.Load(),
+		ShadowWriteErrors: sdb.shadowWriteErrors.Load(),
+	}
+}
+
+func (sdb *ShadowDatabase) recordShadowWrite(err error) {
+	sdb.shadowWrites.Add(1)
+	if err != nil {
+		sdb.shadowWriteErrors.Add(1)
+		log.Printf("ShadowDatabase: Problem writing to shadow: %v", err)
+	}
+}
+
+func (sdb *ShadowDatabase) recordShadowReadError(op string, ctx *ShadowContext, err error) {
+	sdb.shadowReadErrors.Add(1)
+	log.Printf("ShadowDatabase: Problem reading shadow in %v in context %q: %v", op, ctx.Path(), err)
+}
+
+// compare counts a read and reports whether the shadow agreed with the primary.
+func (sdb *ShadowDatabase) compare(op string, ctx *ShadowContext, key []byte,
+	primaryValue []byte, primaryFound bool, shadowValue []byte, shadowFound bool) bool {
+
+	sdb.reads.Add(1)
+	if primaryFound == shadowFound && bytes.Equal(primaryValue, shadowValue) {
+		return true
+	}
+	sdb.mismatches.Add(1)
+	log.Printf("ShadowDatabase: %v mismatch for key %x in context %q: primary found %v (%v bytes), "+
+		"shadow found %v (%v bytes)", op, key, ctx.Path(), primaryFound, len(primaryValue), shadowFound, len(shadowValue))
+	return false
+}
+
+// ==========================
+// ShadowTransaction
+// ==========================
+
+type ShadowTransaction struct {
+	db       *ShadowDatabase
+	primary  Transaction
+	shadow   Transaction
+	readOnly bool
+
+	// mutations are the writes to replay on the shadow, in order.
+	mutations []*shadowMutation
+}
+
+// NewShadowTransaction wraps a primary transaction. Reads are compared against shadow
+// unless it is nil.
+func NewShadowTransaction(db *ShadowDatabase, primary Transaction, shadow Transaction, readOnly bool) *ShadowTransaction {
+	return &ShadowTransaction{
+		db:       db,
+		primary:  primary,
+		shadow:   shadow,
+		readOnly: readOnly,
+	}
+}
+
+func (stx *ShadowTransaction) Set(key []byte, value []byte, ctx Context) error {
+	if stx.readOnly {
+		return errors.New("Set: Transaction is read-only")
+	}
+	shadowCtx, err := AssertContext[*ShadowContext](ctx, stx.db.Id())
+	if err != nil {
+		return errors.Wrapf(err, "Set:")
+	}
+	if err := stx.primary.Set(key, value, shadowCtx.primary); err != nil {
+		return err
+	}
+
+	stx.mutations = append(stx.mutations, &shadowMutation{
+		key:   append([]byte{}, key...),
+		value: append([]byte{}, value...),
+		ctx:   shadowCtx.shadow,
+	})
+	return nil
+}
+
+func (stx *ShadowTransaction) Delete(key []byte, ctx Context) error {
+	if stx.readOnly {
+		return errors.New("Delete: Transaction is read-only")
+	}
+	shadowCtx, err := AssertContext[*ShadowContext](ctx, stx.db.Id())
+	if err != nil {
+		return errors.Wrapf(err, "Delete:")
+	}
+	if err := stx.primary.Delete(key, shadowCtx.primary); err != nil {
+		return err
+	}
+
+	stx.mutations = append(stx.mutations, &shadowMutation{
+		key:    append([]byte{}, key...),
+		ctx:    shadowCtx.shadow,
+		delete: true,
+	})
+	return nil
+}
+
+func (stx *ShadowTransaction) Get(key []byte, ctx Context) ([]byte, error) {
+	shadowCtx, err := AssertContext[*ShadowContext](ctx, stx.db.Id())
+	if err != nil {
+		return nil, errors.Wrapf(err, "Get:")
+	}
+
+	value, err := stx.primary.Get(key, shadowCtx.primary)
+	primaryValue, primaryFound, primaryErr := getResult(value, err)
+	if stx.shadow == nil || primaryErr != nil {
+		return value, err
+	}
+
+	shadowValue, shadowFound, shadowErr := getResult(stx.shadow.Get(key, shadowCtx.shadow))
+	if shadowErr != nil {
+		stx.db.recordShadowReadError("Get", shadowCtx, shadowErr)
+	} else {
+		stx.db.compare("Get", shadowCtx, key, primaryValue, primaryFound, shadowValue, shadowFound)
+	}
+	return value, err
+}
+
+func (stx *ShadowTransaction) MultiGet(keys [][]byte, ctx Context) ([][]byte, []bool, error) {
+	shadowCtx, err := AssertContext[*ShadowContext](ctx, stx.db.Id())
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "MultiGet:")
+	}
+
+	values, found, err := stx.primary.MultiGet(keys, shadowCtx.primary)
+	if stx.shadow == nil || err != nil {
+		return values, found, err
+	}
+
+	shadowValues, shadowFound, shadowErr := stx.shadow.MultiGet(keys, shadowCtx.shadow)
+	if shadowErr != nil {
+		stx.db.recordShadowReadError("MultiGet", shadowCtx, shadowErr)
+		return values, found, nil
+	}
+	for ii := range keys {
+		stx.db.compare("MultiGet", shadowCtx, keys[ii], values[ii], found[ii], shadowValues[ii], shadowFound[ii])
+	}
+	return values, found, nil
+}
+
+func (stx *ShadowTransaction) GetIterator(ctx Context) (Iterator, error) {
+	shadowCtx, err := AssertContext[*ShadowContext](ctx, stx.db.Id())
+	if err != nil {
+		return nil, errors.Wrapf(err, "GetIterator:")
+	}
+
+	primaryIt, err := stx.primary.GetIterator(shadowCtx.primary)
+	if err != nil {
+		return nil, err
+	}
+	var shadowIt Iterator
+	if stx.shadow != nil {
+		if shadowIt, err = stx.shadow.GetIterator(shadowCtx.shadow); err != nil {
+			stx.db.recordShadowReadError("GetIterator", shadowCtx, err)
+			shadowIt = nil
+		}
+	}
+	return NewShadowIterator(stx.db, primaryIt, shadowIt, shadowCtx), nil
+}
+
+type shadowMutation struct {
+	key    []byte
+	value  []byte
+	ctx    Context
+	delete bool
+}
+
+func (mutation *shadowMutation) apply(tx Transaction) error {
+	if mutation.delete {
+		return tx.Delete(mutation.key, mutation.ctx)
+	}
+	return tx.Set(mutation.key, mutation.value, mutation.ctx)
+}
+
+// ==========================
+// ShadowWriteBatch
+// ==========================
+
+// ShadowWriteBatch writes every operation to a primary and a shadow batch. Since batches
+// are not atomic, writes are mirrored as they are made rather than after the primary
+// flushes, and the shadow batch stops receiving writes after its first failure.
+type ShadowWriteBatch struct {
+	db        *ShadowDatabase
+	primary   WriteBatch
+	shadow    WriteBatch
+	shadowErr error
+}
+
+func NewShadowWriteBatch(db *ShadowDatabase, primary WriteBatch, shadow WriteBatch) *ShadowWriteBatch {
+	return &ShadowWriteBatch{
+		db:      db,
+		primary: primary,
+		shadow:  shadow,
+	}
+}
+
+func (swb *ShadowWriteBatch) Set(key []byte, value []byte, ctx Context) error {
+	shadowCtx, err := AssertContext[*ShadowContext](ctx, swb.db.Id())
+	if err != nil {
+		return errors.Wrapf(err, "Set:")
+	}
+	if err := swb.primary.Set(key, value, shadowCtx.primary); err != nil {
+		return err
+	}
+	if swb.shadowErr == nil {
+		swb.shadowErr = swb.shadow.Set(key, value, shadowCtx.shadow)
+	}
+	return nil
+}
+
+func (swb *ShadowWriteBatch) Delete(key []byte, ctx Context) error {
+	shadowCtx, err := AssertContext[*ShadowContext](ctx, swb.db.Id())
+	if err != nil {
+		return errors.Wrapf(err, "Delete:")
+	}
+	if err := swb.primary.Delete(key, shadowCtx.primary); err != nil {
+		return err
+	}
+	if swb.shadowErr == nil {
+		swb.shadowErr = swb.shadow.Delete(key, shadowCtx.shadow)
+	}
+	return nil
+}
+
+func (swb *ShadowWriteBatch) Flush() error {
+	if err := swb.primary.Flush(); err != nil {
+		swb.shadow.Cancel()
+		return err
+	}
+	if swb.shadowErr == nil {
+		swb.shadowErr = swb.shadow.Flush()
+	} else {
+		swb.shadow.Cancel()
+	}
+	swb.db.recordShadowWrite(swb.shadowErr)
+	return nil
+}
+
+func (swb *ShadowWriteBatch) Cancel() {
+	swb.primary.Cancel()
+	swb.shadow.Cancel()
+}
+
+// ==========================
+// ShadowIterator
+// ==========================
+
+// ShadowIterator advances a primary and a shadow iterator in lockstep, comparing keys
+// and values. Once the two diverge every following entry would differ as well, so
+// only the first difference is reported.
+type ShadowIterator struct {
+	db       *ShadowDatabase
+	primary  Iterator
+	shadow   Iterator
+	ctx      *ShadowContext
+	diverged bool
+}
+
+// NewShadowIterator wraps a primary iterator. Entries are compared against shadow
+// unless it is nil, starting with the first entry, at which both iterators start.
+func NewShadowIterator(db *ShadowDatabase, primary Iterator, shadow Iterator, ctx *ShadowContext) *ShadowIterator {
+	sit := &ShadowIterator{
+		db:      db,
+		primary: primary,
+		shadow:  shadow,
+		ctx:     ctx,
+	}
+	if shadow != nil {
+		// Iterators don't report whether they start at an entry, but seeking to the
+		// first key does, without moving them.
+		sit.compareCurrent(primary.Seek(nil), shadow.Seek(nil))
+	}
+	return sit
+}
+
+func (sit *ShadowIterator) GetContext() Context {
+	return sit.ctx
+}
+
+func (sit *ShadowIterator) Value() ([]byte, error) {
+	return sit.primary.Value()
+}
+
+func (sit *ShadowIterator) Key() []byte {
+	return sit.primary.Key()
+}
+
+func (sit *ShadowIterator) localKey() []byte {
+	return iteratorLocalKey(sit.primary)
+}
+
+func (sit *ShadowIterator) Next() bool {
+	primaryValid := sit.primary.Next()
+	if sit.shadow == nil || sit.diverged {
+		return primaryValid
+	}
+	sit.compareCurrent(primaryValid, sit.shadow.Next())
+	return primaryValid
+}
+
+// Seek moves both iterators, which realigns them if they diverged.
+func (sit *ShadowIterator) Seek(key []byte) bool {
+	primaryValid := sit.primary.Seek(key)
+	if sit.shadow == nil {
+		return primaryValid
+	}
+	sit.diverged = false
+	sit.compareCurrent(primaryValid, sit.shadow.Seek(key))
+	return primaryValid
+}
+
+func (sit *ShadowIterator) compareCurrent(primaryValid bool, shadowValid bool) {
+	if !primaryValid && !shadowValid {
+		return
+	}
+	var primaryKey, primaryValue, shadowKey, shadowValue []byte
+	if primaryValid {
+		primaryKey = iteratorLocalKey(sit.primary)
+		value, err := sit.primary.Value()
+		if err != nil {
+			// The caller sees the same error when it reads the value.
+			sit.diverged = true
+			return
+		}
+		primaryValue = value
+	}
+	if shadowValid {
+		shadowKey = iteratorLocalKey(sit.shadow)
+		value, err := sit.shadow.Value()
+		if err != nil {
+			sit.diverged = true
+			sit.db.recordShadowReadError("Iterator", sit.ctx, err)
+			return
+		}
+		shadowValue = value
+	}
+
+	if !bytes.Equal(primaryKey, shadowKey) {
+		sit.diverged = true
+		sit.db.reads.Add(1)
+		sit.db.mismatches.Add(1)
+		log.Printf("ShadowDatabase: Iterator mismatch in context %q: primary at key %x, shadow at key %x",
+			sit.ctx.Path(), primaryKey, shadowKey)
+		return
+	}
+	sit.diverged = !sit.db.compare("Iterator", sit.ctx, primaryKey, primaryValue, primaryValid, shadowValue, shadowValid)
+}
+
+func (sit *ShadowIterator) Close() {
+	sit.primary.Close()
+	if sit.shadow != nil {
+		sit.shadow.Close()
+	}
+}
+
+// ==========================
+// ShadowContext
+// ==========================
+
+type ShadowContext struct {
+	primary Context
+	shadow  Context
+}
+
+func NewShadowContext(primary Context, shadow Context) *ShadowContext {
+	return &ShadowContext{
+		primary: primary,
+		shadow:  shadow,
+	}
+}
+
+func (sc *ShadowContext) Id() DatabaseId {
+	return sc.primary.Id()
+}
+
+func (sc *ShadowContext) NestContext(contextId []byte) Context {
+	return NewShadowContext(sc.primary.NestContext(contextId), sc.shadow.NestContext(contextId))
+}
+
+func (sc *ShadowContext) Path() [][]byte {
+	return sc.primary.Path()
+}
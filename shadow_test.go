@@ -0,0 +1,82 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+// TestShadowDatabase runs Bolt in shadow behind Badger, then diverges the shadow and checks
+// that reads report the difference while still being served from the primary.
+func TestShadowDatabase(t *testing.T) {
+	require := require.New(t)
+
+	primary := newTestBadgerDatabase("badgerdb-shadow-primary", t)
+	shadow := newTestBoltDatabase("boltdb-shadow", t)
+	db := NewShadowDatabase(primary, shadow)
+	defer db.Erase()
+	defer db.Close()
+
+	populateBackupTestDatabase(db, t)
+	balances := db.GetContext([]byte("accounts")).NestContext([]byte("balances"))
+	require.NoError(db.Update(balances, func(tx Transaction, ctx Context) error {
+		return tx.Delete([]byte{'k', 0}, ctx)
+	}))
+	require.Equal(uint64(4), db.Stats().ShadowWrites)
+
+	var primaryBackup, shadowBackup []*BackupRecord
+	require.NoError(forEachRecord(primary, func(record *BackupRecord) error {
+		primaryBackup = append(primaryBackup, record)
+		return nil
+	}))
+	require.NoError(forEachRecord(shadow, func(record *BackupRecord) error {
+		shadowBackup = append(shadowBackup, record)
+		return nil
+	}))
+	require.Len(primaryBackup, 29)
+	require.ElementsMatch(primaryBackup, shadowBackup)
+
+	var keys [][]byte
+	for ii := 0; ii < 10; ii++ {
+		keys = append(keys, []byte{'k', byte(ii)})
+	}
+	readAll := func() {
+		require.NoError(db.View(balances, func(tx Transaction, ctx Context) error {
+			_, found, err := tx.MultiGet(keys, ctx)
+			require.NoError(err)
+			require.False(found[0])
+			_, err = tx.Get([]byte{'k', 2}, ctx)
+			require.NoError(err)
+
+			it, err := tx.GetIterator(ctx)
+			require.NoError(err)
+			defer it.Close()
+			for it.Next() {
+			}
+			return nil
+		}))
+	}
+	readAll()
+	require.Zero(db.Stats().Mismatches)
+	require.Greater(db.Stats().Reads, uint64(11))
+
+	// Diverge the shadow behind the wrapper's back.
+	require.NoError(shadow.Update(balances.(*ShadowContext).shadow, func(tx Transaction, ctx Context) error {
+		return tx.Set([]byte{'k', 2}, []byte("stale"), ctx)
+	}))
+	readAll()
+	// MultiGet, Get and the iterator each see the stale key.
+	require.Equal(uint64(3), db.Stats().Mismatches)
+	require.Zero(db.Stats().ShadowWriteErrors)
+
+	// The entry an iterator starts at is compared without moving it.
+	require.NoError(shadow.Update(balances.(*ShadowContext).shadow, func(tx Transaction, ctx Context) error {
+		return tx.Set([]byte{'k', 1}, []byte("stale"), ctx)
+	}))
+	require.NoError(db.View(balances, func(tx Transaction, ctx Context) error {
+		it, err := tx.GetIterator(ctx)
+		require.NoError(err)
+		it.Close()
+		return nil
+	}))
+	require.Equal(uint64(4), db.Stats().Mismatches)
+}
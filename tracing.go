@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"go.opencensus.io/trace"
+	"io"
+	"time"
+)
+
+const (
+	// DefaultTracingSlowThreshold is the latency above which reads get their own span.
+	DefaultTracingSlowThreshold = 10 * time.Millisecond
+)
+
+type TracingOptions struct {
+	// SlowThreshold is the latency above which a Get, MultiGet or iterator call gets a
+	// child span of its transaction. Zero gives every call a span.
+	SlowThreshold time.Duration
+}
+
+func DefaultTracingOptions() TracingOptions {
+	return TracingOptions{
+		SlowThreshold: DefaultTracingSlowThreshold,
+	}
+}
+
+// ==========================
+// TracedDatabase
+// ==========================
+
+// TracedDatabase records an OpenCensus span for every Update and View, annotated with
+// the backend, the context path, the number of operations and bytes written, and the
+// commit latency. Through UpdateContext and ViewContext, the span is a child of the span
+// in the given Go context, and is itself in the Go context handed to fn.
+//
+// Reads slower than opts.SlowThreshold get a child span. OpenCensus can't backdate a
+// span, so those spans are recorded when the read returns, and carry its latency as an
+// attribute instead.
+type TracedDatabase struct {
+	db   Database
+	opts TracingOptions
+}
+
+func NewTracedDatabase(db Database, opts TracingOptions) *TracedDatabase {
+	return &TracedDatabase{
+		db:   db,
+		opts: opts,
+	}
+}
+
+func (tdb *TracedDatabase) Setup() error {
+	return tdb.db.Setup()
+}
+
+func (tdb *TracedDatabase) GetContext(id []byte) Context {
+	return tdb.db.GetContext(id)
+}
+
+func (tdb *TracedDatabase) Update(ctx Context, fn func(Transaction, Context) error) error {
+	return tdb.UpdateContext(context.Background(), ctx, func(_ context.Context, tx Transaction, ctx Context) error {
+		return fn(tx, ctx)
+	})
+}
+
+func (tdb *TracedDatabase) View(ctx Context, fn func(Transaction, Context) error) error {
+	return tdb.ViewContext(context.Background(), ctx, func(_ context.Context, tx Transaction, ctx Context) error {
+		return fn(tx, ctx)
+	})
+}
+
+func (tdb *TracedDatabase) UpdateContext(goCtx context.Context, ctx Context,
+	fn func(context.Context, Transaction, Context) error) error {
+
+	return tdb.trace(goCtx, "db.Update", ctx, UpdateContext, fn)
+}
+
+func (tdb *TracedDatabase) ViewContext(goCtx context.Context, ctx Context,
+	fn func(context.Context, Transaction, Context) error) error {
+
+	return tdb.trace(goCtx, "db.View", ctx, ViewContext, fn)
+}
+
+// trace runs fn in a transaction opened by run, under a new span.
+func (tdb *TracedDatabase) trace(goCtx context.Context, name string, ctx Context,
+	run func(context.Context, Database, Context, func(context.Context, Transaction, Context) error) error,
+	fn func(context.Context, Transaction, Context) error) error {
+
+	goCtx, span := trace.StartSpan(goCtx, name)
+	defer span.End()
+
+	var ttx *TracedTransaction
+	var fnEnd time.Time
+	err := run(goCtx, tdb.db, ctx, func(goCtx context.Context, tx Transaction, ctx Context) error {
+		ttx = NewTracedTransaction(tdb, goCtx, tx)
+		err := fn(goCtx, ttx, ctx)
+		fnEnd = time.Now()
+		return err
+	})
+
+	span.AddAttributes(
+		trace.StringAttribute("db.backend", tdb.db.Id().String()),
+		trace.StringAttribute("db.path", formatContextPath(ctx.Path())),
+	)
+	if ttx != nil {
+		span.AddAttributes(
+			trace.Int64Attribute("db.operations", int64(ttx.operations)),
+			trace.Int64Attribute("db.bytes_written", int64(ttx.bytesWritten)),
+		)
+	}
+	if !fnEnd.IsZero() {
+		// The transaction commits, or is discarded for a view, once fn returns.
+		span.AddAttributes(trace.Int64Attribute("db.commit_latency_us", time.Since(fnEnd).Microseconds()))
+	}
+	if err != nil {
+		span.SetStatus(trace.Status{Code: trace.StatusCodeUnknown, Message: err.Error()})
+	}
+	return err
+}
+
+func (tdb *TracedDatabase) NewWriteBatch() WriteBatch {
+	return tdb.db.NewWriteBatch()
+}
+
+func (tdb *TracedDatabase) Backup(w io.Writer) error {
+	return tdb.db.Backup(w)
+}
+
+func (tdb *TracedDatabase) BackupSince(w io.Writer, since uint64) (uint64, error) {
+	return tdb.db.BackupSince(w, since)
+}
+
+func (tdb *TracedDatabase) Restore(r io.Reader) error {
+	return tdb.db.Restore(r)
+}
+
+func (tdb *TracedDatabase) Close() error {
+	return tdb.db.Close()
+}
+
+func (tdb *TracedDatabase) Erase() error {
+	return tdb.db.Erase()
+}
+
+func (tdb *TracedDatabase) Id() DatabaseId {
+	return tdb.db.Id()
+}
+
+func (tdb *TracedDatabase) checkIntegrity(report *IntegrityReport) error {
+	return checkWrappedIntegrity(tdb.db, report)
+}
+
+func (tdb *TracedDatabase) nestedContextIds(ctx Context) ([][]byte, error) {
+	return listNestedContextIds(tdb.db, ctx)
+}
+
+// traceSlow records a span for a call that started at start, if it was slow.
+func (tdb *TracedDatabase) traceSlow(goCtx context.Context, name string, path [][]byte, start time.Time, size int) {
+	latency := time.Since(start)
+	if latency < tdb.opts.SlowThreshold {
+		return
+	}
+	_, span := trace.StartSpan(goCtx, name)
+	span.AddAttributes(
+		trace.StringAttribute("db.path", formatContextPath(path)),
+		trace.Int64Attribute("db.latency_us", latency.Microseconds()),
+		trace.Int64Attribute("db.bytes_read", int64(size)),
+	)
+	span.End()
+}
+
+// ==========================
+// TracedTransaction
+// ==========================
+
+// TracedTransaction counts the operations of a transaction. It is used by a single
+// goroutine, like the transaction it wraps.
+type TracedTransaction struct {
+	db    *TracedDatabase
+	goCtx context.Context
+	tx    Transaction
+
+	operations   int
+	bytesWritten int
+}
+
+func NewTracedTransaction(db *TracedDatabase, goCtx context.Context, tx Transaction) *TracedTransaction {
+	return &TracedTransaction{
+		db:    db,
+		goCtx: goCtx,
+		tx:    tx,
+	}
+}
+
+func (ttx *TracedTransaction) Set(key []byte, value []byte, ctx Context) error {
+	ttx.operations++
+	ttx.bytesWritten += len(key) + len(value)
+	return ttx.tx.Set(key, value, ctx)
+}
+
+func (ttx *TracedTransaction) Delete(key []byte, ctx Context) error {
+	ttx.operations++
+	ttx.bytesWritten += len(key)
+	return ttx.tx.Delete(key, ctx)
+}
+
+func (ttx *TracedTransaction) Get(key []byte, ctx Context) ([]byte, error) {
+	ttx.operations++
+	start := time.Now()
+	value, err := ttx.tx.Get(key, ctx)
+	ttx.db.traceSlow(ttx.goCtx, "db.Get", ctx.Path(), start, len(value))
+	return value, err
+}
+
+func (ttx *TracedTransaction) MultiGet(keys [][]byte, ctx Context) ([][]byte, []bool, error) {
+	ttx.operations += len(keys)
+	start := time.Now()
+	values, found, err := ttx.tx.MultiGet(keys, ctx)
+	size := 0
+	for _, value := range values {
+		size += len(value)
+	}
+	ttx.db.traceSlow(ttx.goCtx, "db.MultiGet", ctx.Path(), start, size)
+	return values, found, err
+}
+
+func (ttx *TracedTransaction) GetIterator(ctx Context) (Iterator, error) {
+	it, err := ttx.tx.GetIterator(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return NewTracedIterator(ttx, it, ctx.Path()), nil
+}
+
+// ==========================
+// TracedIterator
+// ==========================
+
+type TracedIterator struct {
+	tx   *TracedTransaction
+	it   Iterator
+	path [][]byte
+}
+
+func NewTracedIterator(tx *TracedTransaction, it Iterator, path [][]byte) *TracedIterator {
+	return &TracedIterator{
+		tx:   tx,
+		it:   it,
+		path: path,
+	}
+}
+
+func (tit *TracedIterator) GetContext() Context {
+	return tit.it.GetContext()
+}
+
+func (tit *TracedIterator) Value() ([]byte, error) {
+	return tit.it.Value()
+}
+
+func (tit *TracedIterator) Key() []byte {
+	return tit.it.Key()
+}
+
+func (tit *TracedIterator) localKey() []byte {
+	return iteratorLocalKey(tit.it)
+}
+
+func (tit *TracedIterator) Next() bool {
+	tit.tx.operations++
+	start := time.Now()
+	valid := tit.it.Next()
+	tit.tx.db.traceSlow(tit.tx.goCtx, "db.Iterator.Next", tit.path, start, 0)
+	return valid
+}
+
+func (tit *TracedIterator) Seek(key []byte) bool {
+	tit.tx.operations++
+	start := time.Now()
+	valid := tit.it.Seek(key)
+	tit.tx.db.traceSlow(tit.tx.goCtx, "db.Iterator.Seek", tit.path, start, 0)
+	return valid
+}
+
+func (tit *TracedIterator) Close() {
+	tit.it.Close()
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"go.opencensus.io/trace"
+	"sync"
+	"testing"
+)
+
+type recordingExporter struct {
+	sync.Mutex
+	spans []*trace.SpanData
+}
+
+func (re *recordingExporter) ExportSpan(span *trace.SpanData) {
+	re.Lock()
+	defer re.Unlock()
+	re.spans = append(re.spans, span)
+}
+
+// TestTracedDatabase follows a request span down into an update and its reads.
+func TestTracedDatabase(t *testing.T) {
+	require := require.New(t)
+
+	exporter := &recordingExporter{}
+	trace.RegisterExporter(exporter)
+	defer trace.UnregisterExporter(exporter)
+	trace.ApplyConfig(trace.Config{DefaultSampler: trace.AlwaysSample()})
+	defer trace.ApplyConfig(trace.Config{DefaultSampler: trace.ProbabilitySampler(1e-4)})
+
+	raw := newTestBoltDatabase("boltdb-traced", t)
+	defer raw.Erase()
+	defer raw.Close()
+	db := NewTracedDatabase(raw, TracingOptions{SlowThreshold: 0})
+	ctx := db.GetContext([]byte("blocks"))
+
+	goCtx, request := trace.StartSpan(context.Background(), "api.PutBlock")
+	err := UpdateContext(goCtx, db, ctx, func(goCtx context.Context, tx Transaction, ctx Context) error {
+		require.Equal(request.SpanContext().TraceID, trace.FromContext(goCtx).SpanContext().TraceID)
+		if err := tx.Set([]byte("key"), []byte("value"), ctx); err != nil {
+			return err
+		}
+		_, err := tx.Get([]byte("key"), ctx)
+		return err
+	})
+	require.NoError(err)
+	request.End()
+
+	spans := make(map[string]*trace.SpanData)
+	for _, span := range exporter.spans {
+		spans[span.Name] = span
+	}
+	update, get := spans["db.Update"], spans["db.Get"]
+	require.NotNil(update)
+	require.NotNil(get)
+	require.Equal(request.SpanContext().SpanID, update.ParentSpanID)
+	require.Equal(update.SpanID, get.ParentSpanID)
+	require.Equal("bolt", update.Attributes["db.backend"])
+	require.Equal("blocks", update.Attributes["db.path"])
+	require.Equal(int64(2), update.Attributes["db.operations"])
+	require.Equal(int64(len("keyvalue")), update.Attributes["db.bytes_written"])
+	require.Contains(update.Attributes, "db.commit_latency_us")
+	require.Equal(int64(len("value")), get.Attributes["db.bytes_read"])
+}
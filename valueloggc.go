@@ -0,0 +1,227 @@
+package main
+
+import (
+	"github.com/dgraph-io/badger/v4"
+	"github.com/pkg/errors"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultValueLogGCInterval is how often the value log is collected when the
+	// database is not under write load.
+	DefaultValueLogGCInterval = 5 * time.Minute
+
+	// DefaultValueLogGCDiscardRatio is the fraction of a value log file that must be
+	// stale before the file is rewritten, the ratio Badger recommends.
+	DefaultValueLogGCDiscardRatio = 0.5
+)
+
+type ValueLogGCOptions struct {
+	// Interval is the time between collections when the database is not under write load.
+	Interval time.Duration
+	// MaxInterval caps the back-off under write load. Every interval found under load
+	// doubles the wait, and the first one found idle resets it to Interval.
+	MaxInterval time.Duration
+	// DiscardRatio is the fraction of a value log file that must be stale for the file
+	// to be rewritten. Lower ratios reclaim more space at the cost of more rewrites.
+	DiscardRatio float64
+	// MaxWritesPerInterval is the number of keys written or deleted during an interval
+	// above which the database is considered under write load, and the collection is
+	// skipped. Zero collects regardless of load.
+	MaxWritesPerInterval uint64
+	// MaxRewritesPerRun bounds the number of value log files rewritten by a single
+	// collection. Zero rewrites files until none qualifies.
+	MaxRewritesPerRun int
+}
+
+func DefaultValueLogGCOptions() ValueLogGCOptions {
+	return ValueLogGCOptions{
+		Interval:             DefaultValueLogGCInterval,
+		MaxInterval:          8 * DefaultValueLogGCInterval,
+		DiscardRatio:         DefaultValueLogGCDiscardRatio,
+		MaxWritesPerInterval: 100000,
+	}
+}
+
+type ValueLogGCStats struct {
+	// Runs is the number of collections run.
+	Runs uint64
+	// Skipped is the number of collections skipped because of write load.
+	Skipped uint64
+	// Rewrites is the number of value log files rewritten.
+	Rewrites uint64
+	// ReclaimedBytes is the total shrinkage of the value log across collections. Files
+	// still read by open transactions are only removed once those finish, so the space
+	// of a rewrite may be counted by a later collection.
+	ReclaimedBytes uint64
+	// Errors is the number of collections that failed. Errors are logged, and the
+	// scheduler keeps running.
+	Errors uint64
+	// LastRun is when the last collection finished, zero if none has run.
+	LastRun time.Time
+}
+
+// ==========================
+// valueLogGC
+// ==========================
+
+// valueLogGC runs Badger's value log garbage collection in the background. Badger
+// compacts its LSM tree by itself, but never reclaims the value log files holding
+// overwritten and deleted values, so without it the disk usage of a database with
+// deletes grows without bound.
+type valueLogGC struct {
+	db   *badger.DB
+	dir  string
+	opts ValueLogGCOptions
+
+	// writes is the number of keys written or deleted, counted by BadgerDatabase.
+	writes *atomic.Uint64
+
+	stop chan struct{}
+	done chan struct{}
+
+	statsLock sync.Mutex
+	stats     ValueLogGCStats
+}
+
+func newValueLogGC(db *badger.DB, dir string, opts ValueLogGCOptions, writes *atomic.Uint64) *valueLogGC {
+	return &valueLogGC{
+		db:     db,
+		dir:    dir,
+		opts:   opts,
+		writes: writes,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+func (gc *valueLogGC) start() {
+	go gc.run()
+}
+
+// close stops the scheduler, waiting for a running collection to finish, so the
+// database can be closed right after.
+func (gc *valueLogGC) close() {
+	close(gc.stop)
+	<-gc.done
+}
+
+func (gc *valueLogGC) run() {
+	defer close(gc.done)
+
+	interval := gc.opts.Interval
+	lastWrites := gc.writes.Load()
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-gc.stop:
+			return
+		case <-timer.C:
+		}
+
+		writes := gc.writes.Load()
+		underLoad := gc.opts.MaxWritesPerInterval > 0 && writes-lastWrites > gc.opts.MaxWritesPerInterval
+		lastWrites = writes
+		if underLoad {
+			gc.statsLock.Lock()
+			gc.stats.Skipped++
+			gc.statsLock.Unlock()
+			interval *= 2
+			if interval > gc.opts.MaxInterval {
+				interval = gc.opts.MaxInterval
+			}
+		} else {
+			interval = gc.opts.Interval
+			if err := gc.collect(); err != nil {
+				log.Printf("valueLogGC: %v", err)
+			}
+		}
+		timer.Reset(interval)
+	}
+}
+
+// collect rewrites value log files until none qualifies, the run's budget is spent, or
+// the scheduler is stopped.
+func (gc *valueLogGC) collect() error {
+	before, err := gc.valueLogSize()
+	if err != nil {
+		return errors.Wrapf(err, "collect: Problem measuring value log")
+	}
+
+	var rewrites uint64
+	for gc.opts.MaxRewritesPerRun == 0 || rewrites < uint64(gc.opts.MaxRewritesPerRun) {
+		if gc.stopped() {
+			break
+		}
+		if err = gc.db.RunValueLogGC(gc.opts.DiscardRatio); err != nil {
+			break
+		}
+		rewrites++
+	}
+	// ErrNoRewrite means no file qualified, and ErrRejected that a collection is
+	// already running, which the next interval retries.
+	if errors.Is(err, badger.ErrNoRewrite) || errors.Is(err, badger.ErrRejected) {
+		err = nil
+	}
+
+	after, sizeErr := gc.valueLogSize()
+	gc.statsLock.Lock()
+	defer gc.statsLock.Unlock()
+	gc.stats.Runs++
+	gc.stats.Rewrites += rewrites
+	if sizeErr == nil && after < before {
+		gc.stats.ReclaimedBytes += uint64(before - after)
+	}
+	if err != nil {
+		gc.stats.Errors++
+	}
+	gc.stats.LastRun = time.Now()
+	return errors.Wrapf(err, "collect: Problem collecting value log")
+}
+
+// valueLogSize sums the value log files on disk. Badger's own size estimate is only
+// refreshed every minute, which would miss the effect of a collection.
+func (gc *valueLogGC) valueLogSize() (int64, error) {
+	entries, err := os.ReadDir(gc.dir)
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".vlog") {
+			continue
+		}
+		info, err := entry.Info()
+		if os.IsNotExist(err) {
+			// Removed by a concurrent rewrite.
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		size += info.Size()
+	}
+	return size, nil
+}
+
+func (gc *valueLogGC) stopped() bool {
+	select {
+	case <-gc.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (gc *valueLogGC) snapshot() ValueLogGCStats {
+	gc.statsLock.Lock()
+	defer gc.statsLock.Unlock()
+
+	return gc.stats
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestValueLogGC overwrites values stored in the value log, and checks that the scheduler
+// backs off while they are written, collects once the writes stop, and stops on Close.
+func TestValueLogGC(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := os.MkdirTemp("", "badgerdb-valueloggc")
+	require.NoError(err)
+	opts := DefaultBadgerOptions(dir)
+	opts.ValueThreshold = 64
+	opts.ValueLogFileSize = 1 << 20
+	// Small tables get flushed and compacted, which records the stale values the
+	// collection needs to pick files.
+	opts.MemTableSize = 1 << 17
+	opts.BaseTableSize = 1 << 16
+	opts.NumLevelZeroTables = 1
+	gcOpts := DefaultValueLogGCOptions()
+	gcOpts.Interval = 20 * time.Millisecond
+	gcOpts.MaxInterval = 40 * time.Millisecond
+	gcOpts.MaxWritesPerInterval = 10
+	// Intervals that would spin or shrink under load are replaced.
+	unset := NewBadgerDatabaseWithValueLogGC(opts, ValueLogGCOptions{MaxInterval: time.Second})
+	require.Equal(DefaultValueLogGCInterval, unset.gcOpts.Interval)
+	require.Equal(DefaultValueLogGCInterval, unset.gcOpts.MaxInterval)
+
+	db := NewBadgerDatabaseWithValueLogGC(opts, gcOpts)
+	require.NoError(db.Setup())
+	defer db.Erase()
+
+	ctx := db.GetContext([]byte("blocks"))
+	value, err := RandomBytes(1024)
+	require.NoError(err)
+	for round := 0; round < 20; round++ {
+		for batch := 0; batch < 5; batch++ {
+			require.NoError(db.Update(ctx, func(tx Transaction, ctx Context) error {
+				for ii := batch * 100; ii < (batch+1)*100; ii++ {
+					if err := tx.Set([]byte{byte(ii >> 8), byte(ii)}, value, ctx); err != nil {
+						return err
+					}
+				}
+				return nil
+			}))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	require.NotZero(db.ValueLogGCStats().Skipped)
+
+	require.Eventually(func() bool {
+		return db.ValueLogGCStats().Runs > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	stats := db.ValueLogGCStats()
+	require.Zero(stats.Errors)
+	// Only the last round is live, so collections rewrite the files of the others.
+	require.Eventually(func() bool {
+		stats = db.ValueLogGCStats()
+		return stats.Rewrites > 0 && stats.ReclaimedBytes > 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.NoError(db.Close())
+	// No collection runs once the database is closed.
+	stats = db.ValueLogGCStats()
+	time.Sleep(3 * gcOpts.Interval)
+	require.Equal(stats, db.ValueLogGCStats())
+}